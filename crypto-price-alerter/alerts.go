@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"crypto-price-alerter/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Alert types
+const (
+	// Price crossed Threshold in Direction
+	AlertTypeThreshold = "threshold"
+	// Price moved by at least Percent in Direction within Window
+	AlertTypePercentChange = "percentChange"
+	// Price is higher than any price in the last Days days
+	AlertTypeNewHigh = "newHigh"
+	// Price is lower than any price in the last Days days
+	AlertTypeNewLow = "newLow"
+)
+
+// `alerts` collection document structure
+type AlertDB struct {
+	ID string `bson:"_id,omitempty"`
+	// Crypto Name
+	Name string `bson:"name"`
+	// One of "threshold", "percentChange", "newHigh" or "newLow"
+	Type string `bson:"type"`
+	// "above" or "below", used by threshold and percentChange alerts
+	Direction string  `bson:"direction"`
+	Threshold float32 `bson:"threshold"`
+	Percent   float32 `bson:"percent"`
+	// Go duration, e.g. "1h"
+	Window string `bson:"window"`
+	Days   int64  `bson:"days"`
+	// Minimum time between firings. Zero uses the default cooldown
+	CooldownSeconds int64 `bson:"cooldownSeconds"`
+	// Kafka event time of the tick that last fired the alert
+	LastFiredAt int64 `bson:"lastFiredAt,omitempty"`
+	// Webhooks notified in addition to ALERT_WEBHOOK_URLS
+	Webhooks []string `bson:"webhooks"`
+	Enabled  bool     `bson:"enabled"`
+}
+
+// Event published to `crypto.price.alerts` and sent to webhooks
+type AlertFiring struct {
+	// Unique for an alert and tick, used by receivers to de-duplicate
+	ID       string   `json:"id"`
+	AlertId  string   `json:"alertId"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Price    float32  `json:"price"`
+	Time     int64    `json:"time"`
+	Message  string   `json:"message"`
+	Webhooks []string `json:"-"`
+}
+
+// Evaluates alert definitions against incoming ticks
+type AlertEvaluator struct {
+	client *mongo.Client
+	// Cooldown used when an alert does not define one
+	defaultCooldown time.Duration
+	// Alert definitions, reloaded by refresh
+	mu     sync.RWMutex
+	alerts []AlertDB
+	// Last tick seen per crypto, used to detect threshold crossings
+	lastTicks map[string]lastTick
+}
+
+// Price and Kafka event time of a tick
+type lastTick struct {
+	price     float32
+	checkedAt int64
+}
+
+func NewAlertEvaluator(client *mongo.Client, defaultCooldown time.Duration) *AlertEvaluator {
+	return &AlertEvaluator{
+		client:          client,
+		defaultCooldown: defaultCooldown,
+		lastTicks:       map[string]lastTick{},
+	}
+}
+
+// Reload enabled alert definitions from the `alerts` collection
+func (a *AlertEvaluator) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := a.client.Database("crypto").Collection("alerts")
+	cursor, err := collection.Find(ctx, bson.M{"enabled": true})
+	if err != nil {
+		return err
+	}
+	var alerts []AlertDB
+	if err = cursor.All(ctx, &alerts); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.alerts = alerts
+	a.mu.Unlock()
+	return nil
+}
+
+// Reload alert definitions every interval until ctx is cancelled
+func (a *AlertEvaluator) refreshEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.refresh(); err != nil {
+				log.Printf("Could not reload alerts: %v\n", err)
+			}
+		}
+	}
+}
+
+// Evaluate all alerts for a crypto against a tick and return the alerts that
+// fired. Alerts within their cooldown are claimed atomically in Mongo, so
+// several alerter instances never fire the same alert twice.
+// Ticks older than the last tick seen for the crypto arrived out of order and are
+// ignored, since comparing them with a newer price would report false crossings.
+func (a *AlertEvaluator) evaluate(cryptoId string, price float32, checkedAt int64) ([]AlertFiring, error) {
+	previous, hasPrevious := a.lastTicks[cryptoId]
+	if hasPrevious && checkedAt < previous.checkedAt {
+		log.Printf("Ignoring out of order %s tick @%d, already saw a tick @%d\n", cryptoId, checkedAt, previous.checkedAt)
+		return nil, nil
+	}
+	a.lastTicks[cryptoId] = lastTick{price: price, checkedAt: checkedAt}
+
+	a.mu.RLock()
+	alerts := a.alerts
+	a.mu.RUnlock()
+	var firings []AlertFiring
+	var errs []error
+	for _, alert := range alerts {
+		if alert.Name != cryptoId {
+			continue
+		}
+		var message string
+		var err error
+		switch alert.Type {
+		case AlertTypeThreshold:
+			if hasPrevious {
+				message = thresholdCrossed(alert, previous.price, price)
+			}
+		case AlertTypePercentChange:
+			message, err = a.percentChanged(alert, price, checkedAt)
+		case AlertTypeNewHigh, AlertTypeNewLow:
+			message, err = a.newHighOrLow(alert, price, checkedAt)
+		default:
+			err = fmt.Errorf("alert %s has unknown type %q", alert.ID, alert.Type)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if message == "" {
+			continue
+		}
+		claimed, err := a.claim(alert, checkedAt)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !claimed {
+			log.Printf("Alert %s triggered within cooldown: %s\n", alert.ID, message)
+			metrics.AlertsSuppressedCounter.WithLabelValues(alert.Name, alert.Type).Inc()
+			continue
+		}
+		firings = append(firings, AlertFiring{
+			ID:       fmt.Sprintf("%s:%d", alert.ID, checkedAt),
+			AlertId:  alert.ID,
+			Name:     cryptoId,
+			Type:     alert.Type,
+			Price:    price,
+			Time:     checkedAt,
+			Message:  message,
+			Webhooks: alert.Webhooks,
+		})
+	}
+	return firings, errors.Join(errs...)
+}
+
+// Returns a message when the price moved across the threshold since the previous tick
+func thresholdCrossed(alert AlertDB, previousPrice float32, price float32) string {
+	if alert.Direction == "below" {
+		if previousPrice > alert.Threshold && price <= alert.Threshold {
+			return fmt.Sprintf("%s fell below %.2f to %.2f", alert.Name, alert.Threshold, price)
+		}
+		return ""
+	}
+	if previousPrice < alert.Threshold && price >= alert.Threshold {
+		return fmt.Sprintf("%s rose above %.2f to %.2f", alert.Name, alert.Threshold, price)
+	}
+	return ""
+}
+
+// Returns a message when the price moved by at least alert.Percent since the
+// earliest tick within the alert window
+func (a *AlertEvaluator) percentChanged(alert AlertDB, price float32, checkedAt int64) (string, error) {
+	window, err := time.ParseDuration(alert.Window)
+	if err != nil {
+		return "", fmt.Errorf("alert %s has invalid window %q: %w", alert.ID, alert.Window, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := a.client.Database("crypto").Collection("price_changes_over_time")
+	filter := bson.M{
+		"name": alert.Name,
+		"time": bson.M{"$gte": checkedAt - int64(window.Seconds()), "$lt": checkedAt},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: 1}})
+	var earliest struct {
+		Price float32 `bson:"lastPrice"`
+	}
+	err = collection.FindOne(ctx, filter, opts).Decode(&earliest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if earliest.Price == 0 {
+		return "", nil
+	}
+	change := (price - earliest.Price) / earliest.Price * 100
+	if alert.Direction == "below" {
+		if change <= -alert.Percent {
+			return fmt.Sprintf("%s fell %.2f%% in %s to %.2f", alert.Name, -change, alert.Window, price), nil
+		}
+		return "", nil
+	}
+	if change >= alert.Percent {
+		return fmt.Sprintf("%s rose %.2f%% in %s to %.2f", alert.Name, change, alert.Window, price), nil
+	}
+	return "", nil
+}
+
+// Returns a message when the price is a new high or low over the last alert.Days days
+func (a *AlertEvaluator) newHighOrLow(alert AlertDB, price float32, checkedAt int64) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := a.client.Database("crypto").Collection("price_changes_over_time")
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"name": alert.Name,
+			"time": bson.M{"$gte": checkedAt - alert.Days*24*60*60, "$lt": checkedAt},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  nil,
+			"high": bson.M{"$max": "$lastPrice"},
+			"low":  bson.M{"$min": "$lastPrice"},
+		}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return "", err
+	}
+	var results []struct {
+		High float32 `bson:"high"`
+		Low  float32 `bson:"low"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return "", err
+	}
+	// No history to compare against
+	if len(results) == 0 {
+		return "", nil
+	}
+	if alert.Type == AlertTypeNewHigh && price > results[0].High {
+		return fmt.Sprintf("%s reached a new %d day high of %.2f", alert.Name, alert.Days, price), nil
+	}
+	if alert.Type == AlertTypeNewLow && price < results[0].Low {
+		return fmt.Sprintf("%s reached a new %d day low of %.2f", alert.Name, alert.Days, price), nil
+	}
+	return "", nil
+}
+
+// Mark an alert as fired at checkedAt, unless it already fired within its cooldown.
+// Returns false when the alert is still cooling down.
+func (a *AlertEvaluator) claim(alert AlertDB, checkedAt int64) (bool, error) {
+	alertId, err := primitive.ObjectIDFromHex(alert.ID)
+	if err != nil {
+		return false, err
+	}
+	cooldown := a.defaultCooldown
+	if alert.CooldownSeconds > 0 {
+		cooldown = time.Duration(alert.CooldownSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := a.client.Database("crypto").Collection("alerts")
+	filter := bson.M{
+		"_id": alertId,
+		"$or": bson.A{
+			bson.M{"lastFiredAt": bson.M{"$exists": false}},
+			bson.M{"lastFiredAt": bson.M{"$lte": checkedAt - int64(cooldown.Seconds())}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"lastFiredAt": checkedAt}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Anomaly types
+const (
+	// Log return of a tick is far from the rolling mean of recent returns
+	AnomalyTypeReturnZScore = "returnZScore"
+	// Log return of a tick is large compared to the EWMA volatility
+	AnomalyTypeVolatility = "volatility"
+	// Time since the previous tick is far from the rolling mean of recent gaps.
+	// Price messages carry no traded volume, so tick frequency is used instead
+	AnomalyTypeTickRate = "tickRate"
+)
+
+// Configuration of the anomaly detector
+type AnomalyConfig struct {
+	// Deviation in standard deviations before a tick is flagged
+	Sigma float64
+	// Number of recent ticks used for the rolling statistics. No anomalies
+	// are flagged for a crypto until this many ticks have been seen
+	Window int
+	// Decay of the EWMA variance, closer to 1 reacts slower
+	Lambda float64
+}
+
+// `price_anomalies` collection document structure. Also published to `crypto.price.anomalies`
+type AnomalyDB struct {
+	ID   string `bson:"_id,omitempty" json:"-"`
+	Name string `bson:"name" json:"name"`
+	// One of "returnZScore", "volatility" or "tickRate"
+	Type string `bson:"type" json:"type"`
+	// Kafka event time of the anomalous tick
+	Time  int64   `bson:"time" json:"time"`
+	Price float32 `bson:"price" json:"price"`
+	// Observed log return, or seconds since the previous tick for tickRate
+	Value float64 `bson:"value" json:"value"`
+	// Expected value and spread the observation was compared against
+	Mean   float64 `bson:"mean" json:"mean"`
+	StdDev float64 `bson:"stdDev" json:"stdDev"`
+	ZScore float64 `bson:"zScore" json:"zScore"`
+	// Threshold in effect when the anomaly was flagged
+	Sigma   float64 `bson:"sigma" json:"sigma"`
+	Message string  `bson:"message" json:"message"`
+}
+
+// Fixed size window of the most recent observations
+type rollingWindow struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func newRollingWindow(size int) *rollingWindow {
+	return &rollingWindow{values: make([]float64, size)}
+}
+
+func (w *rollingWindow) add(value float64) {
+	w.values[w.next] = value
+	w.next = (w.next + 1) % len(w.values)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// Mean and sample standard deviation of the window
+func (w *rollingWindow) stats() (float64, float64) {
+	var sum float64
+	for _, value := range w.values {
+		sum += value
+	}
+	mean := sum / float64(len(w.values))
+	var squares float64
+	for _, value := range w.values {
+		squares += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(w.values)-1))
+}
+
+// Streaming state of a single crypto
+type coinStats struct {
+	lastPrice float64
+	lastTime  int64
+	returns   *rollingWindow
+	gaps      *rollingWindow
+	// EWMA variance of log returns and the number of returns it was calculated from
+	variance float64
+	count    int
+}
+
+// Flags ticks that deviate from the recent behaviour of their crypto
+type AnomalyDetector struct {
+	client *mongo.Client
+	config AnomalyConfig
+	coins  map[string]*coinStats
+}
+
+func NewAnomalyDetector(client *mongo.Client, config AnomalyConfig) *AnomalyDetector {
+	return &AnomalyDetector{client: client, config: config, coins: map[string]*coinStats{}}
+}
+
+// Update the statistics of a crypto with a tick and return the anomalies it caused.
+// Each tick is compared against the statistics from before it. Statistics are
+// warmed up from the recent history in `price_changes_over_time` on the first tick.
+func (d *AnomalyDetector) detect(cryptoId string, price float32, checkedAt int64) ([]AnomalyDB, error) {
+	stats, didFind := d.coins[cryptoId]
+	if !didFind {
+		var err error
+		stats, err = d.warmUp(cryptoId, checkedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.coins[cryptoId] = stats
+	}
+	// Out of order ticks are not part of the ordered stream
+	if stats.lastTime > 0 && checkedAt <= stats.lastTime {
+		return nil, nil
+	}
+	var anomalies []AnomalyDB
+	if stats.lastPrice > 0 && price > 0 {
+		logReturn := math.Log(float64(price) / stats.lastPrice)
+		gap := float64(checkedAt - stats.lastTime)
+		if stats.returns.full {
+			mean, stdDev := stats.returns.stats()
+			if anomaly, isAnomaly := d.flag(AnomalyTypeReturnZScore, logReturn, mean, stdDev); isAnomaly {
+				anomaly.Message = fmt.Sprintf("%s moved %.2f%% to %.2f, %.1f standard deviations from its recent returns", cryptoId, (math.Exp(logReturn)-1)*100, price, anomaly.ZScore)
+				anomalies = append(anomalies, anomaly)
+			}
+			if anomaly, isAnomaly := d.flag(AnomalyTypeVolatility, logReturn, 0, math.Sqrt(stats.variance)); isAnomaly {
+				anomaly.Message = fmt.Sprintf("%s moved %.2f%% to %.2f, %.1f times its EWMA volatility", cryptoId, (math.Exp(logReturn)-1)*100, price, math.Abs(anomaly.ZScore))
+				anomalies = append(anomalies, anomaly)
+			}
+		}
+		if stats.gaps.full {
+			mean, stdDev := stats.gaps.stats()
+			if anomaly, isAnomaly := d.flag(AnomalyTypeTickRate, gap, mean, stdDev); isAnomaly {
+				anomaly.Message = fmt.Sprintf("%s ticked %.0fs after its previous tick, compared to %.0fs on average", cryptoId, gap, mean)
+				anomalies = append(anomalies, anomaly)
+			}
+		}
+		d.observe(stats, logReturn, gap)
+	}
+	stats.lastPrice = float64(price)
+	stats.lastTime = checkedAt
+	for i := range anomalies {
+		anomalies[i].Name = cryptoId
+		anomalies[i].Price = price
+		anomalies[i].Time = checkedAt
+	}
+	return anomalies, nil
+}
+
+// Returns an anomaly when value is more than Sigma standard deviations from mean
+func (d *AnomalyDetector) flag(anomalyType string, value float64, mean float64, stdDev float64) (AnomalyDB, bool) {
+	// Flat history, e.g. an unchanged price, has no meaningful spread
+	if stdDev == 0 || math.IsNaN(stdDev) {
+		return AnomalyDB{}, false
+	}
+	zScore := (value - mean) / stdDev
+	if math.Abs(zScore) < d.config.Sigma {
+		return AnomalyDB{}, false
+	}
+	return AnomalyDB{
+		Type:   anomalyType,
+		Value:  value,
+		Mean:   mean,
+		StdDev: stdDev,
+		ZScore: zScore,
+		Sigma:  d.config.Sigma,
+	}, true
+}
+
+// Add a log return and tick gap to the statistics of a crypto
+func (d *AnomalyDetector) observe(stats *coinStats, logReturn float64, gap float64) {
+	stats.returns.add(logReturn)
+	stats.gaps.add(gap)
+	if stats.count == 0 {
+		stats.variance = logReturn * logReturn
+	} else {
+		stats.variance = d.config.Lambda*stats.variance + (1-d.config.Lambda)*logReturn*logReturn
+	}
+	stats.count++
+}
+
+// Create the statistics of a crypto from the ticks before checkedAt
+func (d *AnomalyDetector) warmUp(cryptoId string, checkedAt int64) (*coinStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collection := d.client.Database("crypto").Collection("price_changes_over_time")
+	// Stale ticks arrived out of order, so are not part of the ordered stream
+	filter := bson.M{"name": cryptoId, "time": bson.M{"$lt": checkedAt}, "stale": bson.M{"$ne": true}}
+	// One more tick than the window, as statistics are calculated between ticks
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(int64(d.config.Window + 1))
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var ticks []struct {
+		Price float32 `bson:"lastPrice"`
+		Time  int64   `bson:"time"`
+	}
+	if err = cursor.All(ctx, &ticks); err != nil {
+		return nil, err
+	}
+	stats := &coinStats{
+		returns: newRollingWindow(d.config.Window),
+		gaps:    newRollingWindow(d.config.Window),
+	}
+	// Ticks were loaded newest first
+	for i := len(ticks) - 1; i >= 0; i-- {
+		tick := ticks[i]
+		if tick.Price <= 0 || tick.Time <= stats.lastTime {
+			continue
+		}
+		if stats.lastPrice > 0 {
+			d.observe(stats, math.Log(float64(tick.Price)/stats.lastPrice), float64(tick.Time-stats.lastTime))
+		}
+		stats.lastPrice = float64(tick.Price)
+		stats.lastTime = tick.Time
+	}
+	log.Printf("Warmed up %s anomaly detection from %d ticks\n", cryptoId, len(ticks))
+	return stats, nil
+}
+
+// Store an anomaly in `price_anomalies`. Anomalies are unique per crypto, type and
+// time, so a redelivered tick does not store the same anomaly twice.
+func saveAnomaly(anomaly AnomalyDB, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := client.Database("crypto").Collection("price_anomalies")
+	filter := bson.M{"name": anomaly.Name, "type": anomaly.Type, "time": anomaly.Time}
+	_, err := collection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": &anomaly}, options.Update().SetUpsert(true))
+	return err
+}
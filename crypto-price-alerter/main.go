@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"crypto-price-alerter/metrics"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Message struct {
+	Name  string
+	Price float32
+}
+
+func parseKafkaMessage(message string) (*Message, error) {
+	parts := strings.Split(message, ":")
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid message format")
+	}
+	price, err := strconv.ParseFloat(parts[1], 32)
+	if err != nil {
+		return nil, fmt.Errorf("Error converting string to float: %s", parts[1])
+	}
+	return &Message{
+		Name:  parts[0],
+		Price: float32(price),
+	}, nil
+}
+
+// Lookup an optional duration environment variable
+func durationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	value, didFind := os.LookupEnv(key)
+	if !didFind {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid %s provided", key))
+	}
+	return duration
+}
+
+// Lookup an optional float environment variable
+func floatFromEnv(key string, defaultValue float64) float64 {
+	value, didFind := os.LookupEnv(key)
+	if !didFind {
+		return defaultValue
+	}
+	value_f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid %s provided", key))
+	}
+	return value_f
+}
+
+// Receive Kafka messages with new Crypto prices, evaluate the alerts defined in
+// the `alerts` collection and publish firings to Kafka and webhooks.
+// Ticks are also checked for statistical anomalies, which are stored in
+// `price_anomalies` and published to Kafka.
+func main() {
+	// Initialize context for killing application
+	mainCtx, cancel := context.WithCancel(context.Background())
+	// Initialize prometheus metrics and expose on separate port
+	metrics.Init(cancel)
+
+	topic := "crypto.price.updated"
+	alertsTopic := "crypto.price.alerts"
+	anomaliesTopic := "crypto.price.anomalies"
+	// Lookup necessary environment variables
+	// Example: "localhost:9091"
+	kafkaServer, didFind := os.LookupEnv("KAFKA_SERVER")
+	if !didFind {
+		panic("No Kafka server provided")
+	}
+	// Example: "mongodb://localhost:27017"
+	mongoURL, didFind := os.LookupEnv("MONGO_URL")
+	if !didFind {
+		panic("No MongoDB URL provided")
+	}
+	// Example: "http://hooks.local/crypto,http://other.local/alerts"
+	var webhookURLs []string
+	if urls := os.Getenv("ALERT_WEBHOOK_URLS"); urls != "" {
+		webhookURLs = strings.Split(urls, ",")
+	}
+	defaultCooldown := durationFromEnv("ALERT_COOLDOWN", time.Hour)
+	refreshInterval := durationFromEnv("ALERT_REFRESH_INTERVAL", 30*time.Second)
+	webhookBackoff := durationFromEnv("WEBHOOK_RETRY_BACKOFF", time.Second)
+	webhookMaxRetries := 5
+	if retries, didFind := os.LookupEnv("WEBHOOK_MAX_RETRIES"); didFind {
+		retries_i, err := strconv.Atoi(retries)
+		if err != nil {
+			panic("Invalid WEBHOOK_MAX_RETRIES provided")
+		}
+		webhookMaxRetries = retries_i
+	}
+	anomalyConfig := AnomalyConfig{
+		Sigma:  floatFromEnv("ANOMALY_SIGMA", 4),
+		Window: 60,
+		Lambda: floatFromEnv("ANOMALY_EWMA_LAMBDA", 0.94),
+	}
+	if window, didFind := os.LookupEnv("ANOMALY_WINDOW"); didFind {
+		window_i, err := strconv.Atoi(window)
+		if err != nil || window_i < 2 {
+			panic("Invalid ANOMALY_WINDOW provided")
+		}
+		anomalyConfig.Window = window_i
+	}
+	if anomalyConfig.Sigma <= 0 || anomalyConfig.Lambda <= 0 || anomalyConfig.Lambda >= 1 {
+		panic("ANOMALY_SIGMA must be positive and ANOMALY_EWMA_LAMBDA between 0 and 1")
+	}
+	// Connect to MongoDB
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
+	if err != nil {
+		panic(err)
+	}
+	defer client.Disconnect(context.Background())
+	// Load alert definitions and keep them up to date
+	evaluator := NewAlertEvaluator(client, defaultCooldown)
+	if err = evaluator.refresh(); err != nil {
+		panic(err)
+	}
+	go evaluator.refreshEvery(mainCtx, refreshInterval)
+	// Deliver firings to webhooks in the background
+	notifier := NewWebhookNotifier(webhookURLs, webhookMaxRetries, webhookBackoff)
+	go notifier.run(mainCtx)
+	// Rolling statistics per crypto for anomaly detection
+	detector := NewAnomalyDetector(client, anomalyConfig)
+	// Create Kafka Producer client for alert firings
+	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": kafkaServer})
+	if err != nil {
+		panic(err)
+	}
+	defer p.Close()
+	// Log failed deliveries of alert firings and anomalies
+	go func() {
+		for ev := range p.Events() {
+			if m, ok := ev.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+				log.Printf("Could not deliver %s message to Kafka: %v\n", *m.TopicPartition.Topic, m.TopicPartition.Error)
+			}
+		}
+	}()
+	// Define Kafka Consumer client. Alerts use their own consumer group so they
+	// receive every tick independently of the change tracker
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  kafkaServer,
+		"group.id":           "go-price-alert-consumer-group",
+		"auto.offset.reset":  "latest",
+		"enable.auto.commit": true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	err = c.Subscribe(topic, nil)
+	if err != nil {
+		panic("Did not subscribe to topic")
+	}
+	log.Printf("STARTUP: Evaluating alerts for %s", topic)
+	for {
+		select {
+		case <-mainCtx.Done():
+			log.Println("Shutting down Kafka consumer...")
+			p.Flush(5000)
+			return
+		default:
+		}
+		ev := c.Poll(2000)
+		switch e := ev.(type) {
+		case *kafka.Message:
+			evaluationStart := time.Now()
+			cryptoMessage, err := parseKafkaMessage(string(e.Value))
+			if err != nil {
+				metrics.FailedKafkaMessagesCounter.WithLabelValues().Inc()
+				log.Printf("Could not parse message %s: %v\n", string(e.Value), err)
+				continue
+			}
+			metrics.MessagesConsumedCounter.WithLabelValues(cryptoMessage.Name).Inc()
+			firings, err := evaluator.evaluate(cryptoMessage.Name, cryptoMessage.Price, e.Timestamp.Unix())
+			if err != nil {
+				log.Printf("Error evaluating alerts for %s: %v\n", cryptoMessage.Name, err)
+			}
+			for _, firing := range firings {
+				log.Printf("Alert %s fired: %s\n", firing.AlertId, firing.Message)
+				metrics.AlertsFiredCounter.WithLabelValues(firing.Name, firing.Type).Inc()
+				value, err := json.Marshal(firing)
+				if err != nil {
+					log.Printf("Could not encode alert %s: %v\n", firing.ID, err)
+					continue
+				}
+				err = p.Produce(&kafka.Message{
+					TopicPartition: kafka.TopicPartition{Topic: &alertsTopic, Partition: kafka.PartitionAny},
+					Key:            []byte(firing.AlertId),
+					Value:          value,
+				}, nil)
+				if err != nil {
+					log.Printf("Could not produce alert %s: %v\n", firing.ID, err)
+				}
+				notifier.notify(firing)
+			}
+			anomalies, err := detector.detect(cryptoMessage.Name, cryptoMessage.Price, e.Timestamp.Unix())
+			if err != nil {
+				log.Printf("Error detecting anomalies for %s: %v\n", cryptoMessage.Name, err)
+			}
+			for _, anomaly := range anomalies {
+				log.Printf("Anomaly detected: %s\n", anomaly.Message)
+				metrics.AnomaliesDetectedCounter.WithLabelValues(anomaly.Name, anomaly.Type).Inc()
+				if err := saveAnomaly(anomaly, client); err != nil {
+					log.Printf("Could not store %s anomaly for %s: %v\n", anomaly.Type, anomaly.Name, err)
+				}
+				value, err := json.Marshal(anomaly)
+				if err != nil {
+					log.Printf("Could not encode %s anomaly for %s: %v\n", anomaly.Type, anomaly.Name, err)
+					continue
+				}
+				err = p.Produce(&kafka.Message{
+					TopicPartition: kafka.TopicPartition{Topic: &anomaliesTopic, Partition: kafka.PartitionAny},
+					Key:            []byte(anomaly.Name),
+					Value:          value,
+				}, nil)
+				if err != nil {
+					log.Printf("Could not produce %s anomaly for %s: %v\n", anomaly.Type, anomaly.Name, err)
+				}
+			}
+			metrics.AlertEvaluationDuration.Observe(time.Since(evaluationStart).Seconds())
+		case kafka.Error:
+			log.Printf("Kafka error: %v\n", e)
+			if e.IsFatal() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+    "os"
+    "os/signal"
+    "syscall"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Define metrics
+var (
+	FailedKafkaMessagesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failed_kafka_messages_total",
+			Help: "Number of Kafka messsages that could not be consumed",
+		},
+		[]string{},
+	)
+
+    MessagesConsumedCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "kafka_messages_total",
+            Help:    "Number of Kafka messages consumed",
+        },
+		[]string{"coin"},
+    )
+
+    AlertsFiredCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "alerts_fired_total",
+            Help:    "Number of price alerts fired",
+        },
+		[]string{"coin", "type"},
+    )
+
+    AlertsSuppressedCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "alerts_suppressed_total",
+            Help:    "Number of triggered price alerts suppressed by their cooldown",
+        },
+		[]string{"coin", "type"},
+    )
+
+    AnomaliesDetectedCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "price_anomalies_total",
+            Help:    "Number of ticks flagged as statistical anomalies",
+        },
+		[]string{"coin", "type"},
+    )
+
+	WebhookDeliveriesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alert_webhook_deliveries_total",
+			Help: "Number of alert webhook deliveries by result",
+		},
+		[]string{"result"},
+	)
+
+    AlertEvaluationDuration = prometheus.NewHistogram(
+        prometheus.HistogramOpts{
+            Name:    "alert_evaluation_duration",
+            Help:    "Duration of evaluating alerts for a price Kafka message",
+            Buckets: prometheus.DefBuckets,
+        },
+    )
+)
+
+// Register metrics
+func Init(cancel context.CancelFunc) {
+	prometheus.MustRegister(FailedKafkaMessagesCounter)
+	prometheus.MustRegister(MessagesConsumedCounter)
+	prometheus.MustRegister(AlertsFiredCounter)
+	prometheus.MustRegister(AlertsSuppressedCounter)
+	prometheus.MustRegister(AnomaliesDetectedCounter)
+	prometheus.MustRegister(WebhookDeliveriesCounter)
+	prometheus.MustRegister(AlertEvaluationDuration)
+
+    // Handle graceful shutdown
+    go handleSignals(cancel)
+
+    // Start metrics endpoint
+    go func() {
+        http.Handle("/metrics", promhttp.Handler())
+        log.Println("Prometheus metrics at :2112/metrics")
+        log.Fatal(http.ListenAndServe(":2112", nil))
+    }()
+
+}
+
+// Handle OS signals
+func handleSignals(cancel context.CancelFunc) {
+    sigChan := make(chan os.Signal, 1)
+    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+    <-sigChan
+    log.Println("Received shutdown signal")
+    cancel()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"crypto-price-alerter/metrics"
+)
+
+// Delivers alert firings to webhooks in the background, retrying failed
+// deliveries with exponential backoff
+type WebhookNotifier struct {
+	// Webhooks notified for every alert
+	urls       []string
+	maxRetries int
+	backoff    time.Duration
+	httpClient *http.Client
+	// Client for the webhooks of alerts, which are set by API users
+	publicClient *http.Client
+	queue        chan AlertFiring
+}
+
+func NewWebhookNotifier(urls []string, maxRetries int, backoff time.Duration) *WebhookNotifier {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: denyPrivateAddresses}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialled instead of the webhook, skipping the address check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &WebhookNotifier{
+		urls:         urls,
+		maxRetries:   maxRetries,
+		backoff:      backoff,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		publicClient: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		queue:        make(chan AlertFiring, 100),
+	}
+}
+
+// Refuse connections to loopback, link-local and private addresses, so alert
+// webhooks can not reach services inside the network. Checked after DNS
+// resolution, so hostnames can not be pointed at them later
+func denyPrivateAddresses(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// Queue a firing for delivery. Drops the firing if the queue is full, so a
+// slow webhook never blocks alert evaluation.
+func (n *WebhookNotifier) notify(firing AlertFiring) {
+	select {
+	case n.queue <- firing:
+	default:
+		metrics.WebhookDeliveriesCounter.WithLabelValues("dropped").Inc()
+		log.Printf("Webhook queue full, dropping alert %s\n", firing.ID)
+	}
+}
+
+// Deliver queued firings until ctx is cancelled
+func (n *WebhookNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case firing := <-n.queue:
+			for _, url := range n.urls {
+				n.deliverAndCount(ctx, n.httpClient, url, firing)
+			}
+			for _, url := range firing.Webhooks {
+				n.deliverAndCount(ctx, n.publicClient, url, firing)
+			}
+		}
+	}
+}
+
+// Deliver a firing to a webhook and count the outcome
+func (n *WebhookNotifier) deliverAndCount(ctx context.Context, client *http.Client, url string, firing AlertFiring) {
+	err := n.deliver(ctx, client, url, firing)
+	if err != nil {
+		metrics.WebhookDeliveriesCounter.WithLabelValues("failed").Inc()
+		log.Printf("Could not deliver alert %s to %s: %v\n", firing.ID, url, err)
+	} else {
+		metrics.WebhookDeliveriesCounter.WithLabelValues("delivered").Inc()
+	}
+}
+
+// POST a firing to a webhook, retrying on network errors and non-2xx responses.
+// The firing ID is sent in the X-Alert-Id header so receivers can ignore retried deliveries.
+func (n *WebhookNotifier) deliver(ctx context.Context, client *http.Client, url string, firing AlertFiring) error {
+	body, err := json.Marshal(firing)
+	if err != nil {
+		return err
+	}
+	delay := n.backoff
+	for attempt := 0; ; attempt++ {
+		err = n.post(ctx, client, url, firing.ID, body)
+		if err == nil || attempt >= n.maxRetries {
+			return err
+		}
+		log.Printf("Retrying alert %s delivery to %s in %s: %v\n", firing.ID, url, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (n *WebhookNotifier) post(ctx context.Context, client *http.Client, url string, firingId string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Alert-Id", firingId)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
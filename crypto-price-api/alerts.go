@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"crypto-price-api/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// `alerts` collection document structure. Evaluated by crypto-price-alerter
+type AlertDB struct {
+	ID string `bson:"_id,omitempty"`
+	// Hex ID of the user that created the alert
+	OwnerID string `bson:"ownerId"`
+	// Crypto Name
+	Name string `bson:"name"`
+	// One of "threshold", "percentChange", "newHigh" or "newLow"
+	Type string `bson:"type"`
+	// "above" or "below", used by threshold and percentChange alerts
+	Direction string  `bson:"direction"`
+	Threshold float32 `bson:"threshold"`
+	Percent   float32 `bson:"percent"`
+	// Go duration, e.g. "1h"
+	Window string `bson:"window"`
+	Days   int64  `bson:"days"`
+	// Minimum time between firings. Zero uses the alerter default
+	CooldownSeconds int64    `bson:"cooldownSeconds"`
+	LastFiredAt     int64    `bson:"lastFiredAt,omitempty"`
+	Webhooks        []string `bson:"webhooks"`
+	Enabled         bool     `bson:"enabled"`
+}
+
+// VM for alerts
+type AlertVM struct {
+	AlertId         string   `json:"_id"`
+	Name            string   `json:"name"`
+	Type            string   `json:"type"`
+	Direction       string   `json:"direction"`
+	Threshold       float32  `json:"threshold"`
+	Percent         float32  `json:"percent"`
+	Window          string   `json:"window"`
+	Days            int64    `json:"days"`
+	CooldownSeconds int64    `json:"cooldownSeconds"`
+	LastFiredAt     int64    `json:"lastFiredAt"`
+	Webhooks        []string `json:"webhooks"`
+	Enabled         bool     `json:"enabled"`
+}
+
+func alertToVM(alert AlertDB) AlertVM {
+	return AlertVM{
+		AlertId:         alert.ID,
+		Name:            alert.Name,
+		Type:            alert.Type,
+		Direction:       alert.Direction,
+		Threshold:       alert.Threshold,
+		Percent:         alert.Percent,
+		Window:          alert.Window,
+		Days:            alert.Days,
+		CooldownSeconds: alert.CooldownSeconds,
+		LastFiredAt:     alert.LastFiredAt,
+		Webhooks:        alert.Webhooks,
+		Enabled:         alert.Enabled,
+	}
+}
+
+// Whether an address is public, rather than loopback, link-local or private
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// Check a webhook is an http(s) URL of a public host, so the alerter can not be
+// used to reach services inside the network. The alerter checks the address again
+// when delivering, in case the host is pointed somewhere else later
+func validateWebhook(ctx context.Context, webhook string) error {
+	parsed, err := url.Parse(webhook)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return fieldError("webhooks", "webhooks must be http or https URLs")
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return fieldError("webhooks", "webhook host %s could not be resolved", parsed.Hostname())
+	}
+	for _, address := range addresses {
+		if !isPublicIP(address.IP) {
+			return fieldError("webhooks", "webhook host %s is not a public address", parsed.Hostname())
+		}
+	}
+	return nil
+}
+
+// Handle to look up the alert definitions of the user
+// GET /alerts
+// Returns: []AlertVM
+func findAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/alerts").Inc()
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	collection := MongoClient.Database("crypto").Collection("alerts")
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	results := []AlertVM{}
+	cursor, err := collection.Find(findCtx, bson.M{"ownerId": requestUser(r).ID}, opts)
+	if err != nil {
+		writeServerError(w, "Looking up alerts", err)
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+		return
+	}
+	for cursor.Next(findCtx) {
+		var alert AlertDB
+		if err := cursor.Decode(&alert); err != nil {
+			fmt.Printf("Could not decode AlertDB %v", err)
+		} else {
+			results = append(results, alertToVM(alert))
+		}
+	}
+	json.NewEncoder(w).Encode(results)
+	metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+}
+
+// Create a new alert based on provided form data.
+// Required fields are:
+//
+//	cryptoId string
+//	type string "threshold", "percentChange", "newHigh" or "newLow"
+//
+// Optional fields are direction, threshold, percent, window, days, cooldownSeconds
+// and webhooks (comma separated)
+//
+// POST /alerts
+// Returns: AlertVM
+func createAlertHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/alerts").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+
+	// Limit request size to 10MB (more than enough!)
+	r.ParseMultipartForm(10 << 20)
+	newAlert := AlertDB{
+		OwnerID:   requestUser(r).ID,
+		Name:      r.FormValue("cryptoId"),
+		Type:      r.FormValue("type"),
+		Direction: r.FormValue("direction"),
+		Window:    r.FormValue("window"),
+		Enabled:   true,
+		Webhooks:  []string{},
+	}
+	if newAlert.Name == "" {
+		writeFieldError(w, fieldError("cryptoId", "cryptoId is required"))
+		return
+	}
+	if newAlert.Direction == "" {
+		newAlert.Direction = "above"
+	}
+	if newAlert.Direction != "above" && newAlert.Direction != "below" {
+		writeFieldError(w, fieldError("direction", "direction must be above or below"))
+		return
+	}
+	var err error
+	switch newAlert.Type {
+	case "threshold":
+		newAlert.Threshold, err = parseFormFloat32(r, "threshold")
+	case "percentChange":
+		newAlert.Percent, err = parseFormFloat32(r, "percent")
+		if _, windowErr := time.ParseDuration(newAlert.Window); err == nil && windowErr != nil {
+			err = fieldError("window", "window must be a duration such as 24h")
+		}
+	case "newHigh", "newLow":
+		newAlert.Days, err = strconv.ParseInt(r.FormValue("days"), 10, 64)
+		if err != nil {
+			err = fieldError("days", "days must be a whole number")
+		}
+	default:
+		err = fieldError("type", "type must be threshold, percentChange, newHigh or newLow")
+	}
+	if err != nil {
+		writeServerError(w, "Creating alert", err)
+		return
+	}
+	if cooldown := r.FormValue("cooldownSeconds"); cooldown != "" {
+		newAlert.CooldownSeconds, err = strconv.ParseInt(cooldown, 10, 64)
+		if err != nil {
+			writeFieldError(w, fieldError("cooldownSeconds", "cooldownSeconds must be a whole number"))
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if webhooks := r.FormValue("webhooks"); webhooks != "" {
+		for _, webhook := range strings.Split(webhooks, ",") {
+			webhook = strings.TrimSpace(webhook)
+			if err := validateWebhook(ctx, webhook); err != nil {
+				writeServerError(w, "Creating alert", err)
+				return
+			}
+			newAlert.Webhooks = append(newAlert.Webhooks, webhook)
+		}
+	}
+	// Insert alert
+	collection := MongoClient.Database("crypto").Collection("alerts")
+	result, err := collection.InsertOne(ctx, &newAlert)
+	if err != nil {
+		writeServerError(w, "Creating alert", err)
+		return
+	}
+	newAlert.ID = result.InsertedID.(primitive.ObjectID).Hex()
+	fmt.Printf("Created new %s alert for [%s]\n", newAlert.Type, newAlert.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(alertToVM(newAlert))
+}
+
+// Delete an alert of the user
+// DELETE /alerts?alertId=
+func deleteAlertHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/alerts").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	alertId, err := primitive.ObjectIDFromHex(r.URL.Query().Get("alertId"))
+	if err != nil {
+		writeFieldError(w, fieldError("alertId", "alertId is not a valid alert ID"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	collection := MongoClient.Database("crypto").Collection("alerts")
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": alertId, "ownerId": requestUser(r).ID})
+	if err != nil {
+		writeServerError(w, "Deleting alert", err)
+		return
+	}
+	if result.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, "Alert not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for /alerts route
+func alertHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		findAlertsHandler(w, r)
+	case http.MethodPost:
+		createAlertHandler(w, r)
+	case http.MethodDelete:
+		deleteAlertHandler(w, r)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
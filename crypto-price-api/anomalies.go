@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"crypto-price-api/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Maximum number of anomalies returned by /anomalies
+const anomaliesLimit = 500
+
+// `price_anomalies` collection document structure. Maintained by crypto-price-alerter
+type AnomalyDB struct {
+	ID      string  `bson:"_id,omitempty"`
+	Name    string  `bson:"name"`
+	Type    string  `bson:"type"`
+	Time    int64   `bson:"time"`
+	Price   float32 `bson:"price"`
+	Value   float64 `bson:"value"`
+	Mean    float64 `bson:"mean"`
+	StdDev  float64 `bson:"stdDev"`
+	ZScore  float64 `bson:"zScore"`
+	Sigma   float64 `bson:"sigma"`
+	Message string  `bson:"message"`
+}
+
+// VM for price anomalies
+type AnomalyVM struct {
+	AnomalyId string `json:"_id"`
+	Name      string `json:"name"`
+	// "returnZScore", "volatility" or "tickRate"
+	Type    string  `json:"type"`
+	Time    int64   `json:"time"`
+	Price   float32 `json:"price"`
+	Value   float64 `json:"value"`
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stdDev"`
+	ZScore  float64 `json:"zScore"`
+	Sigma   float64 `json:"sigma"`
+	Message string  `json:"message"`
+}
+
+// Handle to look up recent price anomalies, newest first
+// GET /anomalies?cryptoId=BTC&type=returnZScore&duration=168h
+// cryptoId and type are optional. duration is a Go duration. Default 168h
+// Returns: []AnomalyVM
+func anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/anomalies").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	duration, err := parseDurationParam(r, "duration", 168*time.Hour)
+	if err != nil {
+		writeServerError(w, "Looking up anomalies", err)
+		return
+	}
+	filter := bson.M{"time": bson.M{"$gte": time.Now().Add(-duration).Unix()}}
+	if cryptoId := r.URL.Query().Get("cryptoId"); cryptoId != "" {
+		filter["name"] = cryptoId
+	}
+	if anomalyType := r.URL.Query().Get("type"); anomalyType != "" {
+		filter["type"] = anomalyType
+	}
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	collection := MongoClient.Database("crypto").Collection("price_anomalies")
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(anomaliesLimit)
+	results := []AnomalyVM{}
+	cursor, err := collection.Find(findCtx, filter, opts)
+	if err != nil {
+		writeServerError(w, "Looking up anomalies", err)
+		return
+	}
+	for cursor.Next(findCtx) {
+		var anomaly AnomalyDB
+		if err := cursor.Decode(&anomaly); err != nil {
+			fmt.Printf("Could not decode AnomalyDB %v", err)
+			continue
+		}
+		results = append(results, AnomalyVM{
+			AnomalyId: anomaly.ID,
+			Name:      anomaly.Name,
+			Type:      anomaly.Type,
+			Time:      anomaly.Time,
+			Price:     anomaly.Price,
+			Value:     anomaly.Value,
+			Mean:      anomaly.Mean,
+			StdDev:    anomaly.StdDev,
+			ZScore:    anomaly.ZScore,
+			Sigma:     anomaly.Sigma,
+			Message:   anomaly.Message,
+		})
+	}
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"crypto-price-api/metrics"
+	"crypto-price-api/storage"
+)
+
+// Check the fields of an asset before it is stored. Sale fields are reset for held assets
+func validateAsset(asset *storage.Asset) error {
+	if asset.Name == "" {
+		return fieldError("cryptoId", "cryptoId is required")
+	}
+	if asset.Amount <= 0 {
+		return fieldError("amount", "amount must be greater than 0")
+	}
+	if asset.PurchasePrice < 0 {
+		return fieldError("purchasePrice", "purchasePrice must not be negative")
+	}
+	if asset.PurchaseTime <= 0 {
+		return fieldError("purchaseTime", "purchaseTime must be greater than 0")
+	}
+	if asset.PurchaseFee < 0 {
+		return fieldError("purchaseFee", "purchaseFee must not be negative")
+	}
+	switch asset.Status {
+	case "held":
+		asset.SalePrice = -1
+		asset.SaleTime = -1
+		asset.SaleFee = 0
+	case "sold":
+		if asset.SalePrice < 0 {
+			return fieldError("salePrice", "salePrice must not be negative for sold assets")
+		}
+		if asset.SaleTime < asset.PurchaseTime {
+			return fieldError("saleTime", "saleTime must not be before purchaseTime")
+		}
+		if asset.SaleFee < 0 {
+			return fieldError("saleFee", "saleFee must not be negative")
+		}
+	default:
+		return fieldError("status", "status must be held or sold")
+	}
+	return nil
+}
+
+// Set target from a float form field. Missing fields are an error when required,
+// otherwise target is left unchanged
+func formFloat32(r *http.Request, field string, required bool, target *float32) error {
+	if _, didFind := r.Form[field]; !didFind && !required {
+		return nil
+	}
+	value, err := parseFormFloat32(r, field)
+	if err != nil {
+		return err
+	}
+	*target = value
+	return nil
+}
+
+// Set target from a string form field. Missing fields are an error when required,
+// otherwise target is left unchanged
+func formString(r *http.Request, field string, required bool, target *string) error {
+	if _, didFind := r.Form[field]; !didFind && !required {
+		return nil
+	}
+	value, err := requiredParam(r, field)
+	if err != nil {
+		return err
+	}
+	*target = value
+	return nil
+}
+
+// Parse the filters, sort and page of an asset list from query parameters
+func parseAssetQuery(r *http.Request) (storage.AssetQuery, error) {
+	params := r.URL.Query()
+	query := storage.AssetQuery{
+		Name:   params.Get("cryptoId"),
+		Status: params.Get("status"),
+		SortBy: params.Get("sort"),
+	}
+	if query.Status != "" && query.Status != "held" && query.Status != "sold" {
+		return query, fieldError("status", "status must be held or sold")
+	}
+	if query.SortBy != "" && !storage.ValidAssetSort(query.SortBy) {
+		return query, fieldError("sort", "sort must be purchaseTime, saleTime, amount or purchasePrice")
+	}
+	var err error
+	if query.From, query.To, err = parseTimeRange(r); err != nil {
+		return query, err
+	}
+	if query.Descending, err = parseOrderParam(r, true); err != nil {
+		return query, err
+	}
+	if query.Limit, err = parseLimitParam(r, 100, 1000); err != nil {
+		return query, err
+	}
+	query.After, err = parseCursorParam(r)
+	return query, err
+}
+
+// Set the fields of an asset from form fields. When required is false, missing
+// fields are left unchanged
+func parseAssetForm(r *http.Request, asset *storage.Asset, required bool) error {
+	if err := formString(r, "cryptoId", required, &asset.Name); err != nil {
+		return err
+	}
+	if err := formFloat32(r, "amount", required, &asset.Amount); err != nil {
+		return err
+	}
+	if err := formFloat32(r, "purchasePrice", required, &asset.PurchasePrice); err != nil {
+		return err
+	}
+	if err := formFloat32(r, "purchaseTime", required, &asset.PurchaseTime); err != nil {
+		return err
+	}
+	if err := formFloat32(r, "purchaseFee", false, &asset.PurchaseFee); err != nil {
+		return err
+	}
+	if err := formString(r, "status", required, &asset.Status); err != nil {
+		return err
+	}
+	if err := formFloat32(r, "saleFee", false, &asset.SaleFee); err != nil {
+		return err
+	}
+	// Sale fields only apply to sold assets
+	isSold := asset.Status == "sold"
+	if err := formFloat32(r, "salePrice", required && isSold, &asset.SalePrice); err != nil {
+		return err
+	}
+	return formFloat32(r, "saleTime", required && isSold, &asset.SaleTime)
+}
+
+// Parse the optional fields of a sale
+func parseSaleForm(r *http.Request) (storage.Sale, error) {
+	sale := storage.Sale{Time: float32(time.Now().Unix())}
+	var err error
+	if sale.Version, err = requestedVersion(r); err != nil {
+		return sale, err
+	}
+	if err = formFloat32(r, "amount", false, &sale.Amount); err != nil {
+		return sale, err
+	}
+	if _, didFind := r.Form["amount"]; didFind && sale.Amount <= 0 {
+		return sale, fieldError("amount", "amount must be greater than 0")
+	}
+	if err = formFloat32(r, "salePrice", false, &sale.Price); err != nil {
+		return sale, err
+	}
+	if sale.Price < 0 {
+		return sale, fieldError("salePrice", "salePrice must not be negative")
+	}
+	if err = formFloat32(r, "saleTime", false, &sale.Time); err != nil {
+		return sale, err
+	}
+	// Milliseconds sent by the FE JS, as for purchaseTime
+	if sale.Time >= 1712893600000 {
+		sale.Time = sale.Time / 1000
+	}
+	if sale.Time <= 0 {
+		return sale, fieldError("saleTime", "saleTime must be greater than 0")
+	}
+	if err = formFloat32(r, "fee", false, &sale.Fee); err != nil {
+		return sale, err
+	}
+	if sale.Fee < 0 {
+		return sale, fieldError("fee", "fee must not be negative")
+	}
+	return sale, nil
+}
+
+// ETag of an asset version
+func assetETag(version int64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// Version the client expects the asset to be at, from the If-Match header or
+// the version form field. Returns storage.AnyVersion when neither is provided
+func requestedVersion(r *http.Request) (int64, error) {
+	value := r.Header.Get("If-Match")
+	field := "If-Match"
+	if value == "" {
+		value = r.FormValue("version")
+		field = "version"
+	}
+	if value == "" || value == "*" {
+		return storage.AnyVersion, nil
+	}
+	value = strings.Trim(strings.TrimPrefix(value, "W/"), "\"")
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 0 {
+		return 0, fieldError(field, "%s must be an asset version", field)
+	}
+	return version, nil
+}
+
+// Write an asset with its version as the ETag
+func writeAsset(w http.ResponseWriter, status int, asset storage.Asset) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", assetETag(asset.Version))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(assetToVM(asset))
+}
+
+// Handler for /assets/{id} routes
+// GET /assets/{id}: Returns AssetVM
+// PUT /assets/{id}: Replace every field. Required fields are cryptoId, amount,
+// purchasePrice, purchaseTime and status. salePrice and saleTime are required for sold assets
+// PATCH /assets/{id}: Replace the provided fields
+// DELETE /assets/{id}
+// PUT, PATCH and DELETE only apply when the asset is still at the version in the
+// If-Match header or version field, otherwise 412 is returned
+func assetByIdHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/assets/{id}").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	assetId := strings.TrimPrefix(r.URL.Path, "/assets/")
+	if assetId == "" || strings.Contains(assetId, "/") {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, fmt.Sprintf("No route for %s", r.URL.Path))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getAssetHandler(w, r, assetId)
+	case http.MethodPut:
+		updateAssetHandler(w, r, assetId, false)
+	case http.MethodPatch:
+		updateAssetHandler(w, r, assetId, true)
+	case http.MethodDelete:
+		deleteAssetHandler(w, r, assetId)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// Look up an asset of a user, treating invalid IDs and assets of other users as missing
+func findAsset(ctx context.Context, ownerID string, assetId string) (storage.Asset, error) {
+	asset, err := Store.FindAsset(ctx, assetId)
+	if errors.Is(err, storage.ErrInvalidID) || (err == nil && asset.OwnerID != ownerID) {
+		return storage.Asset{}, storage.ErrNotFound
+	}
+	return asset, err
+}
+
+func getAssetHandler(w http.ResponseWriter, r *http.Request, assetId string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	asset, err := findAsset(ctx, requestUser(r).ID, assetId)
+	if err != nil {
+		writeServerError(w, "Looking up asset", err)
+		return
+	}
+	if r.Header.Get("If-None-Match") == assetETag(asset.Version) {
+		w.Header().Set("ETag", assetETag(asset.Version))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeAsset(w, http.StatusOK, asset)
+}
+
+func updateAssetHandler(w http.ResponseWriter, r *http.Request, assetId string, partial bool) {
+	// Limit request size to 10MB (more than enough!)
+	r.ParseMultipartForm(10 << 20)
+	version, err := requestedVersion(r)
+	if err != nil {
+		writeServerError(w, "Updating asset", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	current, err := findAsset(ctx, requestUser(r).ID, assetId)
+	if err != nil {
+		writeServerError(w, "Updating asset", err)
+		return
+	}
+	if version != storage.AnyVersion && version != current.Version {
+		writeServerError(w, "Updating asset", storage.ErrVersionConflict)
+		return
+	}
+	// Without a version, the update applies to the version just read.
+	// PUT replaces the form fields, keeping the owner and lineage of the asset
+	asset := storage.Asset{ID: current.ID, OwnerID: current.OwnerID, ParentID: current.ParentID, ImportID: current.ImportID}
+	if partial {
+		asset = current
+	}
+	asset.Version = current.Version
+	if err = parseAssetForm(r, &asset, !partial); err != nil {
+		writeServerError(w, "Updating asset", err)
+		return
+	}
+	if err = validateAsset(&asset); err != nil {
+		writeServerError(w, "Updating asset", err)
+		return
+	}
+	asset, err = Store.UpdateAsset(ctx, asset)
+	if err != nil {
+		writeServerError(w, "Updating asset", err)
+		return
+	}
+	fmt.Printf("Updated asset [%s] to version %d\n", asset.ID, asset.Version)
+	writeAsset(w, http.StatusOK, asset)
+}
+
+func deleteAssetHandler(w http.ResponseWriter, r *http.Request, assetId string) {
+	version, err := requestedVersion(r)
+	if err != nil {
+		writeServerError(w, "Deleting asset", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err = findAsset(ctx, requestUser(r).ID, assetId); err != nil {
+		writeServerError(w, "Deleting asset", err)
+		return
+	}
+	err = Store.DeleteAsset(ctx, assetId, version)
+	if err != nil {
+		writeServerError(w, "Deleting asset", err)
+		return
+	}
+	fmt.Printf("Deleted asset [%s]\n", assetId)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"crypto-price-api/storage"
+)
+
+// Prefix of API tokens, so leaked tokens are easy to recognise
+const tokenPrefix = "cpa_"
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// Create a random API token. Only its hash is stored
+func newToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(secret), nil
+}
+
+// Hash of a token as stored. Tokens are random, so a fast hash is enough
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// User that sent a request through withAuth
+func requestUser(r *http.Request) storage.User {
+	user, _ := r.Context().Value(userContextKey).(storage.User)
+	return user
+}
+
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="crypto-price-api"`)
+	writeError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, message)
+}
+
+// Create a http HandlerFunc that requires an `Authorization: Bearer <token>`
+// header with a valid API token. Read-only users and read-only tokens can only
+// send GET and HEAD requests, and revoke the token itself
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, didFind := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !didFind || token == "" {
+			writeUnauthorized(w, "An API token is required, log in with POST /login")
+			return
+		}
+		// Timeout for lookup
+		findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		apiToken, user, err := Store.FindToken(findCtx, hashToken(strings.TrimSpace(token)))
+		cancel()
+		if errors.Is(err, storage.ErrNotFound) || (err == nil && !apiToken.Valid(time.Now().Unix())) {
+			writeUnauthorized(w, "The API token is invalid or expired")
+			return
+		} else if err != nil {
+			writeServerError(w, "Checking API token", err)
+			return
+		}
+		readOnly := apiToken.ReadOnly || user.Role == storage.RoleReadOnly
+		// A leaked read-only token can always be revoked, but not the user's other tokens
+		revoking := r.Method == http.MethodDelete && r.URL.Path == "/tokens/"+apiToken.ID
+		if readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead && !revoking {
+			writeError(w, http.StatusForbidden, ErrorCodeForbidden, "The API token can only read")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// Create a http HandlerFunc that only lets admins through. Used inside withAuth
+func withAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestUser(r).Role != storage.RoleAdmin {
+			writeError(w, http.StatusForbidden, ErrorCodeForbidden, "Only admins can do this")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"crypto-price-api/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Most buckets returned by /candles
+const maxCandles = 2000
+
+// Bucket size of /candles. Buckets of whole days start at midnight in the
+// requested time zone, and shorter buckets are aligned to midnight
+type CandleInterval struct {
+	Duration time.Duration
+	// Days in a bucket, 0 for intervals shorter than a day
+	Days int
+}
+
+var candleIntervals = map[string]CandleInterval{
+	"1m":  {Duration: time.Minute},
+	"5m":  {Duration: 5 * time.Minute},
+	"15m": {Duration: 15 * time.Minute},
+	"30m": {Duration: 30 * time.Minute},
+	"1h":  {Duration: time.Hour},
+	"4h":  {Duration: 4 * time.Hour},
+	"12h": {Duration: 12 * time.Hour},
+	"1d":  {Duration: 24 * time.Hour, Days: 1},
+	// Weeks start on Monday
+	"1w": {Duration: 7 * 24 * time.Hour, Days: 7},
+}
+
+// Rollups of `price_changes_over_time` maintained by the change tracker, largest first
+var candleRollups = []struct {
+	Seconds    int64
+	Collection string
+}{
+	{Seconds: 24 * 60 * 60, Collection: "price_candles_1d"},
+	{Seconds: 60 * 60, Collection: "price_candles_1h"},
+	{Seconds: 60, Collection: "price_candles_1m"},
+}
+
+// VM for an OHLC candle. Prices are null for empty buckets with fill=null
+type CandleVM struct {
+	// Unix epochs bounding the bucket, start inclusive and end exclusive
+	Start int64    `json:"start"`
+	End   int64    `json:"end"`
+	Open  *float32 `json:"open"`
+	High  *float32 `json:"high"`
+	Low   *float32 `json:"low"`
+	Close *float32 `json:"close"`
+	// Number of ticks in the bucket, 0 for empty buckets
+	Count int64 `json:"count"`
+}
+
+// Bucket computed by the aggregation
+type candleBucketDB struct {
+	Start int64   `bson:"_id"`
+	Open  float32 `bson:"open"`
+	High  float32 `bson:"high"`
+	Low   float32 `bson:"low"`
+	Close float32 `bson:"close"`
+	Count int64   `bson:"count"`
+}
+
+// Start of the bucket containing t, in the location of t
+func candleBucketStart(t time.Time, interval CandleInterval) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if interval.Days == 0 {
+		return midnight.Add(t.Sub(midnight).Truncate(interval.Duration))
+	}
+	if interval.Days == 7 {
+		// Days since Monday
+		return midnight.AddDate(0, 0, -((int(midnight.Weekday()) + 6) % 7))
+	}
+	return midnight
+}
+
+// Start of the bucket after the one starting at start. Buckets shorter than a
+// day restart at midnight, so the last bucket of a day may be shorter
+func candleBucketEnd(start time.Time, interval CandleInterval) time.Time {
+	if interval.Days > 0 {
+		return start.AddDate(0, 0, interval.Days)
+	}
+	next := start.Add(interval.Duration)
+	nextMidnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+	if next.After(nextMidnight) {
+		return nextMidnight
+	}
+	return next
+}
+
+// Boundaries of the buckets covering from to to, as Unix epochs. The last
+// boundary is the end of the bucket containing to
+func candleBoundaries(from time.Time, to time.Time, interval CandleInterval) ([]int64, error) {
+	boundaries := []int64{}
+	bucket := candleBucketStart(from, interval)
+	for !bucket.After(to) {
+		if len(boundaries) > maxCandles {
+			return nil, fieldError("from", "from and to span more than %d buckets of the interval", maxCandles)
+		}
+		boundaries = append(boundaries, bucket.Unix())
+		bucket = candleBucketEnd(bucket, interval)
+	}
+	return append(boundaries, bucket.Unix()), nil
+}
+
+// Largest rollup whose candles each fall in a single bucket, or "" for none
+func candleRollupFor(boundaries []int64) string {
+	for _, rollup := range candleRollups {
+		aligned := true
+		for _, boundary := range boundaries {
+			if boundary%rollup.Seconds != 0 {
+				aligned = false
+				break
+			}
+		}
+		if aligned {
+			return rollup.Collection
+		}
+	}
+	return ""
+}
+
+// Group ticks, or rollup candles when rollup is set, into the buckets between boundaries
+func aggregateCandles(ctx context.Context, db *mongo.Database, cryptoId string, boundaries []int64, rollup string) ([]candleBucketDB, error) {
+	collection, timeField := db.Collection("price_changes_over_time"), "time"
+	output := bson.M{
+		"open":  bson.M{"$first": "$lastPrice"},
+		"high":  bson.M{"$max": "$lastPrice"},
+		"low":   bson.M{"$min": "$lastPrice"},
+		"close": bson.M{"$last": "$lastPrice"},
+		"count": bson.M{"$sum": 1},
+	}
+	if rollup != "" {
+		collection, timeField = db.Collection(rollup), "start"
+		output = bson.M{
+			"open":  bson.M{"$first": "$open"},
+			"high":  bson.M{"$max": "$high"},
+			"low":   bson.M{"$min": "$low"},
+			"close": bson.M{"$last": "$close"},
+			"count": bson.M{"$sum": "$count"},
+		}
+	}
+	boundaryValues := bson.A{}
+	for _, boundary := range boundaries {
+		boundaryValues = append(boundaryValues, boundary)
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"name":    cryptoId,
+			timeField: bson.M{"$gte": boundaries[0], "$lt": boundaries[len(boundaries)-1]},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: timeField, Value: 1}}}},
+		{{Key: "$bucket", Value: bson.M{
+			"groupBy":    "$" + timeField,
+			"boundaries": boundaryValues,
+			"output":     output,
+		}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	buckets := []candleBucketDB{}
+	err = cursor.All(ctx, &buckets)
+	return buckets, err
+}
+
+// Price of the last tick before a time, nil when there is none
+func priceBefore(ctx context.Context, db *mongo.Database, cryptoId string, before int64) (*float32, error) {
+	var tick struct {
+		Price float32 `bson:"lastPrice"`
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: -1}})
+	err := db.Collection("price_changes_over_time").FindOne(ctx, bson.M{"name": cryptoId, "time": bson.M{"$lt": before}}, opts).Decode(&tick)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tick.Price, nil
+}
+
+// Candles of every bucket between boundaries. Empty buckets are left out for
+// fill "none", have null prices for "null", or repeat the previous close for
+// "previous", starting from previousClose
+func fillCandles(buckets []candleBucketDB, boundaries []int64, fill string, previousClose *float32) []CandleVM {
+	byStart := map[int64]candleBucketDB{}
+	for _, bucket := range buckets {
+		byStart[bucket.Start] = bucket
+	}
+	candles := []CandleVM{}
+	for i := 0; i < len(boundaries)-1; i++ {
+		candle := CandleVM{Start: boundaries[i], End: boundaries[i+1]}
+		if bucket, didFind := byStart[candle.Start]; didFind {
+			candle.Open, candle.High, candle.Low, candle.Close = &bucket.Open, &bucket.High, &bucket.Low, &bucket.Close
+			candle.Count = bucket.Count
+			previousClose = &bucket.Close
+		} else if fill == "none" {
+			continue
+		} else if fill == "previous" && previousClose != nil {
+			candle.Open, candle.High, candle.Low, candle.Close = previousClose, previousClose, previousClose, previousClose
+		}
+		candles = append(candles, candle)
+	}
+	return candles
+}
+
+// Handle to look up OHLC candles of a crypto, oldest first
+// GET /candles?cryptoId=BTC&interval=1h&from=&to=&tz=Australia/Sydney&fill=previous
+// interval is 1m, 5m, 15m, 30m, 1h (default), 4h, 12h, 1d or 1w. from and to are
+// Unix epochs or RFC3339 times, default the 100 buckets up to now, at most 2000 buckets.
+// Buckets are aligned to midnight in tz, an IANA time zone. Default UTC.
+// Empty buckets repeat the previous close for fill=previous (default), have null
+// prices for fill=null, or are left out for fill=none.
+// Candles are built from the change tracker's 1m, 1h or 1d rollups when they line
+// up with the buckets and have data, otherwise from the ticks
+// Returns: []CandleVM
+func candlesHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/candles").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	cryptoId, err := requiredParam(r, "cryptoId")
+	if err != nil {
+		writeServerError(w, "Looking up candles", err)
+		return
+	}
+	intervalName := r.URL.Query().Get("interval")
+	if intervalName == "" {
+		intervalName = "1h"
+	}
+	interval, didFind := candleIntervals[intervalName]
+	if !didFind {
+		writeFieldError(w, fieldError("interval", "interval must be 1m, 5m, 15m, 30m, 1h, 4h, 12h, 1d or 1w"))
+		return
+	}
+	location := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		if location, err = time.LoadLocation(tz); err != nil {
+			writeFieldError(w, fieldError("tz", "tz must be an IANA time zone such as Australia/Sydney"))
+			return
+		}
+	}
+	fill := r.URL.Query().Get("fill")
+	if fill == "" {
+		fill = "previous"
+	}
+	if fill != "previous" && fill != "null" && fill != "none" {
+		writeFieldError(w, fieldError("fill", "fill must be previous, null or none"))
+		return
+	}
+	fromUnix, toUnix, err := parseTimeRange(r)
+	if err != nil {
+		writeServerError(w, "Looking up candles", err)
+		return
+	}
+	to := time.Now()
+	if toUnix != 0 {
+		to = time.Unix(toUnix, 0)
+	}
+	from := to.Add(-99 * interval.Duration)
+	if fromUnix != 0 {
+		from = time.Unix(fromUnix, 0)
+	}
+	if from.After(to) {
+		writeFieldError(w, fieldError("from", "from must not be after to"))
+		return
+	}
+	boundaries, err := candleBoundaries(from.In(location), to.In(location), interval)
+	if err != nil {
+		writeServerError(w, "Looking up candles", err)
+		return
+	}
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	db := MongoClient.Database("crypto")
+	rollup := candleRollupFor(boundaries)
+	var buckets []candleBucketDB
+	if rollup != "" {
+		buckets, err = aggregateCandles(findCtx, db, cryptoId, boundaries, rollup)
+	}
+	// Rollups are missing until the tracker has seen ticks or rebuilt them
+	if err == nil && len(buckets) == 0 {
+		buckets, err = aggregateCandles(findCtx, db, cryptoId, boundaries, "")
+	}
+	var previousClose *float32
+	if err == nil && fill == "previous" {
+		previousClose, err = priceBefore(findCtx, db, cryptoId, boundaries[0])
+	}
+	if err != nil {
+		writeServerError(w, "Looking up candles", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fillCandles(buckets, boundaries, fill, previousClose))
+}
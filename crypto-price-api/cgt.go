@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	// Embed the time zone database, as the API image has none
+	_ "time/tzdata"
+
+	"crypto-price-api/metrics"
+	"crypto-price-api/storage"
+)
+
+// Australian financial years and CGT event dates are in Sydney time
+var cgtLocation = mustLoadLocation("Australia/Sydney")
+
+// Share of a capital gain discounted when the asset was held for at least 12 months
+const cgtDiscount = 0.5
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+// VM for a disposal of a CGT asset. Money is in AUD, dates are YYYY-MM-DD in Sydney time
+type CGTDisposalVM struct {
+	AssetId         string  `json:"assetId"`
+	Name            string  `json:"name"`
+	Amount          float32 `json:"amount"`
+	AcquisitionDate string  `json:"acquisitionDate"`
+	DisposalDate    string  `json:"disposalDate"`
+	// Purchase cost including the purchase fee
+	CostBase float64 `json:"costBase"`
+	// Sale value net of the sale fee
+	Proceeds float64 `json:"proceeds"`
+	// Negative for a capital loss
+	Gain float64 `json:"gain"`
+	// Held for at least 12 months, not counting the days of acquisition and disposal
+	DiscountEligible bool `json:"discountEligible"`
+	// Gain after the discount, when eligible
+	DiscountedGain float64 `json:"discountedGain"`
+}
+
+// VM for the capital gains of a July-June financial year
+type CGTReportVM struct {
+	// Such as "2023-24"
+	FinancialYear string          `json:"financialYear"`
+	From          string          `json:"from"`
+	To            string          `json:"to"`
+	Disposals     []CGTDisposalVM `json:"disposals"`
+	TotalProceeds float64         `json:"totalProceeds"`
+	TotalCostBase float64         `json:"totalCostBase"`
+	// Sum of the gains, and of the losses as a positive amount
+	TotalGains  float64 `json:"totalGains"`
+	TotalLosses float64 `json:"totalLosses"`
+	// Gains less losses, with losses applied to non-discountable gains first and
+	// the discount applied to what remains of the discountable gains. Not below 0
+	NetCapitalGain float64 `json:"netCapitalGain"`
+}
+
+// Start of the financial year ending in June of year, and the start of the next one
+func financialYearBounds(year int) (time.Time, time.Time) {
+	return time.Date(year-1, time.July, 1, 0, 0, 0, 0, cgtLocation), time.Date(year, time.July, 1, 0, 0, 0, 0, cgtLocation)
+}
+
+// Year in which the financial year containing t ends
+func financialYearOf(t time.Time) int {
+	t = t.In(cgtLocation)
+	if t.Month() >= time.July {
+		return t.Year() + 1
+	}
+	return t.Year()
+}
+
+// Whether an asset disposed of at disposed was held for at least 12 months since acquired
+func cgtDiscountEligible(acquired time.Time, disposed time.Time) bool {
+	acquired = acquired.In(cgtLocation)
+	disposed = disposed.In(cgtLocation)
+	firstEligibleDay := time.Date(acquired.Year()+1, acquired.Month(), acquired.Day()+1, 0, 0, 0, 0, cgtLocation)
+	return !disposed.Before(firstEligibleDay)
+}
+
+// Build the capital gains report of the financial year ending in June of year from the sold
+// assets. averageCosts are the storage.AverageUnitCosts of the owner's disposals
+func buildCGTReport(assets []storage.Asset, averageCosts map[string]float64, year int) CGTReportVM {
+	from, to := financialYearBounds(year)
+	report := CGTReportVM{
+		FinancialYear: fmt.Sprintf("%d-%02d", year-1, year%100),
+		From:          from.Format(time.DateOnly),
+		To:            to.AddDate(0, 0, -1).Format(time.DateOnly),
+		Disposals:     []CGTDisposalVM{},
+	}
+	sold := []storage.Asset{}
+	for _, asset := range assets {
+		saleTime := int64(asset.SaleTime)
+		if asset.Status == "sold" && saleTime >= from.Unix() && saleTime < to.Unix() {
+			sold = append(sold, asset)
+		}
+	}
+	sort.SliceStable(sold, func(i, j int) bool {
+		if sold[i].SaleTime != sold[j].SaleTime {
+			return sold[i].SaleTime < sold[j].SaleTime
+		}
+		return sold[i].PurchaseTime < sold[j].PurchaseTime
+	})
+	var discountableGains, otherGains float64
+	for _, asset := range sold {
+		acquired := time.Unix(int64(asset.PurchaseTime), 0).In(cgtLocation)
+		disposed := time.Unix(int64(asset.SaleTime), 0).In(cgtLocation)
+		amount := float64(asset.Amount)
+		disposal := CGTDisposalVM{
+			AssetId:          asset.ID,
+			Name:             asset.Name,
+			Amount:           asset.Amount,
+			AcquisitionDate:  acquired.Format(time.DateOnly),
+			DisposalDate:     disposed.Format(time.DateOnly),
+			CostBase:         storage.CostBasis(asset, averageCosts[asset.ID]),
+			Proceeds:         amount*float64(asset.SalePrice) - float64(asset.SaleFee),
+			DiscountEligible: cgtDiscountEligible(acquired, disposed),
+		}
+		disposal.Gain = disposal.Proceeds - disposal.CostBase
+		disposal.DiscountedGain = disposal.Gain
+		report.TotalProceeds += disposal.Proceeds
+		report.TotalCostBase += disposal.CostBase
+		switch {
+		case disposal.Gain < 0:
+			report.TotalLosses -= disposal.Gain
+		case disposal.DiscountEligible:
+			disposal.DiscountedGain = disposal.Gain * (1 - cgtDiscount)
+			report.TotalGains += disposal.Gain
+			discountableGains += disposal.Gain
+		default:
+			report.TotalGains += disposal.Gain
+			otherGains += disposal.Gain
+		}
+		report.Disposals = append(report.Disposals, disposal)
+	}
+	// Losses reduce gains before the discount, non-discountable gains first
+	losses := report.TotalLosses
+	applied := min(losses, otherGains)
+	otherGains -= applied
+	losses -= applied
+	discountableGains -= min(losses, discountableGains)
+	report.NetCapitalGain = otherGains + discountableGains*(1-cgtDiscount)
+	return report
+}
+
+// Format AUD for the CSV report
+func formatAUD(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// Write the disposals of a report as CSV, one row per disposal
+func writeCGTReportCSV(w io.Writer, report CGTReportVM) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{
+		"financial_year", "asset_id", "name", "amount", "acquisition_date", "disposal_date",
+		"cost_base", "proceeds", "gain", "discount_eligible", "discounted_gain",
+	})
+	for _, disposal := range report.Disposals {
+		writer.Write([]string{
+			report.FinancialYear,
+			disposal.AssetId,
+			disposal.Name,
+			strconv.FormatFloat(float64(disposal.Amount), 'f', -1, 32),
+			disposal.AcquisitionDate,
+			disposal.DisposalDate,
+			formatAUD(disposal.CostBase),
+			formatAUD(disposal.Proceeds),
+			formatAUD(disposal.Gain),
+			strconv.FormatBool(disposal.DiscountEligible),
+			formatAUD(disposal.DiscountedGain),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Handle to report the capital gains of an Australian financial year
+// GET /reports/cgt?year=2024&format=csv
+// year is the year the financial year ends in, so 2024 is 1 July 2023 to 30 June 2024.
+// Default the current financial year. format is "json" (default) or "csv"
+// Returns: CGTReportVM, or a CSV of its disposals
+func cgtReportHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/reports/cgt").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	year := financialYearOf(time.Now())
+	if value := r.URL.Query().Get("year"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 2000 || parsed > 9999 {
+			writeFieldError(w, fieldError("year", "year must be the year a financial year ends in, such as 2024"))
+			return
+		}
+		year = parsed
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeFieldError(w, fieldError("format", "format must be json or csv"))
+		return
+	}
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	assets, err := Store.ListAssets(findCtx, requestUser(r).ID)
+	if err != nil {
+		writeServerError(w, "Building CGT report", err)
+		return
+	}
+	disposals, err := Store.ListDisposals(findCtx, requestUser(r).ID, "")
+	if err != nil {
+		writeServerError(w, "Building CGT report", err)
+		return
+	}
+	report := buildCGTReport(assets, storage.AverageUnitCosts(disposals), year)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"cgt-%s.csv\"", report.FinancialYear))
+		writeCGTReportCSV(w, report)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
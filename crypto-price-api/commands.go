@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"crypto-price-api/storage"
+)
+
+// Run a command instead of serving the API. Storage is configured with the same
+// environment variables as the API
+//
+//	cgt-report [-user admin] [-year 2024] [-format json|csv] [-out report.csv]
+//	import-trades [-user admin] -file trades.csv [-exchange kraken] [-method fifo] [-commit]
+func runCommand(command string, args []string) {
+	// "mongo" (default), "sqlite" or "memory"
+	backend, didFind := os.LookupEnv("STORAGE_BACKEND")
+	if !didFind {
+		backend = storage.BackendMongo
+	}
+	openCtx, openCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer openCancel()
+	store, err := storage.Open(openCtx, storage.Config{
+		Backend:    backend,
+		MongoURL:   os.Getenv("MONGO_URL"),
+		SQLitePath: os.Getenv("SQLITE_PATH"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close(context.Background())
+
+	// Large reports and imports can take longer than connecting
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	switch command {
+	case "cgt-report":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		username := flags.String("user", storage.DefaultUserUsername, "user whose sales are reported")
+		year := flags.Int("year", financialYearOf(time.Now()), "year the July-June financial year ends in")
+		format := flags.String("format", "csv", "json or csv")
+		out := flags.String("out", "", "file to write the report to. Default stdout")
+		flags.Parse(args)
+		err = exportCGTReport(ctx, store, *username, *year, *format, *out)
+	case "import-trades":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		username := flags.String("user", storage.DefaultUserUsername, "user the trades are imported for")
+		file := flags.String("file", "", "trade history export to import")
+		exchange := flags.String("exchange", "", "coinbase, kraken, coinspot or binance. Default detected from the header")
+		method := flags.String("method", CostBasisMethod, "fifo, lifo, hifo or average, to match sales to held lots")
+		commit := flags.Bool("commit", false, "write the new trades, otherwise they are only previewed")
+		flags.Parse(args)
+		err = importTrades(ctx, store, *username, *file, strings.ToLower(*exchange), *method, *commit)
+	default:
+		log.Fatalf("Unknown command %q. Valid commands are: cgt-report, import-trades\n", command)
+	}
+	if err != nil {
+		log.Fatalf("Command %s failed: %v\n", command, err)
+	}
+	log.Printf("Command %s completed\n", command)
+}
+
+// Write the capital gains report of a user for a financial year to a file, or stdout when out is empty
+func exportCGTReport(ctx context.Context, store storage.Store, username string, year int, format string, out string) error {
+	if format != "json" && format != "csv" {
+		return fieldError("format", "format must be json or csv")
+	}
+	user, err := store.FindUserByUsername(ctx, username)
+	if err != nil {
+		return fmt.Errorf("finding user %s: %w", username, err)
+	}
+	assets, err := store.ListAssets(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	disposals, err := store.ListDisposals(ctx, user.ID, "")
+	if err != nil {
+		return err
+	}
+	report := buildCGTReport(assets, storage.AverageUnitCosts(disposals), year)
+	var w io.Writer = os.Stdout
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return writeCGTReportCSV(w, report)
+}
+
+// Preview or import a trade history export for a user, writing the result to stdout
+func importTrades(ctx context.Context, store storage.Store, username string, path string, exchange string, method string, commit bool) error {
+	if _, didFind := exchangeParsers[exchange]; exchange != "" && !didFind {
+		return fieldError("exchange", "exchange must be coinbase, kraken, coinspot or binance")
+	}
+	if !storage.ValidCostBasisMethod(method) {
+		return fieldError("method", "method must be fifo, lifo, hifo or average")
+	}
+	user, err := store.FindUserByUsername(ctx, username)
+	if err != nil {
+		return fmt.Errorf("finding user %s: %w", username, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	result, err := previewImport(ctx, store, user.ID, file, exchange)
+	if err != nil {
+		return err
+	}
+	if commit {
+		if err = commitImport(ctx, store, user.ID, &result, method); err != nil {
+			return err
+		}
+		log.Printf("Imported %d %s trades, %d duplicates skipped\n", result.New, result.Exchange, result.Duplicates)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
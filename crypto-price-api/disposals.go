@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"crypto-price-api/metrics"
+	"crypto-price-api/storage"
+)
+
+// Method used to match sales to held lots when a sale does not name one. Set by COST_BASIS_METHOD
+var CostBasisMethod = storage.CostBasisFIFO
+
+// Read CostBasisMethod from COST_BASIS_METHOD: "fifo" (default), "lifo", "hifo" or "average"
+func loadCostBasisMethod() error {
+	if method, didFind := os.LookupEnv("COST_BASIS_METHOD"); didFind {
+		if !storage.ValidCostBasisMethod(method) {
+			return fmt.Errorf("invalid COST_BASIS_METHOD %q", method)
+		}
+		CostBasisMethod = method
+	}
+	return nil
+}
+
+// VM for the part of a sale taken from a held lot
+type LotMatchVM struct {
+	// Held asset the amount was taken from, and the sold asset recording it
+	LotId         string  `json:"lotId"`
+	AssetId       string  `json:"assetId"`
+	Amount        float32 `json:"amount"`
+	PurchasePrice float32 `json:"purchasePrice"`
+	PurchaseTime  float32 `json:"purchaseTime"`
+	CostBasis     float64 `json:"costBasis"`
+	Proceeds      float64 `json:"proceeds"`
+	Gain          float64 `json:"gain"`
+}
+
+// VM for a sale matched to held lots, with its realized gain
+type DisposalVM struct {
+	DisposalId string  `json:"_id"`
+	Name       string  `json:"name"`
+	Amount     float32 `json:"amount"`
+	Price      float32 `json:"price"`
+	Time       float32 `json:"time"`
+	Fee        float32 `json:"fee"`
+	// "fifo", "lifo", "hifo" or "average"
+	Method    string       `json:"method"`
+	CostBasis float64      `json:"costBasis"`
+	Proceeds  float64      `json:"proceeds"`
+	Gain      float64      `json:"gain"`
+	Matches   []LotMatchVM `json:"matches"`
+}
+
+func disposalToVM(disposal storage.Disposal) DisposalVM {
+	matches := []LotMatchVM{}
+	for _, match := range disposal.Matches {
+		matches = append(matches, LotMatchVM{
+			LotId:         match.LotID,
+			AssetId:       match.AssetID,
+			Amount:        match.Amount,
+			PurchasePrice: match.PurchasePrice,
+			PurchaseTime:  match.PurchaseTime,
+			CostBasis:     match.CostBasis,
+			Proceeds:      match.Proceeds,
+			Gain:          match.Gain,
+		})
+	}
+	return DisposalVM{
+		DisposalId: disposal.ID,
+		Name:       disposal.Name,
+		Amount:     disposal.Amount,
+		Price:      disposal.Price,
+		Time:       disposal.Time,
+		Fee:        disposal.Fee,
+		Method:     disposal.Method,
+		CostBasis:  disposal.CostBasis,
+		Proceeds:   disposal.Proceeds,
+		Gain:       disposal.Gain,
+		Matches:    matches,
+	}
+}
+
+// Handler for /sales route
+func salesHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/sales").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	switch r.Method {
+	case http.MethodGet:
+		findSalesHandler(w, r)
+	case http.MethodPost:
+		createSaleHandler(w, r)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// Look up sales and their realized gains, newest first
+// GET /sales?cryptoId=BTC&from=&to=
+// cryptoId is optional. from and to are optional Unix epochs or RFC3339 times bounding the sale time
+// Returns: []DisposalVM
+func findSalesHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		writeServerError(w, "Looking up sales", err)
+		return
+	}
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	disposals, err := Store.ListDisposals(findCtx, requestUser(r).ID, r.URL.Query().Get("cryptoId"))
+	if err != nil {
+		writeServerError(w, "Looking up sales", err)
+		return
+	}
+	results := []DisposalVM{}
+	for _, disposal := range disposals {
+		if float64(disposal.Time) < float64(from) || (to > 0 && float64(disposal.Time) > float64(to)) {
+			continue
+		}
+		results = append(results, disposalToVM(disposal))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// Sell an amount of a crypto from its held lots, matched by a cost basis method.
+// Required fields are:
+//
+//	cryptoId string
+//	amount float32
+//
+// Optional fields are salePrice, saleTime and fee as for /assets/sell, and
+// method, one of "fifo", "lifo", "hifo" or "average". Default COST_BASIS_METHOD
+// POST /sales
+// Returns: DisposalVM
+func createSaleHandler(w http.ResponseWriter, r *http.Request) {
+	// Limit request size to 10MB (more than enough!)
+	r.ParseMultipartForm(10 << 20)
+	cryptoId, err := requiredParam(r, "cryptoId")
+	if err != nil {
+		writeServerError(w, "Selling crypto", err)
+		return
+	}
+	if _, err = requiredParam(r, "amount"); err != nil {
+		writeServerError(w, "Selling crypto", err)
+		return
+	}
+	sale, err := parseSaleForm(r)
+	if err != nil {
+		writeServerError(w, "Selling crypto", err)
+		return
+	}
+	method := CostBasisMethod
+	if err = formString(r, "method", false, &method); err != nil {
+		writeServerError(w, "Selling crypto", err)
+		return
+	}
+	if !storage.ValidCostBasisMethod(method) {
+		writeFieldError(w, fieldError("method", "method must be fifo, lifo, hifo or average"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	// Sell at the current price unless the execution price was provided
+	if _, didFind := r.Form["salePrice"]; !didFind {
+		currentPrice, err := Store.FindPrice(ctx, cryptoId)
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, fmt.Sprintf("No current price for %s, provide salePrice", cryptoId))
+			return
+		} else if err != nil {
+			writeServerError(w, "Selling crypto", err)
+			return
+		}
+		sale.Price = currentPrice.Price
+	}
+	disposal, err := Store.Dispose(ctx, storage.Disposal{
+		OwnerID: requestUser(r).ID,
+		Name:    cryptoId,
+		Amount:  sale.Amount,
+		Price:   sale.Price,
+		Time:    sale.Time,
+		Fee:     sale.Fee,
+		Method:  method,
+	})
+	if errors.Is(err, storage.ErrInsufficientAmount) {
+		err = fieldError("amount", "amount is more than the %s held at saleTime", cryptoId)
+	}
+	if err != nil {
+		writeServerError(w, "Selling crypto", err)
+		return
+	}
+	fmt.Printf("Sold [%f] of [%s] from %d lots by %s\n", disposal.Amount, disposal.Name, len(disposal.Matches), disposal.Method)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(disposalToVM(disposal))
+}
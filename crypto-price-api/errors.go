@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"crypto-price-api/metrics"
+	"crypto-price-api/storage"
+)
+
+// Error codes of ErrorVM
+const (
+	ErrorCodeInvalidField     = "invalid_field"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeVersionConflict  = "version_conflict"
+	ErrorCodeConflict         = "conflict"
+	ErrorCodeUnauthorized     = "unauthorized"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeUnavailable      = "unavailable"
+	ErrorCodeInternal         = "internal"
+)
+
+// Body of every error response
+// {"error": {"status": 400, "code": "invalid_field", "field": "amount", "message": "amount must be a number"}}
+type ErrorVM struct {
+	Error ErrorDetailVM `json:"error"`
+}
+
+type ErrorDetailVM struct {
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	// Request field that failed validation, only set for invalid_field
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// Returned by request parsing when a field is missing or invalid
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+// Create a FieldError with a message about field
+func fieldError(field string, format string, args ...any) *FieldError {
+	return &FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// Write an error response
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeErrorDetail(w, ErrorDetailVM{Status: status, Code: code, Message: message})
+}
+
+func writeErrorDetail(w http.ResponseWriter, detail ErrorDetailVM) {
+	metrics.HTTPErrorsCounter.WithLabelValues(detail.Code).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(detail.Status)
+	json.NewEncoder(w).Encode(ErrorVM{Error: detail})
+}
+
+// Write a 400 response naming the invalid field
+func writeFieldError(w http.ResponseWriter, err *FieldError) {
+	writeErrorDetail(w, ErrorDetailVM{
+		Status:  http.StatusBadRequest,
+		Code:    ErrorCodeInvalidField,
+		Field:   err.Field,
+		Message: err.Message,
+	})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, fmt.Sprintf("%s is not supported", r.Method))
+}
+
+// Write the response for an error returned by parsing or storage.
+// Unexpected errors are logged and hidden from the client behind a 500
+func writeServerError(w http.ResponseWriter, action string, err error) {
+	var fieldErr *FieldError
+	switch {
+	case errors.As(err, &fieldErr):
+		writeFieldError(w, fieldErr)
+	case errors.Is(err, storage.ErrNotFound):
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, action+": not found")
+	case errors.Is(err, storage.ErrUsernameTaken):
+		writeError(w, http.StatusConflict, ErrorCodeConflict, action+": the username is already taken")
+	case errors.Is(err, storage.ErrDuplicateImport):
+		writeError(w, http.StatusConflict, ErrorCodeConflict, action+": "+err.Error())
+	case errors.Is(err, storage.ErrAlreadySold):
+		writeError(w, http.StatusConflict, ErrorCodeConflict, action+": the asset is already sold")
+	case errors.Is(err, storage.ErrVersionConflict):
+		writeError(w, http.StatusPreconditionFailed, ErrorCodeVersionConflict, action+": the asset was changed, reload it and try again")
+	default:
+		log.Printf("%s failed: %v\n", action, err)
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, action+" failed")
+	}
+}
+
+// Records whether a response was started, so a panic after writing is not answered twice
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(body []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(body)
+}
+
+// Create a http HandlerFunc that recovers from panics in handlers, logging the
+// stack and returning a 500 instead of dropping the connection
+func withRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Used by net/http to abort a response on purpose
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			metrics.HTTPPanicsCounter.WithLabelValues(r.URL.Path).Inc()
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, recovered, debug.Stack())
+			if !recorder.wroteHeader {
+				writeError(w, http.StatusInternalServerError, ErrorCodeInternal, "Internal server error")
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
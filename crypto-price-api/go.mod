@@ -5,8 +5,10 @@ go 1.21
 toolchain go1.21.1
 
 require (
+	github.com/mattn/go-sqlite3 v1.14.28
 	github.com/prometheus/client_golang v1.17.0
 	go.mongodb.org/mongo-driver v1.17.3
+	golang.org/x/crypto v0.27.0
 )
 
 require (
@@ -24,7 +26,6 @@ require (
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
 	golang.org/x/text v0.18.0 // indirect
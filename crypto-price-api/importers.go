@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of an ImportTradeVM
+const (
+	ImportStatusNew       = "new"
+	ImportStatusDuplicate = "duplicate"
+	// Rows that are not trades, such as deposits and withdrawals
+	ImportStatusSkipped = "skipped"
+	ImportStatusInvalid = "invalid"
+)
+
+// VM for a row of an exchange export. Prices and fees are in AUD
+type ImportTradeVM struct {
+	// Line of the row in the file
+	Row int `json:"row"`
+	// Exchange and its trade ID, or a hash of the row when the export has no IDs
+	ImportId string  `json:"importId,omitempty"`
+	Side     string  `json:"side,omitempty"`
+	Name     string  `json:"name,omitempty"`
+	Amount   float32 `json:"amount"`
+	Price    float32 `json:"price"`
+	Fee      float32 `json:"fee"`
+	Time     float32 `json:"time"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// Parses the rows of an exchange export, given the columns of its header
+type exchangeParser struct {
+	// Columns identifying the export
+	required []string
+	parse    func(row csvRow) ImportTradeVM
+}
+
+// Exchanges in the order their exports are detected
+var exchangeNames = []string{"coinbase", "kraken", "coinspot", "binance"}
+
+// Exports of the supported exchanges
+var exchangeParsers = map[string]exchangeParser{
+	"coinbase": {required: []string{"timestamp", "transaction type", "asset", "quantity transacted"}, parse: parseCoinbaseRow},
+	"kraken":   {required: []string{"txid", "pair", "time", "type", "price", "vol", "fee"}, parse: parseKrakenRow},
+	"coinspot": {required: []string{"transaction date", "type", "market", "amount"}, parse: parseCoinSpotRow},
+	"binance":  {required: []string{"date(utc)", "pair", "side", "price", "executed", "fee"}, parse: parseBinanceRow},
+}
+
+// Row of a CSV file with its columns named by the header
+type csvRow struct {
+	line    int
+	record  []string
+	columns map[string]int
+}
+
+// Value of the first named column present, trimmed
+func (r csvRow) get(names ...string) string {
+	for _, name := range names {
+		if i, didFind := r.columns[name]; didFind && i < len(r.record) {
+			return strings.TrimSpace(r.record[i])
+		}
+	}
+	return ""
+}
+
+// Number in the first named column present, ignoring currency symbols and thousands separators
+func (r csvRow) number(names ...string) (float64, error) {
+	value := strings.TrimLeft(r.get(names...), "A$")
+	value = strings.ReplaceAll(value, ",", "")
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number: %q", names[0], value)
+	}
+	return number, nil
+}
+
+// Trade ID for exports without one. Identical rows are numbered by occurrence by parseExchangeCSV
+func (r csvRow) hash() string {
+	sum := sha1.Sum([]byte(strings.Join(r.record, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Parse a trade history export, detecting the exchange from the header when exchange is empty.
+// Returns the exchange and a trade for every row after the header
+func parseExchangeCSV(input io.Reader, exchange string) (string, []ImportTradeVM, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return exchange, nil, fieldError("file", "file is not a CSV: %v", err)
+	}
+	// Some exports start with a preamble before the header
+	header := -1
+	var columns map[string]int
+	for i, record := range records {
+		columns = map[string]int{}
+		for j, name := range record {
+			name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+			columns[name] = j
+		}
+		if exchange == "" {
+			for _, name := range exchangeNames {
+				if hasColumns(columns, exchangeParsers[name].required) {
+					exchange = name
+					break
+				}
+			}
+		}
+		if parser, didFind := exchangeParsers[exchange]; didFind && hasColumns(columns, parser.required) {
+			header = i
+			break
+		}
+	}
+	if exchange == "" {
+		return exchange, nil, fieldError("file", "file is not a Coinbase, Kraken, CoinSpot or Binance trade history export")
+	}
+	if header < 0 {
+		return exchange, nil, fieldError("file", "file is not a %s trade history export", exchange)
+	}
+	parser := exchangeParsers[exchange]
+	trades := []ImportTradeVM{}
+	occurrences := map[string]int{}
+	for i, record := range records[header+1:] {
+		row := csvRow{line: header + i + 2, record: record, columns: columns}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		trade := parser.parse(row)
+		trade.Row = row.line
+		if trade.ImportId == "" && trade.Status != ImportStatusSkipped {
+			trade.ImportId = row.hash()
+		}
+		if trade.ImportId != "" {
+			trade.ImportId = exchange + ":" + trade.ImportId
+			occurrences[trade.ImportId]++
+			if n := occurrences[trade.ImportId]; n > 1 {
+				trade.ImportId = fmt.Sprintf("%s-%d", trade.ImportId, n)
+			}
+		}
+		trades = append(trades, trade)
+	}
+	return exchange, trades, nil
+}
+
+func hasColumns(columns map[string]int, required []string) bool {
+	for _, name := range required {
+		if _, didFind := columns[name]; !didFind {
+			return false
+		}
+	}
+	return true
+}
+
+// Mark a trade invalid
+func invalidTrade(trade ImportTradeVM, format string, args ...any) ImportTradeVM {
+	trade.Status = ImportStatusInvalid
+	trade.Message = fmt.Sprintf(format, args...)
+	return trade
+}
+
+// Parse a time in one of layouts, in location when the layout has no zone
+func parseTradeTime(value string, location *time.Location, layouts ...string) (float32, error) {
+	for _, layout := range layouts {
+		if parsed, err := time.ParseInLocation(layout, value, location); err == nil {
+			return float32(parsed.Unix()), nil
+		}
+	}
+	return 0, fmt.Errorf("time is not recognised: %q", value)
+}
+
+// Set the amount, AUD price and fee of a trade, checking the quote currency is AUD
+func pricedTrade(trade ImportTradeVM, quote string, amount float64, price float64, fee float64, err error) ImportTradeVM {
+	if err != nil {
+		return invalidTrade(trade, "%v", err)
+	}
+	if quote != "AUD" {
+		return invalidTrade(trade, "only AUD trades can be imported, not %s", quote)
+	}
+	if amount <= 0 || price < 0 || fee < 0 {
+		return invalidTrade(trade, "amount must be positive, and price and fee must not be negative")
+	}
+	trade.Amount = float32(amount)
+	trade.Price = float32(price)
+	trade.Fee = float32(fee)
+	trade.Status = ImportStatusNew
+	return trade
+}
+
+// Side of a trade from a buy or sell transaction type
+func tradeSide(value string) string {
+	value = strings.ToLower(value)
+	switch {
+	case strings.HasSuffix(value, "buy"):
+		return "buy"
+	case strings.HasSuffix(value, "sell"):
+		return "sell"
+	}
+	return ""
+}
+
+// Coinbase transaction history. Rows other than buys and sells are skipped
+func parseCoinbaseRow(row csvRow) ImportTradeVM {
+	trade := ImportTradeVM{ImportId: row.get("id"), Side: tradeSide(row.get("transaction type")), Name: strings.ToUpper(row.get("asset"))}
+	if trade.Side == "" {
+		trade.Status = ImportStatusSkipped
+		trade.Message = fmt.Sprintf("%s is not a trade", row.get("transaction type"))
+		return trade
+	}
+	var err error
+	trade.Time, err = parseTradeTime(row.get("timestamp"), time.UTC, time.RFC3339, "2006-01-02 15:04:05 MST", "2006-01-02 15:04:05")
+	if err != nil {
+		return invalidTrade(trade, "%v", err)
+	}
+	// Newer exports have negative quantities for sells
+	amount, err := row.number("quantity transacted")
+	amount = math.Abs(amount)
+	var price, fee float64
+	if err == nil {
+		price, err = row.number("spot price at transaction", "price at transaction")
+	}
+	if err == nil {
+		fee, err = row.number("fees and/or spread", "fees")
+	}
+	quote := strings.ToUpper(row.get("spot price currency", "price currency"))
+	return pricedTrade(trade, quote, amount, price, fee, err)
+}
+
+// Kraken pair names use X and Z prefixes and some legacy symbols
+var krakenAssets = map[string]string{"XBT": "BTC", "XDG": "DOGE"}
+
+// Split a Kraken pair such as XXBTZAUD or ETH/AUD into base and quote
+func krakenPair(pair string) (string, string) {
+	pair = strings.ToUpper(strings.ReplaceAll(pair, "/", ""))
+	base, quote := pair, ""
+	for _, candidate := range []string{"AUD", "USD", "EUR", "USDT", "XBT"} {
+		if !strings.HasSuffix(pair, candidate) || len(pair) <= len(candidate) {
+			continue
+		}
+		base, quote = strings.TrimSuffix(pair, candidate), candidate
+		// Legacy pairs prefix both symbols, as in XXBTZAUD, so the quote is only
+		// prefixed when the rest is a prefixed 4 letter base. XTZAUD is XTZ and AUD
+		if prefixed := base[:len(base)-1]; len(prefixed) == 4 && prefixed[0] == 'X' {
+			if prefix := base[len(base)-1]; prefix == 'X' || prefix == 'Z' {
+				base, quote = prefixed, string(prefix)+candidate
+			}
+		}
+		break
+	}
+	normalise := func(symbol string) string {
+		if len(symbol) == 4 && (symbol[0] == 'X' || symbol[0] == 'Z') {
+			symbol = symbol[1:]
+		}
+		if name, didFind := krakenAssets[symbol]; didFind {
+			return name
+		}
+		return symbol
+	}
+	return normalise(base), normalise(quote)
+}
+
+// Kraken trades export. Prices and fees are in the quote currency
+func parseKrakenRow(row csvRow) ImportTradeVM {
+	base, quote := krakenPair(row.get("pair"))
+	trade := ImportTradeVM{ImportId: row.get("txid"), Side: tradeSide(row.get("type")), Name: base}
+	if trade.Side == "" {
+		return invalidTrade(trade, "type must be buy or sell, not %q", row.get("type"))
+	}
+	var err error
+	trade.Time, err = parseTradeTime(row.get("time"), time.UTC, "2006-01-02 15:04:05.9999", "2006-01-02 15:04:05")
+	if err != nil {
+		return invalidTrade(trade, "%v", err)
+	}
+	amount, err := row.number("vol")
+	var price, fee float64
+	if err == nil {
+		price, err = row.number("price")
+	}
+	if err == nil {
+		fee, err = row.number("fee")
+	}
+	return pricedTrade(trade, quote, amount, price, fee, err)
+}
+
+// CoinSpot order history. Times are in Sydney time
+func parseCoinSpotRow(row csvRow) ImportTradeVM {
+	base, quote, _ := strings.Cut(strings.ToUpper(row.get("market")), "/")
+	trade := ImportTradeVM{Side: tradeSide(row.get("type")), Name: base}
+	if trade.Side == "" {
+		return invalidTrade(trade, "type must be buy or sell, not %q", row.get("type"))
+	}
+	var err error
+	trade.Time, err = parseTradeTime(row.get("transaction date"), cgtLocation, "2/01/2006 3:04 PM", "02/01/2006 15:04", "2/01/2006 15:04:05")
+	if err != nil {
+		return invalidTrade(trade, "%v", err)
+	}
+	amount, err := row.number("amount")
+	var price, fee float64
+	if err == nil {
+		price, err = row.number("rate ex. fee", "rate inc. fee")
+	}
+	if err == nil {
+		fee, err = row.number("fee aud (inc gst)", "fee")
+	}
+	return pricedTrade(trade, quote, amount, price, fee, err)
+}
+
+// Split a Binance amount such as "0.0012BTC" into its number and asset
+func binanceAmount(value string) (float64, string, error) {
+	value = strings.ReplaceAll(value, ",", "")
+	end := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if end < 0 {
+		end = len(value)
+	}
+	number, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("amount is not a number: %q", value)
+	}
+	return number, strings.ToUpper(value[end:]), nil
+}
+
+// Binance spot trade history. Fees paid in the bought crypto are converted at
+// the trade price, and fees in other assets such as BNB are not counted
+func parseBinanceRow(row csvRow) ImportTradeVM {
+	pair := strings.ToUpper(row.get("pair"))
+	trade := ImportTradeVM{Side: tradeSide(row.get("side")), Name: strings.TrimSuffix(pair, "AUD")}
+	quote := "AUD"
+	if !strings.HasSuffix(pair, "AUD") {
+		quote = pair
+	}
+	if trade.Side == "" {
+		return invalidTrade(trade, "side must be buy or sell, not %q", row.get("side"))
+	}
+	var err error
+	trade.Time, err = parseTradeTime(row.get("date(utc)"), time.UTC, "2006-01-02 15:04:05")
+	if err != nil {
+		return invalidTrade(trade, "%v", err)
+	}
+	amount, _, err := binanceAmount(row.get("executed"))
+	var price, fee float64
+	var feeAsset string
+	if err == nil {
+		price, err = row.number("price")
+	}
+	if err == nil {
+		fee, feeAsset, err = binanceAmount(row.get("fee"))
+	}
+	switch feeAsset {
+	case "AUD":
+	case trade.Name:
+		fee = fee * price
+	default:
+		fee = 0
+		trade.Message = fmt.Sprintf("fee paid in %s is not counted", feeAsset)
+	}
+	return pricedTrade(trade, quote, amount, price, fee, err)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"crypto-price-api/metrics"
+	"crypto-price-api/storage"
+)
+
+// Largest export accepted by /imports
+const maxImportSize = 10 << 20
+
+// VM for the preview or result of importing an exchange export
+type ImportVM struct {
+	// "coinbase", "kraken", "coinspot" or "binance"
+	Exchange string `json:"exchange"`
+	// Whether the new trades were written. False for a preview
+	Committed bool `json:"committed"`
+	// Number of trades of each status
+	New        int             `json:"new"`
+	Duplicates int             `json:"duplicates"`
+	Skipped    int             `json:"skipped"`
+	Invalid    int             `json:"invalid"`
+	Trades     []ImportTradeVM `json:"trades"`
+}
+
+// Parse an export and mark the trades the user imported before, or repeated in the file, as duplicates
+func previewImport(ctx context.Context, store storage.Store, ownerID string, input io.Reader, exchange string) (ImportVM, error) {
+	exchange, trades, err := parseExchangeCSV(input, exchange)
+	if err != nil {
+		return ImportVM{}, err
+	}
+	importIDs, err := store.ListImportIDs(ctx, ownerID)
+	if err != nil {
+		return ImportVM{}, err
+	}
+	preview := ImportVM{Exchange: exchange, Trades: trades}
+	for i := range preview.Trades {
+		trade := &preview.Trades[i]
+		if trade.Status == ImportStatusNew && importIDs[trade.ImportId] {
+			trade.Status = ImportStatusDuplicate
+		}
+		switch trade.Status {
+		case ImportStatusNew:
+			preview.New++
+		case ImportStatusDuplicate:
+			preview.Duplicates++
+		case ImportStatusSkipped:
+			preview.Skipped++
+		default:
+			preview.Invalid++
+		}
+	}
+	return preview, nil
+}
+
+// Write the new trades of a preview for a user oldest first, all or nothing.
+// Sales are matched to held lots by method. Refused when any row is invalid
+func commitImport(ctx context.Context, store storage.Store, ownerID string, preview *ImportVM, method string) error {
+	if preview.Invalid > 0 {
+		return fieldError("file", "%d rows are invalid, fix or remove them before importing", preview.Invalid)
+	}
+	newTrades := []ImportTradeVM{}
+	for _, trade := range preview.Trades {
+		if trade.Status == ImportStatusNew {
+			newTrades = append(newTrades, trade)
+		}
+	}
+	// Buys before sells at the same time, so they can be sold
+	sort.SliceStable(newTrades, func(i, j int) bool {
+		if newTrades[i].Time != newTrades[j].Time {
+			return newTrades[i].Time < newTrades[j].Time
+		}
+		return newTrades[i].Side == "buy" && newTrades[j].Side == "sell"
+	})
+	trades := []storage.Trade{}
+	for _, trade := range newTrades {
+		if trade.Side == "buy" {
+			trades = append(trades, storage.Trade{Buy: &storage.Asset{
+				OwnerID:       ownerID,
+				Name:          trade.Name,
+				Amount:        trade.Amount,
+				PurchasePrice: trade.Price,
+				PurchaseTime:  trade.Time,
+				PurchaseFee:   trade.Fee,
+				Status:        "held",
+				SalePrice:     -1,
+				SaleTime:      -1,
+				ImportID:      trade.ImportId,
+			}})
+			continue
+		}
+		trades = append(trades, storage.Trade{Sell: &storage.Disposal{
+			OwnerID:  ownerID,
+			Name:     trade.Name,
+			Amount:   trade.Amount,
+			Price:    trade.Price,
+			Time:     trade.Time,
+			Fee:      trade.Fee,
+			Method:   method,
+			ImportID: trade.ImportId,
+		}})
+	}
+	if len(trades) > 0 {
+		err := store.ImportTrades(ctx, trades)
+		if errors.Is(err, storage.ErrInsufficientAmount) {
+			return fieldError("file", "%v. Import the purchases first", err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	preview.Committed = true
+	return nil
+}
+
+// Import trades from an exchange trade history export. The file is sent as the
+// "file" field of a multipart form, or as the request body
+// POST /imports?exchange=kraken&commit=true&method=fifo
+// exchange is one of "coinbase", "kraken", "coinspot" or "binance". Default detected from the header.
+// commit writes the new trades, otherwise they are only previewed. Default false.
+// method matches sales to held lots as for /sales. Default COST_BASIS_METHOD
+// Returns: ImportVM
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/imports").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	exchange := strings.ToLower(r.URL.Query().Get("exchange"))
+	if _, didFind := exchangeParsers[exchange]; exchange != "" && !didFind {
+		writeFieldError(w, fieldError("exchange", "exchange must be coinbase, kraken, coinspot or binance"))
+		return
+	}
+	commit := r.URL.Query().Get("commit") == "true"
+	method := CostBasisMethod
+	if value := r.URL.Query().Get("method"); value != "" {
+		method = value
+	}
+	if !storage.ValidCostBasisMethod(method) {
+		writeFieldError(w, fieldError("method", "method must be fifo, lifo, hifo or average"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	var input io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeFieldError(w, fieldError("file", "file is required"))
+			return
+		}
+		defer file.Close()
+		input = file
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	ownerID := requestUser(r).ID
+	result, err := previewImport(ctx, Store, ownerID, input, exchange)
+	if err == nil && commit {
+		err = commitImport(ctx, Store, ownerID, &result, method)
+	}
+	if err != nil {
+		writeServerError(w, "Importing trades", err)
+		return
+	}
+	if result.Committed {
+		fmt.Printf("Imported %d %s trades, %d duplicates\n", result.New, result.Exchange, result.Duplicates)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
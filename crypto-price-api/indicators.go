@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"crypto-price-api/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// `indicators` collection document structure. Maintained by the change tracker
+type IndicatorsDB struct {
+	ID              string   `bson:"_id,omitempty"`
+	Name            string   `bson:"name"`
+	Time            int64    `bson:"time"`
+	Price           float32  `bson:"price"`
+	SMA20           *float64 `bson:"sma20,omitempty"`
+	SMA50           *float64 `bson:"sma50,omitempty"`
+	EMA12           *float64 `bson:"ema12,omitempty"`
+	EMA26           *float64 `bson:"ema26,omitempty"`
+	Volatility20    *float64 `bson:"volatility20,omitempty"`
+	RSI14           *float64 `bson:"rsi14,omitempty"`
+	BollingerLower  *float64 `bson:"bollingerLower,omitempty"`
+	BollingerMiddle *float64 `bson:"bollingerMiddle,omitempty"`
+	BollingerUpper  *float64 `bson:"bollingerUpper,omitempty"`
+	Count           int64    `bson:"count"`
+}
+
+// VM for technical indicators. Indicators are null until enough ticks have been seen
+type IndicatorsVM struct {
+	Name            string   `json:"name"`
+	Time            int64    `json:"time"`
+	Price           float32  `json:"price"`
+	SMA20           *float64 `json:"sma20"`
+	SMA50           *float64 `json:"sma50"`
+	EMA12           *float64 `json:"ema12"`
+	EMA26           *float64 `json:"ema26"`
+	Volatility20    *float64 `json:"volatility20"`
+	RSI14           *float64 `json:"rsi14"`
+	BollingerLower  *float64 `json:"bollingerLower"`
+	BollingerMiddle *float64 `json:"bollingerMiddle"`
+	BollingerUpper  *float64 `json:"bollingerUpper"`
+	Count           int64    `json:"count"`
+}
+
+// Handle to look up the latest technical indicators of every crypto, or a single crypto
+// GET /indicators?cryptoId=BTC
+// Returns: []IndicatorsVM
+func indicatorsHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/indicators").Inc()
+	// Optional coin from query params
+	filter := bson.M{}
+	if cryptoId := r.URL.Query().Get("cryptoId"); cryptoId != "" {
+		filter["name"] = cryptoId
+	}
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	collection := MongoClient.Database("crypto").Collection("indicators")
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	results := []IndicatorsVM{}
+	cursor, err := collection.Find(findCtx, filter, opts)
+	if err != nil {
+		writeServerError(w, "Looking up indicators", err)
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+		return
+	}
+	for cursor.Next(findCtx) {
+		var indicators IndicatorsDB
+		if err := cursor.Decode(&indicators); err != nil {
+			fmt.Printf("Could not decode IndicatorsDB %v", err)
+		} else {
+			results = append(results, IndicatorsVM{
+				Name:            indicators.Name,
+				Time:            indicators.Time,
+				Price:           indicators.Price,
+				SMA20:           indicators.SMA20,
+				SMA50:           indicators.SMA50,
+				EMA12:           indicators.EMA12,
+				EMA26:           indicators.EMA26,
+				Volatility20:    indicators.Volatility20,
+				RSI14:           indicators.RSI14,
+				BollingerLower:  indicators.BollingerLower,
+				BollingerMiddle: indicators.BollingerMiddle,
+				BollingerUpper:  indicators.BollingerUpper,
+				Count:           indicators.Count,
+			})
+		}
+	}
+	json.NewEncoder(w).Encode(results)
+	metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+}
@@ -4,52 +4,20 @@ import (
 	"context"
 	"os"
 	"fmt"
-	"strconv"
 	"net/http"
 	"time"
 	"encoding/json"
 	"log"
+	"errors"
+	"strings"
 
 	"crypto-price-api/metrics"
-
-    "go.mongodb.org/mongo-driver/bson"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/mongo/options"
-    "go.mongodb.org/mongo-driver/bson/primitive"
+	"crypto-price-api/storage"
 )
 
-var MongoUrl string
+// Storage for prices, price changes and assets. Selected by STORAGE_BACKEND
+var Store storage.Store
 
-// `prices` collection document structure
-type CryptoPriceDB struct {
-    ID    string `bson:"_id,omitempty"`
-    Name  string `bson:"name"`
-    Price float32	 `bson:"price"`
-}
-// `prices_change_over_time`
-type CryptoPriceChangeDB struct {
-    ID    		string `bson:"_id,omitempty"`
-    Name  		string `bson:"name"`
-    Price  	float32	    `bson:"lastPrice"`
-    PriceChange  	float32	    `bson:"priceChange"`
-    Time int64     `bson:"time"`
-}
-// `assets`
-type AssetDB struct {
-    ID    string        `bson:"_id,omitempty"`
-    // Crypto Name
-    Name  string        `bson:"name"`
-    // Crypto Amount
-    Amount  float32        `bson:"amount"`
-    // Price at time crypto was checked
-    PurchasePrice float32	    `bson:"purchasePrice"`
-    // Time that the crypto was purchased
-    PurchaseTime float32     `bson:"purchaseTime"`
-    // Whether the crypto is active. Valid values are "held" or "sold"
-    Status      string `bson:"status"`
-    SalePrice float32 `bson:"salePrice"`
-    SaleTime float32 `bson:"saleTime"`
-}
 // VM for current price response
 type CurrentPriceResponseVM struct {
     Name    string 	`json:"name"`
@@ -72,231 +40,187 @@ type AssetVM struct {
     Status      string `json:"status"`
     SalePrice float32 `json:"salePrice"`
     SaleTime float32 `json:"saleTime"`
+    PurchaseFee float32 `json:"purchaseFee"`
+    SaleFee float32 `json:"saleFee"`
+    // Asset this asset was split from by a partial sale
+    ParentId string `json:"parentId,omitempty"`
+    // Incremented on every change. Also returned as the ETag of /assets/{id}
+    Version int64 `json:"version"`
+}
+// VM for the result of a sale
+type SaleVM struct {
+    Sold AssetVM `json:"sold"`
+    // Rest of a partially sold asset, null when the whole asset was sold
+    Held *AssetVM `json:"held"`
 }
 // Return the current price of a crypto. 
 // Returns CurrentPriceResponseVM
 func currentPriceHandler(w http.ResponseWriter, r *http.Request) {
 	requestStartTime := time.Now()
 	metrics.HTTPRequestCounter.WithLabelValues("/assets").Inc()
-	// Connect to MongoDB 
-	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(MongoUrl))
-    if err != nil {
+	defer func() {
 		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
-        panic(err)
-    }
-    defer client.Disconnect(connectCtx)
-
+	}()
 	// Timeout for lookup
-	findCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
     defer cancel()
-	// Set content type to application/json
-    w.Header().Set("Content-Type", "application/json")
-	// Lookup all prices from `prices` MongoDB
-    collection := client.Database("crypto").Collection("prices")
-	var results []CurrentPriceResponseVM
-    cursor, err := collection.Find(findCtx, bson.M{})
+	// Lookup all prices
+	prices, err := Store.ListPrices(findCtx)
     if err != nil {
-        log.Println("No crypto prices found:", err)
-		fmt.Fprintf(w, "[]")
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+		writeServerError(w, "Looking up crypto prices", err)
 		return
     }
 	// Convert DB response to json view model
-    for cursor.Next(findCtx) {
-        var cryptoPrice CryptoPriceDB
-        if err := cursor.Decode(&cryptoPrice); err != nil {
-            fmt.Printf("%v", err)
-        }else { 
-			// fmt.Printf("Found crypto document in `prices`: %s\n", cryptoPrice.Name)
-			results = append(results, CurrentPriceResponseVM{ 
-				Name: cryptoPrice.Name,
-				Price: cryptoPrice.Price,
-			})
-		}
-	}
-    if err := cursor.Err(); err != nil {
-        fmt.Printf("%v\n", err)
-    } else { 
-		// Encode the struct to JSON and write to response
-		json.NewEncoder(w).Encode(results)	
+	results := []CurrentPriceResponseVM{}
+    for _, cryptoPrice := range prices {
+		results = append(results, CurrentPriceResponseVM{ 
+			Name: cryptoPrice.Name,
+			Price: cryptoPrice.Price,
+		})
 	}
-	metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	// Encode the struct to JSON and write to response
+    w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)	
 }
 // Handle to look up price changes within a time period and return a list of all prices or the earliest price
+// GET /changes?cryptoId=BTC&duration=168h&all=true&from=&to=&order=asc&limit=1000&cursor=
+// from and to are optional Unix epochs or RFC3339 times, from defaults to duration ago.
+// With all=true, ticks are paged oldest first (order=desc for newest first), limit
+// per page (default 1000, at most 10000). X-Total-Count is the number of ticks in the
+// window, and X-Next-Cursor the cursor of the next page, omitted on the last page
 // Returns: []CryptoPriceChangeVM
 func priceChangeHandler(w http.ResponseWriter, r *http.Request) {
 	requestStartTime := time.Now()
 	metrics.HTTPRequestCounter.WithLabelValues("/assets").Inc()
-	// Get coin from query params
-	cryptoId := r.URL.Query().Get("cryptoId")
-	if cryptoId == "" {
+	defer func() {
 		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
-		panic("No crypto ID provided")
-	}
-	// Get duration from query params
-	durationStr := r.URL.Query().Get("duration")
-	if durationStr == "" {
-		durationStr = "1w"
+	}()
+	// Get coin from query params
+	cryptoId, err := requiredParam(r, "cryptoId")
+	if err != nil {
+		writeServerError(w, "Looking up price changes", err)
+		return
 	}
+	// Get duration from query params. Default 1 week
+	duration, err := parseDurationParam(r, "duration", 7*24*time.Hour)
+    if err != nil {
+		writeServerError(w, "Looking up price changes", err)
+		return
+    }
 	// Get if all should be returned from all price, or only the earliest record
 	returnAllPrices := false
 	allStr := r.URL.Query().Get("all")
 	if allStr == "true" {
 		returnAllPrices = true
 	}
-
-	// Connect to MongoDB 
-	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(MongoUrl))
-    if err != nil {
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
-        panic(err)
-    }
-    defer client.Disconnect(connectCtx)
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		writeServerError(w, "Looking up price changes", err)
+		return
+	}
+	// Calculate change in price from queried period
+	if from == 0 {
+		from = time.Now().Add(-duration).Unix()
+	}
+	query := storage.PriceChangeQuery{Name: cryptoId, From: from, To: to, Limit: 1}
+	// Either return array with single earliest element, or a page of all elements
+	if returnAllPrices {
+		if query.Limit, err = parseLimitParam(r, 1000, 10000); err == nil {
+			query.Descending, err = parseOrderParam(r, false)
+		}
+		if err == nil {
+			query.After, err = parseCursorParam(r)
+		}
+		if err != nil {
+			writeServerError(w, "Looking up price changes", err)
+			return
+		}
+	}
 
 	// Timeout for lookup
-	findCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
     defer cancel()
-	// Set content type to application/json
-    w.Header().Set("Content-Type", "application/json")
-	// Lookup all prices from `prices` MongoDB
-    collection := client.Database("crypto").Collection("price_changes_over_time")
 
-	// Calculate change in price from queried period
-	duration, err := time.ParseDuration(durationStr)
-    if err != nil {
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
-		panic(err)
-    }
-	sevenDaysAgo := time.Now().Add(-duration)
-	// Filter to load times greater than the duration
-    filter := bson.M{
-		"name": cryptoId,
-		"time": bson.M{
-			"$gt": sevenDaysAgo.Unix(),
-		},
-	}
-	// Sort in ascending order to find earliest within provided time period
-	opts := options.Find().SetSort(bson.D{{"time", 1}})
-	var results []CryptoPriceChangeVM
-	// Find all results
-    cursor, err := collection.Find(findCtx, filter, opts)
-	// Return [] on error
+	page, err := Store.ListPriceChanges(findCtx, query)
+	if errors.Is(err, storage.ErrInvalidID) {
+		err = fieldError("cursor", "cursor must be the X-Next-Cursor of the previous page")
+	}
     if err != nil {
-        log.Println("No crypto prices found:", err)
-		json.NewEncoder(w).Encode(results)	
+		writeServerError(w, "Looking up price changes", err)
 		return
 	}
-	// Convert DB response to json view model. Either return array with single earliest element, or all array of all elements
-	if returnAllPrices { 
-		// Return many elements.
-		for cursor.Next(findCtx) {
-			var cryptoPrice CryptoPriceChangeDB
-			if err := cursor.Decode(&cryptoPrice); err != nil {
-				fmt.Printf("Could not decode CryptoPriceChangeDB %v", err)
-			}else { 
-				// fmt.Printf("Found crypto document in `price_changes_over_time`: %s\n", cryptoPrice.Name)
-				results = append(results, CryptoPriceChangeVM{ 
-					Name: cryptoPrice.Name,
-					Price: cryptoPrice.Price,
-					Time: cryptoPrice.Time,
-				})
-			}
-		}
-	} else { 
-		// Return single element
-		cursor.Next(findCtx)
-		var cryptoPrice CryptoPriceChangeDB
-		if err := cursor.Decode(&cryptoPrice); err != nil {
-			fmt.Printf("Could not decode CryptoPriceChangeDB %v", err)
-		}else { 
-			// fmt.Printf("Found crypto document in `price_changes_over_time`: %s\n", cryptoPrice.Name)
-			results = append(results, CryptoPriceChangeVM{ 
-				Name: cryptoPrice.Name,
-				Price: cryptoPrice.Price,
-				Time: cryptoPrice.Time,
-			})
-		}
-	}
-	// Handle cursor errors
-    if err := cursor.Err(); err != nil {
-        fmt.Printf("%v\n", err)
+	// Convert DB response to json view model
+	results := []CryptoPriceChangeVM{}
+	for _, cryptoPrice := range page.Changes {
+		results = append(results, CryptoPriceChangeVM{ 
+			Name: cryptoPrice.Name,
+			Price: cryptoPrice.Price,
+			Time: cryptoPrice.Time,
+		})
 	}
 	// Return JSON array to user
+	writePageHeaders(w, r, page.Total, page.Next)
+    w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)	
-	metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
 }
-// Handle to look up assets sorted by purchase time
-// GET /assets
+// Convert a stored asset to its view model
+func assetToVM(cryptoAsset storage.Asset) AssetVM {
+	return AssetVM{ 
+		AssetId: cryptoAsset.ID,
+		Name: cryptoAsset.Name,
+		Amount: cryptoAsset.Amount,
+		PurchasePrice: cryptoAsset.PurchasePrice,
+		PurchaseTime: cryptoAsset.PurchaseTime,
+		Status: cryptoAsset.Status,
+		SalePrice: cryptoAsset.SalePrice,
+		SaleTime: cryptoAsset.SaleTime,
+		PurchaseFee: cryptoAsset.PurchaseFee,
+		SaleFee: cryptoAsset.SaleFee,
+		ParentId: cryptoAsset.ParentID,
+		Version: cryptoAsset.Version,
+	}
+}
+// Handle to look up a page of the user's assets, most recently purchased first
+// GET /assets?cryptoId=BTC&status=held&from=&to=&sort=purchaseTime&order=desc&limit=100&cursor=
+// cryptoId and status ("held" or "sold") are optional filters, and from and to
+// optional Unix epochs or RFC3339 times bounding the purchase time.
+// sort is purchaseTime (default), saleTime, amount or purchasePrice, and order
+// desc (default) or asc. limit is the page size, default 100 and at most 1000.
+// X-Total-Count is the number of matching assets, and X-Next-Cursor the cursor of
+// the next page, omitted on the last page
 // Returns: []AssetVM
 func findAssetsHandler(w http.ResponseWriter, r *http.Request) { 
 	requestStartTime := time.Now()
 	metrics.HTTPRequestCounter.WithLabelValues("/assets").Inc()
-	// Get coin from query params
-	// cryptoId := r.URL.Query().Get("cryptoId")
-	// if cryptoId == "" {
-	// 	panic("No crypto ID provided")
-	// }
-
-	// Connect to MongoDB 
-	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(MongoUrl))
-    if err != nil {
+	defer func() {
 		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
-        panic(err)
-    }
-    defer client.Disconnect(connectCtx)
-
+	}()
+	query, err := parseAssetQuery(r)
+	if err != nil {
+		writeServerError(w, "Looking up assets", err)
+		return
+	}
+	query.OwnerID = requestUser(r).ID
 	// Timeout for lookup
-	findCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
     defer cancel()
-	// Set content type to application/json
-    w.Header().Set("Content-Type", "application/json")
-	// Lookup all prices from `prices` MongoDB
-    collection := client.Database("crypto").Collection("assets")
-
-	// Filter to load times greater than the duration
-    filter := bson.M{
-		// "name": cryptoId,
-	}
-	// Sort in ascending order of purchase time
-	opts := options.Find().SetSort(bson.D{{"purchaseTime", -1}})
-	var results []AssetVM
-	// Find all results
-    cursor, err := collection.Find(findCtx, filter, opts)
-	// Return [] on error
+	// Find a page of the user's assets
+	page, err := Store.FindAssets(findCtx, query)
+	if errors.Is(err, storage.ErrInvalidID) {
+		err = fieldError("cursor", "cursor must be the X-Next-Cursor of the previous page")
+	}
     if err != nil {
-        log.Println("Error searching for assets:", err)
-		json.NewEncoder(w).Encode(results)	
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+		writeServerError(w, "Looking up assets", err)
 		return
 	}
-	// Return many elements.
-	for cursor.Next(findCtx) {
-		var cryptoAsset AssetDB
-		if err := cursor.Decode(&cryptoAsset); err != nil {
-			fmt.Printf("Could not decode AssetDB %v", err)
-		}else { 
-			// fmt.Printf("Found asset document in `assets`: %s\n", cryptoAsset.Name)
-			results = append(results, AssetVM{ 
-				AssetId: cryptoAsset.ID,
-				Name: cryptoAsset.Name,
-				Amount: cryptoAsset.Amount,
-				PurchasePrice: cryptoAsset.PurchasePrice,
-				PurchaseTime: cryptoAsset.PurchaseTime,
-				Status: cryptoAsset.Status,
-				SalePrice: cryptoAsset.SalePrice,
-				SaleTime: cryptoAsset.SaleTime,
-			})
-		}
+	results := []AssetVM{}
+	for _, cryptoAsset := range page.Assets {
+		results = append(results, assetToVM(cryptoAsset))
 	}
 	// Return asssets
+	writePageHeaders(w, r, page.Total, page.Next)
+    w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)	
-	metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
 }
 // Create a new asset based on provided form data. 
 // Required fields are:
@@ -304,132 +228,150 @@ func findAssetsHandler(w http.ResponseWriter, r *http.Request) {
 //		amount float32
 //		purchaseTime float32
 //		purchasePrice float32
+// Optional fields are:
+//		purchaseFee float32
 // 		
 // POST /assets
+// Returns: AssetVM
 func createAssetHandler(w http.ResponseWriter, r *http.Request) { 
 	requestStartTime := time.Now()
 	metrics.HTTPRequestCounter.WithLabelValues("/assets").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
 
 	// Limit request size to 10MB (more than enough!)
 	r.ParseMultipartForm(10 << 20) // 10MB
 	
-	// Access regular form fields
-	cryptoId := r.FormValue("cryptoId")
-	amount := r.FormValue("amount")
-	purchaseTime := r.FormValue("purchaseTime")
-	purchasePrice := r.FormValue("purchasePrice")
-	// Convert strings to float32s or ints
-	amountF32, err := strconv.ParseFloat(amount, 32)
+	// Access and convert regular form fields
+	cryptoId, err := requiredParam(r, "cryptoId")
 	if err != nil {
-        fmt.Printf("Error converting string to int:", err)
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+		writeServerError(w, "Creating asset", err)
 		return
 	}
-	purchaseTimeF32, err := strconv.ParseFloat(purchaseTime, 32)
+	amountF32, err := parseFormFloat32(r, "amount")
 	if err != nil {
-        fmt.Printf("Error converting string to int:", err)
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+		writeServerError(w, "Creating asset", err)
+		return
+	}
+	purchaseTimeF32, err := parseFormFloat32(r, "purchaseTime")
+	if err != nil {
+		writeServerError(w, "Creating asset", err)
 		return
 	}
 	// Specially handle purchaseTimeF32, incase its been incorrectly sent by the FE JS 
 	if purchaseTimeF32 >= 1712893600000 {
 		purchaseTimeF32 = purchaseTimeF32 / 1000
 	}
-	purchasePriceF32, err := strconv.ParseFloat(purchasePrice, 32)
+	purchasePriceF32, err := parseFormFloat32(r, "purchasePrice")
 	if err != nil {
-        fmt.Printf("Error converting string to int:", err)
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+		writeServerError(w, "Creating asset", err)
 		return
 	}
-	// Connect to MongoDB 
-	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(MongoUrl))
-    if err != nil {
-		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
-		panic(err)
-    }
-    defer client.Disconnect(connectCtx)
 	// Create new asset
-	// log.Println("Creating new `assets` document for " + cryptoId)
-	newAsset := AssetDB{
+	newAsset := storage.Asset{
+		OwnerID: requestUser(r).ID,
 		Name: cryptoId,
-		Amount: float32(amountF32),
-		PurchasePrice: float32(purchasePriceF32),
-		PurchaseTime: float32(purchaseTimeF32),
+		Amount: amountF32,
+		PurchasePrice: purchasePriceF32,
+		PurchaseTime: purchaseTimeF32,
 		Status: 	"held",
 		SalePrice: -1,
 		SaleTime: -1,
 	}
+	if err = formFloat32(r, "purchaseFee", false, &newAsset.PurchaseFee); err != nil {
+		writeServerError(w, "Creating asset", err)
+		return
+	}
+	if err = validateAsset(&newAsset); err != nil {
+		writeServerError(w, "Creating asset", err)
+		return
+	}
 	// Insert asset
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
-	collection := client.Database("crypto").Collection("assets")
-	_, err = collection.InsertOne(ctx, &newAsset)
+	newAsset, err = Store.CreateAsset(ctx, newAsset)
 	if err != nil {
-		fmt.Printf("Insert new `assets` document failed: %v\n", err)
-	}else { 
-		fmt.Printf("Created new asset [%s] at $%f AUD\n", newAsset.Name, newAsset.PurchasePrice)
+		writeServerError(w, "Creating asset", err)
+		return
 	}
-	metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	fmt.Printf("Created new asset [%s] at $%f AUD\n", newAsset.Name, newAsset.PurchasePrice)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(assetToVM(newAsset))
 }
-// Handler to mark asset as sold
+// Sell some or all of an asset. Optional fields are:
+//		amount float32, the amount to sell. Default the whole asset
+//		salePrice float32, the price per coin. Default the current price
+//		saleTime float32, Unix epoch. Default now
+//		fee float32, exchange fee in AUD. Default 0
+//		version int64, or an If-Match header, to only sell an unchanged asset
+// Selling part of an asset keeps the rest held under the same ID and creates a sold asset
+// POST /assets/sell?assetId=
+// Returns: SaleVM
 func sellAssetHandler(w http.ResponseWriter, r *http.Request) {
-	// Mark existing asset as sold
-	assetIdStr := r.URL.Query().Get("assetId")
-	if assetIdStr == "" {
-		panic("No asset ID provided")
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/assets/sell").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
 	}
-	// Connect to MongoDB 
-	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(MongoUrl))
-    if err != nil {
-        panic(err)
-    }
-    defer client.Disconnect(connectCtx)
-	// Lookup Asset
-	assetCollection := client.Database("crypto").Collection("assets")
-	// Define a filter to look up a specific crypto
-	assetId, err := primitive.ObjectIDFromHex(assetIdStr) 
+	// Limit request size to 10MB (more than enough!)
+	r.ParseMultipartForm(10 << 20)
+	assetIdStr, err := requiredParam(r, "assetId")
 	if err != nil {
-		panic(err)
+		writeServerError(w, "Selling asset", err)
+		return
 	}
-	assetFilter := bson.M{"_id": assetId}
-	// Find the asset to sell
-	findAssetCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	var assetResult AssetDB 
-	err = assetCollection.FindOne(findAssetCtx, assetFilter).Decode(&assetResult)
-	// Look up current prices of crypto from database
-	priceCollection := client.Database("crypto").Collection("prices")
-	priceFilter := bson.M{"name": assetResult.Name}
-	findPriceCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	sale, err := parseSaleForm(r)
+	if err != nil {
+		writeServerError(w, "Selling asset", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
-	var currentPrice CryptoPriceDB
-	err = priceCollection.FindOne(findPriceCtx, priceFilter).Decode(&currentPrice)
+	// Only the owner can sell an asset
+	assetResult, err := findAsset(ctx, requestUser(r).ID, assetIdStr)
 	if err != nil {
-		panic(err)
+		writeServerError(w, "Selling asset", err)
+		return
+	}
+	// Sell at the current price unless the execution price was provided
+	if _, didFind := r.Form["salePrice"]; !didFind {
+		currentPrice, err := Store.FindPrice(ctx, assetResult.Name)
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, fmt.Sprintf("No current price for %s, provide salePrice", assetResult.Name))
+			return
+		} else if err != nil {
+			writeServerError(w, "Selling asset", err)
+			return
+		}
+		sale.Price = currentPrice.Price
 	}
-	// Define the update query to mark the asset as sold
-	saleTime := time.Now().Unix()
-	updateAssetFilter := bson.M{
-		"$set": bson.M{
-			"status": "sold",
-			"salePrice": currentPrice.Price,
-			"saleTime": float32(saleTime),
-		}, 
+	sold, held, err := Store.SellAsset(ctx, assetIdStr, sale)
+	switch {
+	case errors.Is(err, storage.ErrInvalidID):
+		err = fieldError("assetId", "assetId is not a valid asset ID")
+	case errors.Is(err, storage.ErrInsufficientAmount):
+		err = fieldError("amount", "amount is more than the asset holds")
+	case errors.Is(err, storage.ErrSaleBeforePurchase):
+		err = fieldError("saleTime", "saleTime must not be before purchaseTime")
 	}
-	findAndUpdateCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	// Update main `assets` collection 
-	_, err = assetCollection.UpdateOne(findAndUpdateCtx, assetFilter, updateAssetFilter)
 	if err != nil {
-		fmt.Printf("Could not find and update: %v\n", err)
-		panic(err)
+		writeServerError(w, "Selling asset", err)
+		return
 	}
-	fmt.Printf("Sold [%f] of [%s] at %f\n", assetResult.Amount, assetResult.Name, saleTime)
-	return
+	fmt.Printf("Sold [%f] of [%s] at %f\n", sold.Amount, sold.Name, sold.SalePrice)
+	result := SaleVM{Sold: assetToVM(sold)}
+	if held != nil {
+		heldVM := assetToVM(*held)
+		result.Held = &heldVM
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 // Handler for /assets route
 func assetHandler(w http.ResponseWriter, r *http.Request) { 
@@ -441,18 +383,24 @@ func assetHandler(w http.ResponseWriter, r *http.Request) {
 		// fmt.Fprintln(w, "This is a POST request")
 		createAssetHandler(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r)
 	}
 }
 
-// Create a http HandlerFunc to add permissive CORS headers 
+// Origins of the web UI allowed to call the API from a browser. Set by CORS_ORIGINS
+var CORSOrigins = []string{"http://localhost:8083"}
+
+// Create a http HandlerFunc to add CORS headers for requests from CORSOrigins
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Allow all origins for simplicity. 
-		// FIXME: Customize in production, 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		// Other origins get no CORS headers, so browsers block their requests
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && isCORSOrigin(origin) { 
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Link, X-Total-Count, X-Next-Cursor")
+		}
 		// Handle preflight request
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -462,28 +410,130 @@ func withCORS(next http.Handler) http.Handler {
 	})
 }
 
+// Whether browsers may call the API from origin
+func isCORSOrigin(origin string) bool { 
+	for _, allowed := range CORSOrigins { 
+		if allowed == origin { 
+			return true
+		}
+	}
+	return false
+}
+
+// Serve the API. Passing a command as the first argument runs a command instead, see runCommand.
 func main() {
+	// Commands match sales to lots with the same method as the API
+	if err := loadCostBasisMethod(); err != nil {
+		panic(err)
+	}
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
 	// Initialize context for killing application
 	_, cancel := context.WithCancel(context.Background())
 	// Initialize prometheus metrics and expose on separate port
 	metrics.Init(cancel)
 	// Lookup necessary environment variables
+	// "mongo" (default), "sqlite" or "memory"
+	backend, didFind := os.LookupEnv("STORAGE_BACKEND")
+	if !didFind {
+		backend = storage.BackendMongo
+	}
 	// Example: "mongodb://localhost:27017"
-	didFind := false
-	MongoUrl, didFind = os.LookupEnv("MONGO_URL")
-	if !didFind { 
+	mongoUrl, didFind := os.LookupEnv("MONGO_URL")
+	if !didFind && backend == storage.BackendMongo { 
 		panic("No MongoDB URL provided")
 	}
+	// Example: "/data/crypto.db"
+	sqlitePath, didFind := os.LookupEnv("SQLITE_PATH")
+	if !didFind && backend == storage.BackendSQLite {
+		panic("No SQLite path provided")
+	}
+	// Comma separated origins of the web UI. Default "http://localhost:8083"
+	if origins, didFind := os.LookupEnv("CORS_ORIGINS"); didFind { 
+		CORSOrigins = []string{}
+		for _, origin := range strings.Split(origins, ",") { 
+			if origin = strings.TrimSpace(origin); origin != "" { 
+				CORSOrigins = append(CORSOrigins, origin)
+			}
+		}
+	}
+	// Password of the default admin user, set when it has none
+	adminPassword := os.Getenv("ADMIN_PASSWORD")
+	// Connect the shared Mongo client
+	if mongoUrl != "" {
+		poolConfig, err := loadMongoPoolConfig()
+		if err != nil {
+			panic(err)
+		}
+		connectCtx, connectCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		MongoClient, err = connectMongo(connectCtx, mongoUrl, poolConfig)
+		connectCancel()
+		if err != nil {
+			panic(err)
+		}
+		defer MongoClient.Disconnect(context.Background())
+		log.Printf("Connected to MongoDB with a pool of %d to %d connections\n", poolConfig.MinPoolSize, poolConfig.MaxPoolSize)
+	}
+	var err error
+	if backend == storage.BackendMongo {
+		Store = storage.NewMongoStore(MongoClient)
+	} else {
+		openCtx, openCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		Store, err = storage.Open(openCtx, storage.Config{
+			Backend: backend,
+			SQLitePath: sqlitePath,
+		})
+		openCancel()
+		if err != nil {
+			panic(err)
+		}
+		defer Store.Close(context.Background())
+	}
+	log.Printf("Using %s storage\n", backend)
+	if adminPassword != "" {
+		initCtx, initCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = initAdminPassword(initCtx, adminPassword)
+		initCancel()
+		if err != nil {
+			panic(err)
+		}
+	}
 	// Create HTTP Server Mux to support CORS middleware
 	mux := http.NewServeMux()
 	// Assign HTTP routes
+	// Market data is public, so the web UI can show prices before logging in
 	mux.Handle("/prices", withCORS(http.HandlerFunc(currentPriceHandler)))
 	mux.Handle("/changes", withCORS(http.HandlerFunc(priceChangeHandler)))
-	mux.Handle("/assets", withCORS(http.HandlerFunc(assetHandler)))
-	mux.Handle("/assets/sell", withCORS(http.HandlerFunc(sellAssetHandler)))
+	mux.Handle("/login", withCORS(http.HandlerFunc(loginHandler)))
+	// Routes below need an API token, see withAuth
+	mux.Handle("/me", withCORS(withAuth(http.HandlerFunc(meHandler))))
+	mux.Handle("/users", withCORS(withAuth(withAdmin(http.HandlerFunc(usersHandler)))))
+	mux.Handle("/tokens", withCORS(withAuth(http.HandlerFunc(tokensHandler))))
+	mux.Handle("/tokens/", withCORS(withAuth(http.HandlerFunc(tokensHandler))))
+	mux.Handle("/assets", withCORS(withAuth(http.HandlerFunc(assetHandler))))
+	mux.Handle("/assets/sell", withCORS(withAuth(http.HandlerFunc(sellAssetHandler))))
+	mux.Handle("/assets/", withCORS(withAuth(http.HandlerFunc(assetByIdHandler))))
+	mux.Handle("/pnl", withCORS(withAuth(http.HandlerFunc(pnlHandler))))
+	mux.Handle("/sales", withCORS(withAuth(http.HandlerFunc(salesHandler))))
+	mux.Handle("/reports/cgt", withCORS(withAuth(http.HandlerFunc(cgtReportHandler))))
+	mux.Handle("/imports", withCORS(withAuth(http.HandlerFunc(importHandler))))
+	// Alerts, indicators, portfolio snapshots, anomalies and candles are only stored in MongoDB
+	if MongoClient != nil {
+		mux.Handle("/alerts", withCORS(withAuth(http.HandlerFunc(alertHandler))))
+		// Snapshots are kept per user and only served to their owner
+		mux.Handle("/portfolio", withCORS(withAuth(http.HandlerFunc(portfolioHandler))))
+		// Public market data, as /prices
+		mux.Handle("/indicators", withCORS(http.HandlerFunc(indicatorsHandler)))
+		mux.Handle("/anomalies", withCORS(http.HandlerFunc(anomaliesHandler)))
+		mux.Handle("/candles", withCORS(http.HandlerFunc(candlesHandler)))
+	} else {
+		log.Println("No MongoDB URL provided, /alerts, /indicators, /portfolio, /anomalies and /candles are disabled")
+	}
 	// Start server 
 	log.Println("Starting server at :8082")
-	err := http.ListenAndServe(":8082", mux)
+	err = http.ListenAndServe(":8082", withRecover(mux))
 	if err != nil {
 		log.Println("Error starting server:", err)
 	}
@@ -30,6 +30,22 @@ var (
         },
     )
 
+	HTTPErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_errors_total",
+			Help: "Number of HTTP error responses",
+		},
+		[]string{"code"},
+	)
+
+	HTTPPanicsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_panics_total",
+			Help: "Number of HTTP handlers that panicked",
+		},
+		[]string{"path"},
+	)
+
 	FailedKafkaMessagesCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "failed_kafka_messages_total",
@@ -59,9 +75,12 @@ var (
 func Init(cancel context.CancelFunc) {
 	prometheus.MustRegister(HTTPRequestCounter)
 	prometheus.MustRegister(HTTPRequestDuration)
+	prometheus.MustRegister(HTTPErrorsCounter)
+	prometheus.MustRegister(HTTPPanicsCounter)
 	prometheus.MustRegister(FailedKafkaMessagesCounter)
 	prometheus.MustRegister(MessagesConsumedCounter)
 	prometheus.MustRegister(PriceChangeMessageDuration)
+	registerMongoPoolMetrics()
 
     // Handle graceful shutdown
     go handleSignals(cancel)
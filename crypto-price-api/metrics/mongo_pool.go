@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Mongo connection pool metrics, updated by the PoolMonitor of the shared client
+var (
+	MongoPoolConnectionsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mongo_pool_connections",
+			Help: "Number of open connections in the Mongo connection pool",
+		},
+	)
+
+	MongoPoolCheckedOutGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mongo_pool_checked_out_connections",
+			Help: "Number of Mongo connections in use by requests",
+		},
+	)
+
+	MongoPoolCheckoutFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mongo_pool_checkout_failures_total",
+			Help: "Number of times a Mongo connection could not be checked out of the pool",
+		},
+		[]string{"reason"},
+	)
+
+	MongoPoolCheckoutDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mongo_pool_checkout_duration_seconds",
+			Help:    "Time waited to check a connection out of the Mongo connection pool",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	MongoPoolClearedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mongo_pool_cleared_total",
+			Help: "Number of times the Mongo connection pool was cleared after a server error",
+		},
+	)
+)
+
+func registerMongoPoolMetrics() {
+	prometheus.MustRegister(MongoPoolConnectionsGauge)
+	prometheus.MustRegister(MongoPoolCheckedOutGauge)
+	prometheus.MustRegister(MongoPoolCheckoutFailuresCounter)
+	prometheus.MustRegister(MongoPoolCheckoutDuration)
+	prometheus.MustRegister(MongoPoolClearedCounter)
+}
+
+// Pool monitor exporting the Mongo connection pool metrics
+func MongoPoolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(evt *event.PoolEvent) {
+			switch evt.Type {
+			case event.ConnectionCreated:
+				MongoPoolConnectionsGauge.Inc()
+			case event.ConnectionClosed:
+				MongoPoolConnectionsGauge.Dec()
+			case event.GetSucceeded:
+				MongoPoolCheckedOutGauge.Inc()
+				MongoPoolCheckoutDuration.Observe(evt.Duration.Seconds())
+			case event.GetFailed:
+				MongoPoolCheckoutFailuresCounter.WithLabelValues(evt.Reason).Inc()
+				MongoPoolCheckoutDuration.Observe(evt.Duration.Seconds())
+			case event.ConnectionReturned:
+				MongoPoolCheckedOutGauge.Dec()
+			case event.PoolCleared:
+				MongoPoolClearedCounter.Inc()
+			}
+		},
+	}
+}
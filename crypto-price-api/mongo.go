@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"crypto-price-api/metrics"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mongo client shared by every request. nil when MONGO_URL is not set
+var MongoClient *mongo.Client
+
+// Connection pool sizes of the shared client
+type MongoPoolConfig struct {
+	MaxPoolSize     uint64
+	MinPoolSize     uint64
+	MaxConnIdleTime time.Duration
+}
+
+// Read the pool sizes from MONGO_MAX_POOL_SIZE, MONGO_MIN_POOL_SIZE and MONGO_MAX_CONN_IDLE_TIME
+func loadMongoPoolConfig() (MongoPoolConfig, error) {
+	config := MongoPoolConfig{
+		MaxPoolSize:     50,
+		MinPoolSize:     5,
+		MaxConnIdleTime: 5 * time.Minute,
+	}
+	var err error
+	if value, didFind := os.LookupEnv("MONGO_MAX_POOL_SIZE"); didFind {
+		config.MaxPoolSize, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid MONGO_MAX_POOL_SIZE %q: %v", value, err)
+		}
+	}
+	if value, didFind := os.LookupEnv("MONGO_MIN_POOL_SIZE"); didFind {
+		config.MinPoolSize, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid MONGO_MIN_POOL_SIZE %q: %v", value, err)
+		}
+	}
+	if value, didFind := os.LookupEnv("MONGO_MAX_CONN_IDLE_TIME"); didFind {
+		config.MaxConnIdleTime, err = time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid MONGO_MAX_CONN_IDLE_TIME %q: %v", value, err)
+		}
+	}
+	if config.MaxPoolSize > 0 && config.MinPoolSize > config.MaxPoolSize {
+		return config, fmt.Errorf("MONGO_MIN_POOL_SIZE %d is larger than MONGO_MAX_POOL_SIZE %d", config.MinPoolSize, config.MaxPoolSize)
+	}
+	return config, nil
+}
+
+// Connect the shared client. The driver pools connections, so a single client
+// is used for the lifetime of the API and pool usage is exported as metrics
+func connectMongo(ctx context.Context, url string, config MongoPoolConfig) (*mongo.Client, error) {
+	opts := options.Client().
+		ApplyURI(url).
+		SetMaxPoolSize(config.MaxPoolSize).
+		SetMinPoolSize(config.MinPoolSize).
+		SetMaxConnIdleTime(config.MaxConnIdleTime).
+		SetPoolMonitor(metrics.MongoPoolMonitor())
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Fail on startup rather than on the first request when Mongo is unreachable
+	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
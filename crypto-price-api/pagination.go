@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"crypto-price-api/storage"
+)
+
+// Encode the position of the next page for the cursor query parameter
+func encodeCursor(cursor storage.Cursor) string {
+	value := strconv.FormatFloat(cursor.Value, 'g', -1, 64) + ":" + cursor.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// Parse the optional cursor query parameter returned as X-Next-Cursor by the previous page
+func parseCursorParam(r *http.Request) (*storage.Cursor, error) {
+	param := r.URL.Query().Get("cursor")
+	if param == "" {
+		return nil, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return nil, fieldError("cursor", "cursor must be the X-Next-Cursor of the previous page")
+	}
+	value, id, didFind := strings.Cut(string(decoded), ":")
+	parsed, err := strconv.ParseFloat(value, 64)
+	if !didFind || err != nil || id == "" {
+		return nil, fieldError("cursor", "cursor must be the X-Next-Cursor of the previous page")
+	}
+	return &storage.Cursor{Value: parsed, ID: id}, nil
+}
+
+// Parse the optional limit query parameter, the largest page returned
+func parseLimitParam(r *http.Request, defaultValue int64, maxValue int64) (int64, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultValue, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 1 || limit > maxValue {
+		return 0, fieldError("limit", "limit must be between 1 and %d", maxValue)
+	}
+	return limit, nil
+}
+
+// Parse the optional order query parameter, "asc" or "desc". Returns whether it is descending
+func parseOrderParam(r *http.Request, defaultDescending bool) (bool, error) {
+	switch r.URL.Query().Get("order") {
+	case "":
+		return defaultDescending, nil
+	case "asc":
+		return false, nil
+	case "desc":
+		return true, nil
+	}
+	return false, fieldError("order", "order must be asc or desc")
+}
+
+// Set the total count of a paged response, and the cursor and link of its next page
+func writePageHeaders(w http.ResponseWriter, r *http.Request, total int64, next *storage.Cursor) {
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if next == nil {
+		return
+	}
+	cursor := encodeCursor(*next)
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	w.Header().Set("X-Next-Cursor", cursor)
+	w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, query.Encode()))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"crypto-price-api/metrics"
+	"crypto-price-api/storage"
+)
+
+// VM for the profit and loss of a single crypto, or of every crypto in total.
+// Costs include purchase fees and proceeds are net of sale fees. Returns are percentages
+type PnLVM struct {
+	Name string `json:"name,omitempty"`
+	// Held amount and the current price, only set per crypto. False Priced means
+	// there is no current price, so the holding is valued at cost
+	Amount float64 `json:"amount"`
+	Price  float64 `json:"price"`
+	Priced bool    `json:"priced"`
+	// Held assets
+	CostBasis        float64 `json:"costBasis"`
+	MarketValue      float64 `json:"marketValue"`
+	UnrealizedPnL    float64 `json:"unrealizedPnl"`
+	UnrealizedReturn float64 `json:"unrealizedReturn"`
+	// Sold assets
+	SoldCost       float64 `json:"soldCost"`
+	Proceeds       float64 `json:"proceeds"`
+	RealizedPnL    float64 `json:"realizedPnl"`
+	RealizedReturn float64 `json:"realizedReturn"`
+	TotalPnL       float64 `json:"totalPnl"`
+	TotalReturn    float64 `json:"totalReturn"`
+}
+
+// VM for the /pnl response
+type PnLReportVM struct {
+	From  int64   `json:"from"`
+	To    int64   `json:"to"`
+	Coins []PnLVM `json:"coins"`
+	Total PnLVM   `json:"total"`
+}
+
+// Percentage return of pnl on cost, 0 when nothing was spent
+func percentReturn(pnl float64, cost float64) float64 {
+	if cost == 0 {
+		return 0
+	}
+	return pnl / cost * 100
+}
+
+// Add the P&L totals of other to p
+func (p *PnLVM) add(other PnLVM) {
+	p.CostBasis += other.CostBasis
+	p.MarketValue += other.MarketValue
+	p.SoldCost += other.SoldCost
+	p.Proceeds += other.Proceeds
+}
+
+// Work out the P&L and returns from the cost and value totals
+func (p *PnLVM) calculate() {
+	p.UnrealizedPnL = p.MarketValue - p.CostBasis
+	p.UnrealizedReturn = percentReturn(p.UnrealizedPnL, p.CostBasis)
+	p.RealizedPnL = p.Proceeds - p.SoldCost
+	p.RealizedReturn = percentReturn(p.RealizedPnL, p.SoldCost)
+	p.TotalPnL = p.UnrealizedPnL + p.RealizedPnL
+	p.TotalReturn = percentReturn(p.TotalPnL, p.CostBasis+p.SoldCost)
+}
+
+// Calculate the P&L of assets at the current prices. Sales are counted when
+// their sale time is within [from, to], and held assets when they were
+// purchased by to. to of 0 means unbounded. averageCosts are the
+// storage.AverageUnitCosts of the owner's disposals
+func calculatePnL(assets []storage.Asset, prices []storage.Price, averageCosts map[string]float64, from int64, to int64) PnLReportVM {
+	currentPrices := map[string]float64{}
+	for _, price := range prices {
+		currentPrices[price.Name] = float64(price.Price)
+	}
+	coins := map[string]*PnLVM{}
+	for _, asset := range assets {
+		coin, didFind := coins[asset.Name]
+		if !didFind {
+			price, priced := currentPrices[asset.Name]
+			coin = &PnLVM{Name: asset.Name, Price: price, Priced: priced}
+			coins[asset.Name] = coin
+		}
+		amount := float64(asset.Amount)
+		cost := storage.CostBasis(asset, averageCosts[asset.ID])
+		if asset.Status == "sold" {
+			if float64(asset.SaleTime) < float64(from) || (to > 0 && float64(asset.SaleTime) > float64(to)) {
+				continue
+			}
+			coin.SoldCost += cost
+			coin.Proceeds += amount*float64(asset.SalePrice) - float64(asset.SaleFee)
+			continue
+		}
+		if to > 0 && float64(asset.PurchaseTime) > float64(to) {
+			continue
+		}
+		coin.Amount += amount
+		coin.CostBasis += cost
+		if coin.Priced {
+			coin.MarketValue += amount * coin.Price
+		} else {
+			coin.MarketValue += cost
+		}
+	}
+	report := PnLReportVM{From: from, To: to, Coins: []PnLVM{}, Total: PnLVM{Priced: true}}
+	for _, coin := range coins {
+		// Skip cryptos with nothing held or sold in the range
+		if coin.CostBasis == 0 && coin.SoldCost == 0 && coin.Amount == 0 && coin.Proceeds == 0 {
+			continue
+		}
+		coin.calculate()
+		report.Coins = append(report.Coins, *coin)
+		report.Total.add(*coin)
+		report.Total.Priced = report.Total.Priced && (coin.Priced || coin.Amount == 0)
+	}
+	sort.Slice(report.Coins, func(i, j int) bool {
+		return report.Coins[i].Name < report.Coins[j].Name
+	})
+	report.Total.calculate()
+	return report
+}
+
+// Handle to calculate profit and loss from the assets and current prices
+// GET /pnl?from=&to=
+// from and to are optional Unix epochs or RFC3339 times bounding the sales
+// counted in realized P&L. Held assets purchased after to are left out
+// Returns: PnLReportVM
+func pnlHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/pnl").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		writeServerError(w, "Calculating P&L", err)
+		return
+	}
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	assets, err := Store.ListAssets(findCtx, requestUser(r).ID)
+	if err != nil {
+		writeServerError(w, "Calculating P&L", err)
+		return
+	}
+	disposals, err := Store.ListDisposals(findCtx, requestUser(r).ID, "")
+	if err != nil {
+		writeServerError(w, "Calculating P&L", err)
+		return
+	}
+	prices, err := Store.ListPrices(findCtx)
+	if err != nil {
+		writeServerError(w, "Calculating P&L", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(calculatePnL(assets, prices, storage.AverageUnitCosts(disposals), from, to))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"crypto-price-api/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Market value of the held assets of a single crypto
+type PortfolioHoldingDB struct {
+	Name   string  `bson:"name"`
+	Amount float64 `bson:"amount"`
+	Price  float64 `bson:"price"`
+	Value  float64 `bson:"value"`
+	Cost   float64 `bson:"cost"`
+}
+
+// `portfolio_snapshots` collection document structure. Maintained by the change tracker
+type PortfolioSnapshotDB struct {
+	ID            string               `bson:"_id,omitempty"`
+	OwnerID       string               `bson:"ownerId"`
+	Interval      string               `bson:"interval"`
+	Time          int64                `bson:"time"`
+	UpdatedAt     int64                `bson:"updatedAt"`
+	Value         float64              `bson:"value"`
+	Cost          float64              `bson:"cost"`
+	UnrealizedPnL float64              `bson:"unrealizedPnl"`
+	RealizedPnL   float64              `bson:"realizedPnl"`
+	Holdings      []PortfolioHoldingDB `bson:"holdings"`
+}
+
+// VM for a held crypto in a portfolio snapshot
+type PortfolioHoldingVM struct {
+	Name   string  `json:"name"`
+	Amount float64 `json:"amount"`
+	Price  float64 `json:"price"`
+	Value  float64 `json:"value"`
+	Cost   float64 `json:"cost"`
+}
+
+// VM for a point of the portfolio value time series
+type PortfolioSnapshotVM struct {
+	Time          int64                `json:"time"`
+	Value         float64              `json:"value"`
+	Cost          float64              `json:"cost"`
+	UnrealizedPnL float64              `json:"unrealizedPnl"`
+	RealizedPnL   float64              `json:"realizedPnl"`
+	Holdings      []PortfolioHoldingVM `json:"holdings"`
+}
+
+// Snapshot series maintained by the change tracker
+var portfolioIntervals = map[string]bool{"1m": true, "1h": true, "1d": true}
+
+// Handle to look up the portfolio value over time of the user of the request, oldest first
+// GET /portfolio?interval=1h&duration=168h
+// interval is one of "1m" (kept for 1 day), "1h" (kept for 30 days) or "1d". Default "1h"
+// duration is a Go duration. Default 168h
+// Returns: []PortfolioSnapshotVM
+func portfolioHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/portfolio").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "1h"
+	}
+	if !portfolioIntervals[interval] {
+		writeFieldError(w, fieldError("interval", "interval must be 1m, 1h or 1d"))
+		return
+	}
+	duration, err := parseDurationParam(r, "duration", 168*time.Hour)
+	if err != nil {
+		writeServerError(w, "Looking up portfolio snapshots", err)
+		return
+	}
+	// Timeout for lookup
+	findCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	collection := MongoClient.Database("crypto").Collection("portfolio_snapshots")
+	filter := bson.M{
+		"ownerId":  requestUser(r).ID,
+		"interval": interval,
+		"time":     bson.M{"$gte": time.Now().Add(-duration).Unix()},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}})
+	results := []PortfolioSnapshotVM{}
+	cursor, err := collection.Find(findCtx, filter, opts)
+	if err != nil {
+		writeServerError(w, "Looking up portfolio snapshots", err)
+		return
+	}
+	for cursor.Next(findCtx) {
+		var snapshot PortfolioSnapshotDB
+		if err := cursor.Decode(&snapshot); err != nil {
+			fmt.Printf("Could not decode PortfolioSnapshotDB %v", err)
+			continue
+		}
+		holdings := []PortfolioHoldingVM{}
+		for _, holding := range snapshot.Holdings {
+			holdings = append(holdings, PortfolioHoldingVM(holding))
+		}
+		results = append(results, PortfolioSnapshotVM{
+			Time:          snapshot.Time,
+			Value:         snapshot.Value,
+			Cost:          snapshot.Cost,
+			UnrealizedPnL: snapshot.UnrealizedPnL,
+			RealizedPnL:   snapshot.RealizedPnL,
+			Holdings:      holdings,
+		})
+	}
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// Trade imported from an exchange export. Exactly one of Buy and Sell is set,
+// with its ImportID
+type Trade struct {
+	// Purchase, created as a held asset
+	Buy *Asset
+	// Sale, disposed of from the held lots
+	Sell *Disposal
+}
+
+func (t Trade) ImportID() string {
+	if t.Buy != nil {
+		return t.Buy.ImportID
+	}
+	return t.Sell.ImportID
+}
+
+// User the trade is imported for
+func (t Trade) OwnerID() string {
+	if t.Buy != nil {
+		return t.Buy.OwnerID
+	}
+	return t.Sell.OwnerID
+}
+
+// Trades imported from exchange exports
+type ImportRepository interface {
+	// Import IDs of the assets and disposals already imported by a user
+	ListImportIDs(ctx context.Context, ownerID string) (map[string]bool, error)
+	// Create the bought assets and dispose of the sales in order, all or nothing.
+	// Returns ErrDuplicateImport when its owner already imported a trade, or
+	// ErrInsufficientAmount when a sale is more than was held, wrapped with the
+	// import ID of the trade
+	ImportTrades(ctx context.Context, trades []Trade) error
+}
+
+// Wrap an error of importing a trade with its import ID
+func importError(trade Trade, err error) error {
+	return fmt.Errorf("trade %s: %w", trade.ImportID(), err)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"sort"
+)
+
+// Methods of matching a disposal to held lots
+const (
+	// Oldest lots first
+	CostBasisFIFO = "fifo"
+	// Newest lots first
+	CostBasisLIFO = "lifo"
+	// Lots with the highest unit cost first
+	CostBasisHIFO = "hifo"
+	// Lots are sold oldest first, at the average unit cost of every held lot
+	CostBasisAverage = "average"
+)
+
+// Whether method is one of the cost basis methods
+func ValidCostBasisMethod(method string) bool {
+	switch method {
+	case CostBasisFIFO, CostBasisLIFO, CostBasisHIFO, CostBasisAverage:
+		return true
+	}
+	return false
+}
+
+// Part of a disposal taken from a held lot
+type LotMatch struct {
+	// Held asset the amount was taken from, and the sold asset recording it
+	LotID   string  `bson:"lotId"`
+	AssetID string  `bson:"assetId"`
+	Amount  float32 `bson:"amount"`
+	// Purchase of the lot
+	PurchasePrice float32 `bson:"purchasePrice"`
+	PurchaseTime  float32 `bson:"purchaseTime"`
+	// Cost including the purchase fee, or the average cost for CostBasisAverage
+	CostBasis float64 `bson:"costBasis"`
+	// Sale value net of this match's share of the sale fee
+	Proceeds float64 `bson:"proceeds"`
+	Gain     float64 `bson:"gain"`
+}
+
+// `disposals` collection document structure. A sale of an amount of a crypto
+// matched to held lots
+type Disposal struct {
+	ID string `bson:"_id,omitempty"`
+	// User whose lots were sold
+	OwnerID string  `bson:"ownerId"`
+	Name    string  `bson:"name"`
+	Amount  float32 `bson:"amount"`
+	Price   float32 `bson:"price"`
+	Time    float32 `bson:"time"`
+	Fee     float32 `bson:"fee"`
+	// One of the CostBasis methods
+	Method string `bson:"method"`
+	// Totals of Matches
+	CostBasis float64    `bson:"costBasis"`
+	Proceeds  float64    `bson:"proceeds"`
+	Gain      float64    `bson:"gain"`
+	Matches   []LotMatch `bson:"matches"`
+	// Trade the disposal was imported from. Unique
+	ImportID string `bson:"importId,omitempty"`
+}
+
+// Sales of an amount of a crypto matched to held lots
+type DisposalRepository interface {
+	// Sell an amount of a crypto from the held lots of disposal.OwnerID in the order of
+	// disposal.Method, and record the lot matches. Returns the disposal with its
+	// ID and matches, or ErrInsufficientAmount when the lots held at the sale time
+	// hold less than the amount
+	Dispose(ctx context.Context, disposal Disposal) (Disposal, error)
+	// Disposals of a user of a crypto, or of every crypto when name is empty, newest first
+	ListDisposals(ctx context.Context, ownerID string, name string) ([]Disposal, error)
+}
+
+// Amount sold under this rounding error is ignored, as asset amounts are float32
+const lotAmountTolerance = 1e-6
+
+// Sale of a held lot planned by planDisposal
+type lotSale struct {
+	Lot  Asset
+	Sale Sale
+}
+
+// Unit cost of a lot including its purchase fee
+func lotUnitCost(lot Asset) float64 {
+	if lot.Amount == 0 {
+		return float64(lot.PurchasePrice)
+	}
+	return float64(lot.PurchasePrice) + float64(lot.PurchaseFee)/float64(lot.Amount)
+}
+
+// Cost of an asset including its purchase fee, or at averageUnitCost when it was
+// sold by a CostBasisAverage disposal. Used by disposals, P&L and tax reports, so
+// they agree on realized gains
+func CostBasis(asset Asset, averageUnitCost float64) float64 {
+	if averageUnitCost != 0 {
+		return float64(asset.Amount) * averageUnitCost
+	}
+	return float64(asset.Amount)*float64(asset.PurchasePrice) + float64(asset.PurchaseFee)
+}
+
+// Unit costs of the assets sold by CostBasisAverage disposals, by sold asset ID,
+// to pass to CostBasis
+func AverageUnitCosts(disposals []Disposal) map[string]float64 {
+	costs := map[string]float64{}
+	for _, disposal := range disposals {
+		if disposal.Method != CostBasisAverage {
+			continue
+		}
+		for _, match := range disposal.Matches {
+			if match.Amount != 0 {
+				costs[match.AssetID] = match.CostBasis / float64(match.Amount)
+			}
+		}
+	}
+	return costs
+}
+
+// Work out the sales of held lots for a disposal. assets may include any asset,
+// only lots of the crypto held by the owner at the sale time are sold. Also returns the
+// average unit cost of those lots
+func planDisposal(assets []Asset, disposal Disposal) ([]lotSale, float64, error) {
+	lots := []Asset{}
+	var totalAmount, totalCost float64
+	for _, asset := range assets {
+		if asset.OwnerID != disposal.OwnerID || asset.Name != disposal.Name || asset.Status != "held" || asset.PurchaseTime > disposal.Time {
+			continue
+		}
+		lots = append(lots, asset)
+		totalAmount += float64(asset.Amount)
+		totalCost += lotUnitCost(asset) * float64(asset.Amount)
+	}
+	if float64(disposal.Amount) > totalAmount+lotAmountTolerance {
+		return nil, 0, ErrInsufficientAmount
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		switch disposal.Method {
+		case CostBasisLIFO:
+			return lots[i].PurchaseTime > lots[j].PurchaseTime
+		case CostBasisHIFO:
+			if lotUnitCost(lots[i]) != lotUnitCost(lots[j]) {
+				return lotUnitCost(lots[i]) > lotUnitCost(lots[j])
+			}
+		}
+		return lots[i].PurchaseTime < lots[j].PurchaseTime
+	})
+	sales := []lotSale{}
+	remaining := float64(disposal.Amount)
+	for _, lot := range lots {
+		if remaining <= lotAmountTolerance {
+			break
+		}
+		sale := Sale{Price: disposal.Price, Time: disposal.Time, Version: lot.Version}
+		sold := float64(lot.Amount)
+		if sold > remaining+lotAmountTolerance {
+			sold = remaining
+			sale.Amount = float32(remaining)
+		}
+		// Split the sale fee in proportion to the amount sold
+		sale.Fee = float32(float64(disposal.Fee) * sold / float64(disposal.Amount))
+		sales = append(sales, lotSale{Lot: lot, Sale: sale})
+		remaining -= sold
+	}
+	return sales, totalCost / totalAmount, nil
+}
+
+// Record the sold assets of the planned sales as the matches of a disposal
+func completeDisposal(disposal Disposal, sales []lotSale, sold []Asset, averageCost float64) Disposal {
+	disposal.Matches = []LotMatch{}
+	disposal.CostBasis, disposal.Proceeds, disposal.Gain = 0, 0, 0
+	if disposal.Method != CostBasisAverage {
+		averageCost = 0
+	}
+	for i, asset := range sold {
+		match := LotMatch{
+			LotID:         sales[i].Lot.ID,
+			AssetID:       asset.ID,
+			Amount:        asset.Amount,
+			PurchasePrice: asset.PurchasePrice,
+			PurchaseTime:  asset.PurchaseTime,
+			CostBasis:     CostBasis(asset, averageCost),
+			Proceeds:      float64(asset.Amount)*float64(asset.SalePrice) - float64(asset.SaleFee),
+		}
+		match.Gain = match.Proceeds - match.CostBasis
+		disposal.Matches = append(disposal.Matches, match)
+		disposal.CostBasis += match.CostBasis
+		disposal.Proceeds += match.Proceeds
+		disposal.Gain += match.Gain
+	}
+	return disposal
+}
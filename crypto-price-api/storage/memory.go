@@ -0,0 +1,429 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store kept in memory, for tests and local development. Nothing is persisted
+type MemoryStore struct {
+	mu      sync.RWMutex
+	prices  map[string]Price
+	changes []PriceChange
+	assets  map[string]Asset
+	// Oldest first
+	disposals []Disposal
+	users     map[string]User
+	tokens    map[string]APIToken
+}
+
+// Create an empty store with the default user
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		prices: map[string]Price{},
+		assets: map[string]Asset{},
+		users: map[string]User{
+			DefaultUserID: {ID: DefaultUserID, Username: DefaultUserUsername, Role: RoleAdmin, CreatedAt: time.Now().Unix()},
+		},
+		tokens: map[string]APIToken{},
+	}
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// Set the current price of a crypto
+func (s *MemoryStore) PutPrice(price Price) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, didFind := s.prices[price.Name]; didFind {
+		price.ID = existing.ID
+	} else {
+		price.ID = newID()
+	}
+	s.prices[price.Name] = price
+}
+
+// Append a tick to the price history
+func (s *MemoryStore) AddPriceChange(change PriceChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change.ID = newID()
+	s.changes = append(s.changes, change)
+}
+
+func (s *MemoryStore) ListPrices(ctx context.Context) ([]Price, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prices := []Price{}
+	for _, price := range s.prices {
+		prices = append(prices, price)
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Name < prices[j].Name })
+	return prices, nil
+}
+
+func (s *MemoryStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	price, didFind := s.prices[name]
+	if !didFind {
+		return price, ErrNotFound
+	}
+	return price, nil
+}
+
+func (s *MemoryStore) ListPriceChanges(ctx context.Context, query PriceChangeQuery) (PriceChangePage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	page := PriceChangePage{Changes: []PriceChange{}}
+	matches := []PriceChange{}
+	for _, change := range s.changes {
+		if change.Name == query.Name && (query.From == 0 || change.Time >= query.From) && (query.To == 0 || change.Time <= query.To) {
+			matches = append(matches, change)
+		}
+	}
+	page.Total = int64(len(matches))
+	key := func(i int) Cursor { return Cursor{float64(matches[i].Time), matches[i].ID} }
+	sort.Slice(matches, func(i, j int) bool { return key(i).before(key(j), query.Descending) })
+	start, end, next := pageBounds(len(matches), key, query.After, query.Descending, query.Limit)
+	page.Changes = append(page.Changes, matches[start:end]...)
+	page.Next = next
+	return page, nil
+}
+
+func (s *MemoryStore) ListAssets(ctx context.Context, ownerID string) ([]Asset, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	assets := []Asset{}
+	for _, asset := range s.assets {
+		if ownerID == "" || asset.OwnerID == ownerID {
+			assets = append(assets, asset)
+		}
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].PurchaseTime > assets[j].PurchaseTime })
+	return assets, nil
+}
+
+func (s *MemoryStore) FindAssets(ctx context.Context, query AssetQuery) (AssetPage, error) {
+	if err := validateAssetQuery(query); err != nil {
+		return AssetPage{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	page := AssetPage{Assets: []Asset{}}
+	matches := []Asset{}
+	for _, asset := range s.assets {
+		if query.matches(asset) {
+			matches = append(matches, asset)
+		}
+	}
+	page.Total = int64(len(matches))
+	field := query.sortField()
+	key := func(i int) Cursor { return Cursor{assetSortValue(matches[i], field), matches[i].ID} }
+	sort.Slice(matches, func(i, j int) bool { return key(i).before(key(j), query.Descending) })
+	start, end, next := pageBounds(len(matches), key, query.After, query.Descending, query.Limit)
+	page.Assets = append(page.Assets, matches[start:end]...)
+	page.Next = next
+	return page, nil
+}
+
+func (s *MemoryStore) FindAsset(ctx context.Context, id string) (Asset, error) {
+	if err := validateID(id); err != nil {
+		return Asset{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	asset, didFind := s.assets[id]
+	if !didFind {
+		return asset, ErrNotFound
+	}
+	return asset, nil
+}
+
+func (s *MemoryStore) CreateAsset(ctx context.Context, asset Asset) (Asset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	asset.ID = newID()
+	asset.Version = 1
+	s.assets[asset.ID] = asset
+	return asset, nil
+}
+
+func (s *MemoryStore) SellAsset(ctx context.Context, id string, sale Sale) (Asset, *Asset, error) {
+	if err := validateID(id); err != nil {
+		return Asset{}, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sellAsset(id, sale)
+}
+
+// Sell an asset while holding the lock
+func (s *MemoryStore) sellAsset(id string, sale Sale) (Asset, *Asset, error) {
+	current, didFind := s.assets[id]
+	if !didFind {
+		return current, nil, ErrNotFound
+	}
+	sold, held, err := planSale(current, sale)
+	if err != nil {
+		return sold, nil, err
+	}
+	if held == nil {
+		sold.Version++
+		s.assets[id] = sold
+		return sold, nil, nil
+	}
+	held.Version++
+	s.assets[id] = *held
+	sold.ID = newID()
+	sold.Version = 1
+	s.assets[sold.ID] = sold
+	return sold, held, nil
+}
+
+func (s *MemoryStore) UpdateAsset(ctx context.Context, asset Asset) (Asset, error) {
+	if err := validateID(asset.ID); err != nil {
+		return asset, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, didFind := s.assets[asset.ID]
+	if !didFind {
+		return asset, ErrNotFound
+	}
+	if current.Version != asset.Version {
+		return current, ErrVersionConflict
+	}
+	// The owner is never changed by an update
+	asset.OwnerID = current.OwnerID
+	asset.Version++
+	s.assets[asset.ID] = asset
+	return asset, nil
+}
+
+func (s *MemoryStore) DeleteAsset(ctx context.Context, id string, version int64) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, didFind := s.assets[id]
+	if !didFind {
+		return ErrNotFound
+	}
+	if version != AnyVersion && current.Version != version {
+		return ErrVersionConflict
+	}
+	delete(s.assets, id)
+	return nil
+}
+
+func (s *MemoryStore) Dispose(ctx context.Context, disposal Disposal) (Disposal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dispose(disposal)
+}
+
+// Dispose while holding the lock
+func (s *MemoryStore) dispose(disposal Disposal) (Disposal, error) {
+	assets := []Asset{}
+	for _, asset := range s.assets {
+		assets = append(assets, asset)
+	}
+	sales, averageCost, err := planDisposal(assets, disposal)
+	if err != nil {
+		return disposal, err
+	}
+	// Every lot was read under the lock, so the sales cannot fail part way
+	soldAssets := []Asset{}
+	for _, lotSale := range sales {
+		sold, _, err := s.sellAsset(lotSale.Lot.ID, lotSale.Sale)
+		if err != nil {
+			return disposal, err
+		}
+		soldAssets = append(soldAssets, sold)
+	}
+	disposal = completeDisposal(disposal, sales, soldAssets, averageCost)
+	disposal.ID = newID()
+	s.disposals = append(s.disposals, disposal)
+	return disposal, nil
+}
+
+func (s *MemoryStore) ListDisposals(ctx context.Context, ownerID string, name string) ([]Disposal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	disposals := []Disposal{}
+	for _, disposal := range s.disposals {
+		if disposal.OwnerID == ownerID && (name == "" || disposal.Name == name) {
+			disposals = append(disposals, disposal)
+		}
+	}
+	sort.SliceStable(disposals, func(i, j int) bool { return disposals[i].Time > disposals[j].Time })
+	return disposals, nil
+}
+
+func (s *MemoryStore) ListImportIDs(ctx context.Context, ownerID string) (map[string]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.importIDs(ownerID), nil
+}
+
+// Import IDs of a user while holding the lock
+func (s *MemoryStore) importIDs(ownerID string) map[string]bool {
+	importIDs := map[string]bool{}
+	for _, asset := range s.assets {
+		if asset.OwnerID == ownerID && asset.ImportID != "" {
+			importIDs[asset.ImportID] = true
+		}
+	}
+	for _, disposal := range s.disposals {
+		if disposal.OwnerID == ownerID && disposal.ImportID != "" {
+			importIDs[disposal.ImportID] = true
+		}
+	}
+	return importIDs
+}
+
+// The assets and disposals are restored if any trade fails
+func (s *MemoryStore) ImportTrades(ctx context.Context, trades []Trade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Import IDs of each owner
+	importIDs := map[string]map[string]bool{}
+	assets := make(map[string]Asset, len(s.assets))
+	for id, asset := range s.assets {
+		assets[id] = asset
+	}
+	disposals := s.disposals
+	var err error
+	for _, trade := range trades {
+		ownerImportIDs, didFind := importIDs[trade.OwnerID()]
+		if !didFind {
+			ownerImportIDs = s.importIDs(trade.OwnerID())
+			importIDs[trade.OwnerID()] = ownerImportIDs
+		}
+		if ownerImportIDs[trade.ImportID()] {
+			err = importError(trade, ErrDuplicateImport)
+			break
+		}
+		ownerImportIDs[trade.ImportID()] = true
+		if trade.Buy != nil {
+			asset := *trade.Buy
+			asset.ID = newID()
+			asset.Version = 1
+			s.assets[asset.ID] = asset
+			continue
+		}
+		if _, err = s.dispose(*trade.Sell); err != nil {
+			err = importError(trade, err)
+			break
+		}
+	}
+	if err != nil {
+		s.assets = assets
+		s.disposals = disposals
+	}
+	return err
+}
+
+func (s *MemoryStore) ListUsers(ctx context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []User{}
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *MemoryStore) FindUserByUsername(ctx context.Context, username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			return user, ErrUsernameTaken
+		}
+	}
+	user.ID = newID()
+	s.users[user.ID] = user
+	return user, nil
+}
+
+func (s *MemoryStore) SetPasswordHash(ctx context.Context, id string, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, didFind := s.users[id]
+	if !didFind {
+		return ErrNotFound
+	}
+	user.PasswordHash = passwordHash
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryStore) ListTokens(ctx context.Context, userID string) ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := []APIToken{}
+	for _, token := range s.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt > tokens[j].CreatedAt })
+	return tokens, nil
+}
+
+func (s *MemoryStore) CreateToken(ctx context.Context, token APIToken) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token.ID = newID()
+	s.tokens[token.ID] = token
+	return token, nil
+}
+
+func (s *MemoryStore) FindToken(ctx context.Context, tokenHash string) (APIToken, User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, token := range s.tokens {
+		if token.TokenHash == tokenHash {
+			user, didFind := s.users[token.UserID]
+			if !didFind {
+				return token, user, ErrNotFound
+			}
+			return token, user, nil
+		}
+	}
+	return APIToken{}, User{}, ErrNotFound
+}
+
+func (s *MemoryStore) DeleteToken(ctx context.Context, userID string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, didFind := s.tokens[id]
+	if !didFind || token.UserID != userID {
+		return ErrNotFound
+	}
+	delete(s.tokens, id)
+	return nil
+}
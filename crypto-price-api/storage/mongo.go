@@ -0,0 +1,654 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store backed by the `crypto` MongoDB database
+type MongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+	// Whether the deployment supports transactions, once topologyKnown
+	topologyMu    sync.Mutex
+	topologyKnown bool
+	transactions  bool
+}
+
+// Connect to MongoDB
+func OpenMongo(ctx context.Context, url string) (*MongoStore, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	return NewMongoStore(client), nil
+}
+
+// Create a store using an existing client
+func NewMongoStore(client *mongo.Client) *MongoStore {
+	return &MongoStore{client: client, db: client.Database("crypto")}
+}
+
+// Client for collections without a repository
+func (s *MongoStore) Client() *mongo.Client {
+	return s.client
+}
+
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+// Whether the server is a replica set member or mongos, as standalone servers have
+// no transactions. Asked once, or again after the server could not be asked
+func (s *MongoStore) supportsTransactions(ctx context.Context) bool {
+	s.topologyMu.Lock()
+	defer s.topologyMu.Unlock()
+	if s.topologyKnown {
+		return s.transactions
+	}
+	var hello bson.M
+	if err := s.client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false
+	}
+	_, isReplicaSet := hello["setName"]
+	s.transactions = isReplicaSet || hello["msg"] == "isdbgrid"
+	s.topologyKnown = true
+	return s.transactions
+}
+
+// Whether ctx runs in a transaction, which is aborted on failure rather than undone
+func inTransaction(ctx context.Context) bool {
+	return mongo.SessionFromContext(ctx) != nil
+}
+
+// Run fn in a transaction when the deployment supports them, or in the transaction
+// ctx already runs in. Otherwise fn runs without one and must undo its own writes
+// on failure, see inTransaction
+func (s *MongoStore) withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if inTransaction(ctx) || !s.supportsTransactions(ctx) {
+		return fn(ctx)
+	}
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionCtx)
+	})
+	return err
+}
+
+func (s *MongoStore) ListPrices(ctx context.Context) ([]Price, error) {
+	cursor, err := s.db.Collection("prices").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	prices := []Price{}
+	err = cursor.All(ctx, &prices)
+	return prices, err
+}
+
+func (s *MongoStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	var price Price
+	err := s.db.Collection("prices").FindOne(ctx, bson.M{"name": name}).Decode(&price)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return price, ErrNotFound
+	}
+	return price, err
+}
+
+// Add inclusive bounds on field to a filter. 0 is unbounded
+func rangeFilter(filter bson.M, field string, from int64, to int64) {
+	bounds := bson.M{}
+	if from != 0 {
+		bounds["$gte"] = from
+	}
+	if to != 0 {
+		bounds["$lte"] = to
+	}
+	if len(bounds) > 0 {
+		filter[field] = bounds
+	}
+}
+
+// Find options and keyset filter of a page sorted by field then _id. Returns
+// ErrInvalidID when the cursor ID is not an ObjectID
+func mongoPage(field string, descending bool, after *Cursor, limit int64) (*options.FindOptions, bson.M, error) {
+	direction, comparison := 1, "$gt"
+	if descending {
+		direction, comparison = -1, "$lt"
+	}
+	opts := options.Find().SetSort(bson.D{{Key: field, Value: direction}, {Key: "_id", Value: direction}})
+	if limit > 0 {
+		// One more to tell whether there is a next page
+		opts.SetLimit(limit + 1)
+	}
+	if after == nil {
+		return opts, nil, nil
+	}
+	afterId, err := primitive.ObjectIDFromHex(after.ID)
+	if err != nil {
+		return nil, nil, ErrInvalidID
+	}
+	return opts, bson.M{"$or": bson.A{
+		bson.M{field: bson.M{comparison: after.Value}},
+		bson.M{field: after.Value, "_id": bson.M{comparison: afterId}},
+	}}, nil
+}
+
+// Add a keyset filter to a filter, keeping the filter's own conditions
+func withPageFilter(filter bson.M, pageFilter bson.M) bson.M {
+	if pageFilter == nil {
+		return filter
+	}
+	return bson.M{"$and": bson.A{filter, pageFilter}}
+}
+
+func (s *MongoStore) ListPriceChanges(ctx context.Context, query PriceChangeQuery) (PriceChangePage, error) {
+	page := PriceChangePage{Changes: []PriceChange{}}
+	filter := bson.M{"name": query.Name}
+	rangeFilter(filter, "time", query.From, query.To)
+	opts, pageFilter, err := mongoPage("time", query.Descending, query.After, query.Limit)
+	if err != nil {
+		return page, err
+	}
+	collection := s.db.Collection("price_changes_over_time")
+	if page.Total, err = collection.CountDocuments(ctx, filter); err != nil {
+		return page, err
+	}
+	cursor, err := collection.Find(ctx, withPageFilter(filter, pageFilter), opts)
+	if err != nil {
+		return page, err
+	}
+	if err = cursor.All(ctx, &page.Changes); err != nil {
+		return page, err
+	}
+	end, next := pageEnd(len(page.Changes), query.Limit, func(i int) Cursor {
+		return Cursor{float64(page.Changes[i].Time), page.Changes[i].ID}
+	})
+	page.Changes, page.Next = page.Changes[:end], next
+	return page, nil
+}
+
+func (s *MongoStore) ListAssets(ctx context.Context, ownerID string) ([]Asset, error) {
+	filter := bson.M{}
+	if ownerID != "" {
+		filter["ownerId"] = ownerID
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "purchaseTime", Value: -1}})
+	cursor, err := s.db.Collection("assets").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	assets := []Asset{}
+	err = cursor.All(ctx, &assets)
+	return assets, err
+}
+
+func (s *MongoStore) FindAssets(ctx context.Context, query AssetQuery) (AssetPage, error) {
+	page := AssetPage{Assets: []Asset{}}
+	if err := validateAssetQuery(query); err != nil {
+		return page, err
+	}
+	filter := bson.M{}
+	for field, value := range map[string]string{"ownerId": query.OwnerID, "name": query.Name, "status": query.Status} {
+		if value != "" {
+			filter[field] = value
+		}
+	}
+	rangeFilter(filter, "purchaseTime", query.From, query.To)
+	field := query.sortField()
+	opts, pageFilter, err := mongoPage(field, query.Descending, query.After, query.Limit)
+	if err != nil {
+		return page, err
+	}
+	collection := s.db.Collection("assets")
+	if page.Total, err = collection.CountDocuments(ctx, filter); err != nil {
+		return page, err
+	}
+	cursor, err := collection.Find(ctx, withPageFilter(filter, pageFilter), opts)
+	if err != nil {
+		return page, err
+	}
+	if err = cursor.All(ctx, &page.Assets); err != nil {
+		return page, err
+	}
+	end, next := pageEnd(len(page.Assets), query.Limit, func(i int) Cursor {
+		return Cursor{assetSortValue(page.Assets[i], field), page.Assets[i].ID}
+	})
+	page.Assets, page.Next = page.Assets[:end], next
+	return page, nil
+}
+
+func (s *MongoStore) FindAsset(ctx context.Context, id string) (Asset, error) {
+	var asset Asset
+	assetId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return asset, ErrInvalidID
+	}
+	err = s.db.Collection("assets").FindOne(ctx, bson.M{"_id": assetId}).Decode(&asset)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return asset, ErrNotFound
+	}
+	return asset, err
+}
+
+func (s *MongoStore) CreateAsset(ctx context.Context, asset Asset) (Asset, error) {
+	asset.ID = ""
+	asset.Version = 1
+	result, err := s.db.Collection("assets").InsertOne(ctx, &asset)
+	if mongo.IsDuplicateKeyError(err) {
+		return asset, ErrDuplicateImport
+	}
+	if err != nil {
+		return asset, err
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		asset.ID = id.Hex()
+	}
+	return asset, nil
+}
+
+// The held and sold parts of a partial sale are written in a transaction when the
+// deployment supports them. Otherwise they are written separately, and if the sold
+// part cannot be inserted the held asset is restored
+func (s *MongoStore) SellAsset(ctx context.Context, id string, sale Sale) (Asset, *Asset, error) {
+	var sold Asset
+	var held *Asset
+	err := s.withTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		sold, held, err = s.sellAsset(ctx, id, sale)
+		return err
+	})
+	return sold, held, err
+}
+
+func (s *MongoStore) sellAsset(ctx context.Context, id string, sale Sale) (Asset, *Asset, error) {
+	current, err := s.FindAsset(ctx, id)
+	if err != nil {
+		return current, nil, err
+	}
+	sold, held, err := planSale(current, sale)
+	if err != nil {
+		return sold, nil, err
+	}
+	if held == nil {
+		sold, err = s.UpdateAsset(ctx, sold)
+		return sold, nil, err
+	}
+	updated, err := s.UpdateAsset(ctx, *held)
+	if err != nil {
+		return sold, nil, err
+	}
+	sold, err = s.CreateAsset(ctx, sold)
+	if err != nil && inTransaction(ctx) {
+		return sold, nil, err
+	} else if err != nil {
+		current.Version = updated.Version
+		if _, restoreErr := s.UpdateAsset(ctx, current); restoreErr != nil {
+			return sold, nil, fmt.Errorf("%w, and could not restore asset %s: %v", err, id, restoreErr)
+		}
+		return sold, nil, err
+	}
+	return sold, &updated, nil
+}
+
+// Matches an asset at version. Assets created before versioning have no version field
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+// Work out why a versioned write matched no asset
+func (s *MongoStore) versionedWriteError(ctx context.Context, assetId primitive.ObjectID) error {
+	count, err := s.db.Collection("assets").CountDocuments(ctx, bson.M{"_id": assetId})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionConflict
+}
+
+func (s *MongoStore) UpdateAsset(ctx context.Context, asset Asset) (Asset, error) {
+	assetId, err := primitive.ObjectIDFromHex(asset.ID)
+	if err != nil {
+		return asset, ErrInvalidID
+	}
+	filter := bson.M{"_id": assetId, "version": versionFilter(asset.Version)}
+	update := bson.M{
+		"$set": bson.M{
+			"name":          asset.Name,
+			"amount":        asset.Amount,
+			"purchasePrice": asset.PurchasePrice,
+			"purchaseTime":  asset.PurchaseTime,
+			"status":        asset.Status,
+			"salePrice":     asset.SalePrice,
+			"saleTime":      asset.SaleTime,
+			"purchaseFee":   asset.PurchaseFee,
+			"saleFee":       asset.SaleFee,
+			"parentId":      asset.ParentID,
+			"version":       asset.Version + 1,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated Asset
+	err = s.db.Collection("assets").FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return asset, s.versionedWriteError(ctx, assetId)
+	}
+	return updated, err
+}
+
+func (s *MongoStore) DeleteAsset(ctx context.Context, id string, version int64) error {
+	assetId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrInvalidID
+	}
+	filter := bson.M{"_id": assetId}
+	if version != AnyVersion {
+		filter["version"] = versionFilter(version)
+	}
+	result, err := s.db.Collection("assets").DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return s.versionedWriteError(ctx, assetId)
+	}
+	return nil
+}
+
+// Lots are sold and the disposal recorded in a transaction when the deployment
+// supports them. Otherwise lots are sold one at a time, and if a lot cannot be sold
+// or the disposal cannot be recorded, the lots already sold are restored
+func (s *MongoStore) Dispose(ctx context.Context, disposal Disposal) (Disposal, error) {
+	result := disposal
+	err := s.withTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		result, _, err = s.dispose(ctx, disposal)
+		return err
+	})
+	return result, err
+}
+
+// Dispose, also returning a function to undo the disposal that returns its argument
+func (s *MongoStore) dispose(ctx context.Context, disposal Disposal) (Disposal, func(context.Context, error) error, error) {
+	filter := bson.M{"ownerId": disposal.OwnerID, "name": disposal.Name, "status": "held"}
+	cursor, err := s.db.Collection("assets").Find(ctx, filter)
+	if err != nil {
+		return disposal, nil, err
+	}
+	lots := []Asset{}
+	if err = cursor.All(ctx, &lots); err != nil {
+		return disposal, nil, err
+	}
+	sales, averageCost, err := planDisposal(lots, disposal)
+	if err != nil {
+		return disposal, nil, err
+	}
+	soldAssets := []Asset{}
+	heldAssets := []*Asset{}
+	for _, lotSale := range sales {
+		sold, held, err := s.SellAsset(ctx, lotSale.Lot.ID, lotSale.Sale)
+		if err != nil {
+			return disposal, nil, s.undoLotSales(ctx, sales, soldAssets, heldAssets, err)
+		}
+		soldAssets = append(soldAssets, sold)
+		heldAssets = append(heldAssets, held)
+	}
+	disposal = completeDisposal(disposal, sales, soldAssets, averageCost)
+	disposal.ID = ""
+	result, err := s.db.Collection("disposals").InsertOne(ctx, &disposal)
+	if mongo.IsDuplicateKeyError(err) {
+		err = ErrDuplicateImport
+	}
+	if err != nil {
+		return disposal, nil, s.undoLotSales(ctx, sales, soldAssets, heldAssets, err)
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		disposal.ID = id.Hex()
+	}
+	undo := func(undoCtx context.Context, err error) error {
+		if _, deleteErr := s.db.Collection("disposals").DeleteOne(undoCtx, bson.M{"_id": result.InsertedID}); deleteErr != nil {
+			return fmt.Errorf("%w, and could not delete disposal %s: %v", err, disposal.ID, deleteErr)
+		}
+		return s.undoLotSales(undoCtx, sales, soldAssets, heldAssets, err)
+	}
+	return disposal, undo, nil
+}
+
+// Restore the lots sold by a failed disposal, returning err. Nothing is restored in
+// a transaction, as it is aborted instead
+func (s *MongoStore) undoLotSales(ctx context.Context, sales []lotSale, sold []Asset, held []*Asset, err error) error {
+	if inTransaction(ctx) {
+		return err
+	}
+	for i := len(sold) - 1; i >= 0; i-- {
+		lot := sales[i].Lot
+		var undoErr error
+		if held[i] == nil {
+			lot.Version = sold[i].Version
+		} else {
+			lot.Version = held[i].Version
+			undoErr = s.DeleteAsset(ctx, sold[i].ID, AnyVersion)
+			if errors.Is(undoErr, ErrNotFound) {
+				undoErr = nil
+			}
+		}
+		if undoErr == nil {
+			_, undoErr = s.UpdateAsset(ctx, lot)
+		}
+		if undoErr != nil {
+			return fmt.Errorf("%w, and could not restore asset %s: %v", err, lot.ID, undoErr)
+		}
+	}
+	return err
+}
+
+func (s *MongoStore) ListDisposals(ctx context.Context, ownerID string, name string) ([]Disposal, error) {
+	filter := bson.M{"ownerId": ownerID}
+	if name != "" {
+		filter["name"] = name
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	cursor, err := s.db.Collection("disposals").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	disposals := []Disposal{}
+	err = cursor.All(ctx, &disposals)
+	return disposals, err
+}
+
+func (s *MongoStore) ListImportIDs(ctx context.Context, ownerID string) (map[string]bool, error) {
+	importIDs := map[string]bool{}
+	filter := bson.M{"ownerId": ownerID, "importId": bson.M{"$exists": true}}
+	for _, collection := range []string{"assets", "disposals"} {
+		values, err := s.db.Collection(collection).Distinct(ctx, "importId", filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			if importID, ok := value.(string); ok {
+				importIDs[importID] = true
+			}
+		}
+	}
+	return importIDs, nil
+}
+
+// Trades are written in one transaction when the deployment supports them, so an
+// import is all or nothing. A standalone server has no transactions, so trades are
+// written one at a time and if a trade fails, the trades already written are undone
+// in reverse order. The undo has its own context, so it still runs when ctx was
+// cancelled or timed out, but a crash during an import leaves the trades written so far
+func (s *MongoStore) ImportTrades(ctx context.Context, trades []Trade) error {
+	return s.withTransaction(ctx, func(ctx context.Context) error {
+		return s.importTrades(ctx, trades)
+	})
+}
+
+func (s *MongoStore) importTrades(ctx context.Context, trades []Trade) error {
+	undos := []func(context.Context, error) error{}
+	var err error
+	for _, trade := range trades {
+		if trade.Buy != nil {
+			var asset Asset
+			asset, err = s.CreateAsset(ctx, *trade.Buy)
+			if err == nil {
+				undos = append(undos, func(undoCtx context.Context, err error) error {
+					// Already deleted when the undo is repeated
+					deleteErr := s.DeleteAsset(undoCtx, asset.ID, AnyVersion)
+					if deleteErr != nil && !errors.Is(deleteErr, ErrNotFound) {
+						return fmt.Errorf("%w, and could not delete asset %s: %v", err, asset.ID, deleteErr)
+					}
+					return err
+				})
+			}
+		} else {
+			var undo func(context.Context, error) error
+			_, undo, err = s.dispose(ctx, *trade.Sell)
+			if err == nil {
+				undos = append(undos, undo)
+			}
+		}
+		if err != nil {
+			err = importError(trade, err)
+			break
+		}
+	}
+	if err == nil || inTransaction(ctx) {
+		return err
+	}
+	undoCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := len(undos) - 1; i >= 0; i-- {
+		err = undos[i](undoCtx, err)
+	}
+	return err
+}
+
+func (s *MongoStore) ListUsers(ctx context.Context) ([]User, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "username", Value: 1}})
+	cursor, err := s.db.Collection("users").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (s *MongoStore) FindUserByUsername(ctx context.Context, username string) (User, error) {
+	var user User
+	err := s.db.Collection("users").FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *MongoStore) CreateUser(ctx context.Context, user User) (User, error) {
+	user.ID = ""
+	result, err := s.db.Collection("users").InsertOne(ctx, &user)
+	if mongo.IsDuplicateKeyError(err) {
+		return user, ErrUsernameTaken
+	}
+	if err != nil {
+		return user, err
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		user.ID = id.Hex()
+	}
+	return user, nil
+}
+
+func (s *MongoStore) SetPasswordHash(ctx context.Context, id string, passwordHash string) error {
+	userId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrInvalidID
+	}
+	result, err := s.db.Collection("users").UpdateOne(ctx, bson.M{"_id": userId}, bson.M{"$set": bson.M{"passwordHash": passwordHash}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) ListTokens(ctx context.Context, userID string) ([]APIToken, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := s.db.Collection("api_tokens").Find(ctx, bson.M{"userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []APIToken{}
+	err = cursor.All(ctx, &tokens)
+	return tokens, err
+}
+
+func (s *MongoStore) CreateToken(ctx context.Context, token APIToken) (APIToken, error) {
+	token.ID = ""
+	result, err := s.db.Collection("api_tokens").InsertOne(ctx, &token)
+	if err != nil {
+		return token, err
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		token.ID = id.Hex()
+	}
+	return token, nil
+}
+
+func (s *MongoStore) FindToken(ctx context.Context, tokenHash string) (APIToken, User, error) {
+	var token APIToken
+	var user User
+	err := s.db.Collection("api_tokens").FindOne(ctx, bson.M{"tokenHash": tokenHash}).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return token, user, ErrNotFound
+	} else if err != nil {
+		return token, user, err
+	}
+	userId, err := primitive.ObjectIDFromHex(token.UserID)
+	if err != nil {
+		return token, user, ErrNotFound
+	}
+	err = s.db.Collection("users").FindOne(ctx, bson.M{"_id": userId}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return token, user, ErrNotFound
+	}
+	return token, user, err
+}
+
+func (s *MongoStore) DeleteToken(ctx context.Context, userID string, id string) error {
+	tokenId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	result, err := s.db.Collection("api_tokens").DeleteOne(ctx, bson.M{"_id": tokenId, "userId": userID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
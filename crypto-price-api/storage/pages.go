@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Fields assets can be sorted by, named as in the `assets` collection
+const (
+	AssetSortPurchaseTime  = "purchaseTime"
+	AssetSortSaleTime      = "saleTime"
+	AssetSortAmount        = "amount"
+	AssetSortPurchasePrice = "purchasePrice"
+)
+
+// Whether assets can be sorted by field
+func ValidAssetSort(field string) bool {
+	switch field {
+	case AssetSortPurchaseTime, AssetSortSaleTime, AssetSortAmount, AssetSortPurchasePrice:
+		return true
+	}
+	return false
+}
+
+// Position after the last item of a page. Pages are ordered by a sort field,
+// then by ID so items with the same value are neither skipped nor repeated
+type Cursor struct {
+	// Sort field value and ID of the last item
+	Value float64
+	ID    string
+}
+
+// Filters, order and size of a page of assets
+type AssetQuery struct {
+	// Empty matches the assets of every user
+	OwnerID string
+	// Crypto name and status, empty matches any
+	Name   string
+	Status string
+	// Inclusive bounds of the purchase time. 0 is unbounded
+	From int64
+	To   int64
+	// One of the AssetSort fields. Default AssetSortPurchaseTime
+	SortBy     string
+	Descending bool
+	// Start after this position, nil for the first page
+	After *Cursor
+	// Largest page, 0 for every match
+	Limit int64
+}
+
+// Page of assets
+type AssetPage struct {
+	Assets []Asset
+	// Number of assets matching the filters, on every page
+	Total int64
+	// Position to request the next page from, nil on the last page
+	Next *Cursor
+}
+
+// Filters, order and size of a page of price changes, ordered by time
+type PriceChangeQuery struct {
+	Name string
+	// Inclusive bounds of the tick time. 0 is unbounded
+	From int64
+	To   int64
+	// Newest first instead of oldest first
+	Descending bool
+	// Start after this position, nil for the first page
+	After *Cursor
+	// Largest page, 0 for every match
+	Limit int64
+}
+
+// Page of price changes
+type PriceChangePage struct {
+	Changes []PriceChange
+	// Number of ticks matching the filters, on every page
+	Total int64
+	// Position to request the next page from, nil on the last page
+	Next *Cursor
+}
+
+// Sort field of an asset query, defaulting to the purchase time
+func (q AssetQuery) sortField() string {
+	if q.SortBy == "" {
+		return AssetSortPurchaseTime
+	}
+	return q.SortBy
+}
+
+// Value of an asset's sort field
+func assetSortValue(asset Asset, field string) float64 {
+	switch field {
+	case AssetSortSaleTime:
+		return float64(asset.SaleTime)
+	case AssetSortAmount:
+		return float64(asset.Amount)
+	case AssetSortPurchasePrice:
+		return float64(asset.PurchasePrice)
+	}
+	return float64(asset.PurchaseTime)
+}
+
+// Whether an asset matches the filters of a query, ignoring its cursor
+func (q AssetQuery) matches(asset Asset) bool {
+	purchaseTime := int64(asset.PurchaseTime)
+	return (q.OwnerID == "" || asset.OwnerID == q.OwnerID) &&
+		(q.Name == "" || asset.Name == q.Name) &&
+		(q.Status == "" || asset.Status == q.Status) &&
+		(q.From == 0 || purchaseTime >= q.From) &&
+		(q.To == 0 || purchaseTime <= q.To)
+}
+
+// Whether the item at c comes before the item at other in a page order
+func (c Cursor) before(other Cursor, descending bool) bool {
+	if c.Value != other.Value {
+		return (c.Value < other.Value) != descending
+	}
+	return (c.ID < other.ID) != descending
+}
+
+// Bounds of the page of n sorted items starting after a cursor, and the cursor of
+// the next page. key returns the sort value and ID of an item
+func pageBounds(n int, key func(i int) Cursor, after *Cursor, descending bool, limit int64) (int, int, *Cursor) {
+	start := 0
+	if after != nil {
+		start = sort.Search(n, func(i int) bool {
+			return after.before(key(i), descending)
+		})
+	}
+	end := n
+	if limit > 0 && int64(end-start) > limit {
+		end = start + int(limit)
+	}
+	if end == n || end == start {
+		return start, end, nil
+	}
+	next := key(end - 1)
+	return start, end, &next
+}
+
+// Length of a page fetched with one item more than limit, and the cursor of the
+// next page. key returns the sort value and ID of an item
+func pageEnd(n int, limit int64, key func(i int) Cursor) (int, *Cursor) {
+	if limit <= 0 || int64(n) <= limit {
+		return n, nil
+	}
+	next := key(int(limit) - 1)
+	return int(limit), &next
+}
+
+// Check the sort field of an asset query
+func validateAssetQuery(query AssetQuery) error {
+	if query.SortBy != "" && !ValidAssetSort(query.SortBy) {
+		return fmt.Errorf("cannot sort assets by %q", query.SortBy)
+	}
+	return nil
+}
@@ -0,0 +1,781 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Tables mirroring the Mongo collections. Created by every service using the
+// SQLite backend, so keep in sync with the producer and change tracker.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS prices (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	price REAL NOT NULL,
+	time INTEGER,
+	previous_price REAL
+);
+CREATE TABLE IF NOT EXISTS price_changes_over_time (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	last_price REAL NOT NULL,
+	price_change REAL NOT NULL,
+	time INTEGER NOT NULL,
+	stale INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (name, time, last_price)
+);
+CREATE INDEX IF NOT EXISTS price_changes_over_time_time ON price_changes_over_time (time);
+CREATE TABLE IF NOT EXISTS assets (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	amount REAL NOT NULL,
+	purchase_price REAL NOT NULL,
+	purchase_time REAL NOT NULL,
+	status TEXT NOT NULL,
+	sale_price REAL NOT NULL,
+	sale_time REAL NOT NULL
+);
+`
+
+// Changes to the API tables after sqliteSchema, applied in order and tracked with
+// PRAGMA user_version. Assets are only used by the API, so other services do not
+// need these.
+var sqliteMigrations = []string{
+	// Optimistic concurrency for asset updates
+	`ALTER TABLE assets ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+	// Fees and lots split by partial sales
+	`ALTER TABLE assets ADD COLUMN purchase_fee REAL NOT NULL DEFAULT 0;
+	ALTER TABLE assets ADD COLUMN sale_fee REAL NOT NULL DEFAULT 0;
+	ALTER TABLE assets ADD COLUMN parent_id TEXT;`,
+	// Sales matched to held lots by cost basis method
+	`CREATE TABLE disposals (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		amount REAL NOT NULL,
+		price REAL NOT NULL,
+		time REAL NOT NULL,
+		fee REAL NOT NULL,
+		method TEXT NOT NULL,
+		cost_basis REAL NOT NULL,
+		proceeds REAL NOT NULL,
+		gain REAL NOT NULL
+	);
+	CREATE INDEX disposals_name_time ON disposals (name, time);
+	CREATE TABLE lot_matches (
+		disposal_id TEXT NOT NULL REFERENCES disposals (id),
+		position INTEGER NOT NULL,
+		lot_id TEXT NOT NULL,
+		asset_id TEXT NOT NULL,
+		amount REAL NOT NULL,
+		purchase_price REAL NOT NULL,
+		purchase_time REAL NOT NULL,
+		cost_basis REAL NOT NULL,
+		proceeds REAL NOT NULL,
+		gain REAL NOT NULL,
+		PRIMARY KEY (disposal_id, position)
+	);`,
+	// Trades imported from exchange exports
+	`ALTER TABLE assets ADD COLUMN import_id TEXT;
+	CREATE UNIQUE INDEX assets_import_id ON assets (import_id);
+	ALTER TABLE disposals ADD COLUMN import_id TEXT;
+	CREATE UNIQUE INDEX disposals_import_id ON disposals (import_id);`,
+	// User accounts. Existing assets and disposals belong to the default user
+	`CREATE TABLE users (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE api_tokens (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES users (id),
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		read_only INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX api_tokens_user_id ON api_tokens (user_id);
+	INSERT INTO users (id, username, password_hash, role, created_at)
+	VALUES ('` + DefaultUserID + `', '` + DefaultUserUsername + `', '', '` + RoleAdmin + `', strftime('%s', 'now'));
+	ALTER TABLE assets ADD COLUMN owner_id TEXT NOT NULL DEFAULT '` + DefaultUserID + `';
+	CREATE INDEX assets_owner_id ON assets (owner_id, purchase_time);
+	ALTER TABLE disposals ADD COLUMN owner_id TEXT NOT NULL DEFAULT '` + DefaultUserID + `';
+	DROP INDEX assets_import_id;
+	CREATE UNIQUE INDEX assets_import_id ON assets (owner_id, import_id);
+	DROP INDEX disposals_import_id;
+	CREATE UNIQUE INDEX disposals_import_id ON disposals (owner_id, import_id);`,
+	// Filtered pages of assets. Price changes are paged with their (name, time, last_price) unique index
+	`CREATE INDEX assets_owner_status ON assets (owner_id, status, purchase_time);
+	CREATE INDEX assets_owner_name ON assets (owner_id, name, purchase_time);`,
+}
+
+// Store backed by an SQLite database file, for lightweight deployments
+type SQLStore struct {
+	db *sql.DB
+}
+
+// Open an SQLite database, creating the tables if they do not exist.
+// WAL mode and a busy timeout let several services share the file.
+func OpenSQLite(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// Apply the migrations newer than the user_version of the database
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteMigrations[version]); err == nil {
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("SQLite migration %d failed: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) ListPrices(ctx context.Context) ([]Price, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, price, COALESCE(time, 0) FROM prices ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := []Price{}
+	for rows.Next() {
+		var price Price
+		if err = rows.Scan(&price.ID, &price.Name, &price.Price, &price.Time); err != nil {
+			return nil, err
+		}
+		prices = append(prices, price)
+	}
+	return prices, rows.Err()
+}
+
+func (s *SQLStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	var price Price
+	row := s.db.QueryRowContext(ctx, `SELECT id, name, price, COALESCE(time, 0) FROM prices WHERE name = ?`, name)
+	err := row.Scan(&price.ID, &price.Name, &price.Price, &price.Time)
+	if errors.Is(err, sql.ErrNoRows) {
+		return price, ErrNotFound
+	}
+	return price, err
+}
+
+// Order and keyset condition of a page sorted by column then id
+func sqlitePageOrder(column string, descending bool, after *Cursor) (string, string, []any) {
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+	order := fmt.Sprintf("%s %s, id %s", column, direction, direction)
+	if after == nil {
+		return order, "", nil
+	}
+	condition := fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, comparison, column, comparison)
+	return order, condition, []any{after.Value, after.Value, after.ID}
+}
+
+// Limit of a page query, fetching one more row to tell whether there is a next page
+func sqlitePageLimit(limit int64) int64 {
+	if limit <= 0 {
+		return -1
+	}
+	return limit + 1
+}
+
+func (s *SQLStore) ListPriceChanges(ctx context.Context, query PriceChangeQuery) (PriceChangePage, error) {
+	page := PriceChangePage{Changes: []PriceChange{}}
+	conditions := []string{"name = ?"}
+	args := []any{query.Name}
+	if query.From != 0 {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, query.From)
+	}
+	if query.To != 0 {
+		conditions = append(conditions, "time <= ?")
+		args = append(args, query.To)
+	}
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM price_changes_over_time WHERE `+strings.Join(conditions, " AND "),
+		args...).Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+	order, after, afterArgs := sqlitePageOrder("time", query.Descending, query.After)
+	if after != "" {
+		conditions = append(conditions, after)
+		args = append(args, afterArgs...)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, last_price, price_change, time, stale FROM price_changes_over_time
+		WHERE `+strings.Join(conditions, " AND ")+` ORDER BY `+order+` LIMIT ?`,
+		append(args, sqlitePageLimit(query.Limit))...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change PriceChange
+		if err = rows.Scan(&change.ID, &change.Name, &change.Price, &change.PriceChange, &change.Time, &change.Stale); err != nil {
+			return page, err
+		}
+		page.Changes = append(page.Changes, change)
+	}
+	end, next := pageEnd(len(page.Changes), query.Limit, func(i int) Cursor {
+		return Cursor{float64(page.Changes[i].Time), page.Changes[i].ID}
+	})
+	page.Changes, page.Next = page.Changes[:end], next
+	return page, rows.Err()
+}
+
+const assetColumns = `id, owner_id, name, amount, purchase_price, purchase_time, status, sale_price, sale_time,
+	purchase_fee, sale_fee, COALESCE(parent_id, ''), COALESCE(import_id, ''), version`
+
+func scanAsset(row interface{ Scan(...any) error }) (Asset, error) {
+	var asset Asset
+	err := row.Scan(&asset.ID, &asset.OwnerID, &asset.Name, &asset.Amount, &asset.PurchasePrice, &asset.PurchaseTime, &asset.Status,
+		&asset.SalePrice, &asset.SaleTime, &asset.PurchaseFee, &asset.SaleFee, &asset.ParentID, &asset.ImportID, &asset.Version)
+	return asset, err
+}
+
+// Runs statements on the database or in a transaction
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *SQLStore) ListAssets(ctx context.Context, ownerID string) ([]Asset, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+assetColumns+` FROM assets WHERE ? = '' OR owner_id = ? ORDER BY purchase_time DESC`,
+		ownerID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	assets := []Asset{}
+	for rows.Next() {
+		asset, err := scanAsset(rows)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+func findSQLAsset(ctx context.Context, q sqlQuerier, id string) (Asset, error) {
+	if err := validateID(id); err != nil {
+		return Asset{}, err
+	}
+	asset, err := scanAsset(q.QueryRowContext(ctx, `SELECT `+assetColumns+` FROM assets WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return asset, ErrNotFound
+	}
+	return asset, err
+}
+
+// Columns of the AssetSort fields
+var sqliteAssetSortColumns = map[string]string{
+	AssetSortPurchaseTime:  "purchase_time",
+	AssetSortSaleTime:      "sale_time",
+	AssetSortAmount:        "amount",
+	AssetSortPurchasePrice: "purchase_price",
+}
+
+func (s *SQLStore) FindAssets(ctx context.Context, query AssetQuery) (AssetPage, error) {
+	page := AssetPage{Assets: []Asset{}}
+	if err := validateAssetQuery(query); err != nil {
+		return page, err
+	}
+	conditions := []string{"1 = 1"}
+	args := []any{}
+	for _, filter := range [][2]string{{"owner_id", query.OwnerID}, {"name", query.Name}, {"status", query.Status}} {
+		if filter[1] != "" {
+			conditions = append(conditions, filter[0]+" = ?")
+			args = append(args, filter[1])
+		}
+	}
+	if query.From != 0 {
+		conditions = append(conditions, "purchase_time >= ?")
+		args = append(args, query.From)
+	}
+	if query.To != 0 {
+		conditions = append(conditions, "purchase_time <= ?")
+		args = append(args, query.To)
+	}
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM assets WHERE `+strings.Join(conditions, " AND "), args...).Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+	field := query.sortField()
+	order, after, afterArgs := sqlitePageOrder(sqliteAssetSortColumns[field], query.Descending, query.After)
+	if after != "" {
+		conditions = append(conditions, after)
+		args = append(args, afterArgs...)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+assetColumns+` FROM assets WHERE `+strings.Join(conditions, " AND ")+
+		` ORDER BY `+order+` LIMIT ?`, append(args, sqlitePageLimit(query.Limit))...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		asset, err := scanAsset(rows)
+		if err != nil {
+			return page, err
+		}
+		page.Assets = append(page.Assets, asset)
+	}
+	end, next := pageEnd(len(page.Assets), query.Limit, func(i int) Cursor {
+		return Cursor{assetSortValue(page.Assets[i], field), page.Assets[i].ID}
+	})
+	page.Assets, page.Next = page.Assets[:end], next
+	return page, rows.Err()
+}
+
+func (s *SQLStore) FindAsset(ctx context.Context, id string) (Asset, error) {
+	return findSQLAsset(ctx, s.db, id)
+}
+
+func insertSQLAsset(ctx context.Context, q sqlQuerier, asset Asset) (Asset, error) {
+	asset.ID = newID()
+	asset.Version = 1
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO assets (id, owner_id, name, amount, purchase_price, purchase_time, status, sale_price, sale_time,
+			purchase_fee, sale_fee, parent_id, import_id, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?)`,
+		asset.ID, asset.OwnerID, asset.Name, asset.Amount, asset.PurchasePrice, asset.PurchaseTime, asset.Status, asset.SalePrice, asset.SaleTime,
+		asset.PurchaseFee, asset.SaleFee, asset.ParentID, asset.ImportID, asset.Version)
+	return asset, duplicateImportError(err)
+}
+
+// Report the unique index on import IDs rejecting a row as ErrDuplicateImport, as MongoStore does
+func duplicateImportError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrDuplicateImport
+	}
+	return err
+}
+
+func (s *SQLStore) CreateAsset(ctx context.Context, asset Asset) (Asset, error) {
+	return insertSQLAsset(ctx, s.db, asset)
+}
+
+// The held and sold parts of a partial sale are written in one transaction
+func (s *SQLStore) SellAsset(ctx context.Context, id string, sale Sale) (Asset, *Asset, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Asset{}, nil, err
+	}
+	defer tx.Rollback()
+	sold, held, err := sellSQLAsset(ctx, tx, id, sale)
+	if err != nil {
+		return sold, nil, err
+	}
+	return sold, held, tx.Commit()
+}
+
+func sellSQLAsset(ctx context.Context, q sqlQuerier, id string, sale Sale) (Asset, *Asset, error) {
+	current, err := findSQLAsset(ctx, q, id)
+	if err != nil {
+		return current, nil, err
+	}
+	sold, held, err := planSale(current, sale)
+	if err != nil {
+		return sold, nil, err
+	}
+	if held == nil {
+		sold, err = updateSQLAsset(ctx, q, sold)
+		return sold, nil, err
+	}
+	updated, err := updateSQLAsset(ctx, q, *held)
+	if err != nil {
+		return sold, nil, err
+	}
+	sold, err = insertSQLAsset(ctx, q, sold)
+	return sold, &updated, err
+}
+
+// Work out why a versioned write changed no asset
+func versionedSQLWriteError(ctx context.Context, q sqlQuerier, id string) error {
+	var count int
+	if err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM assets WHERE id = ?`, id).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionConflict
+}
+
+func updateSQLAsset(ctx context.Context, q sqlQuerier, asset Asset) (Asset, error) {
+	if err := validateID(asset.ID); err != nil {
+		return asset, err
+	}
+	result, err := q.ExecContext(ctx, `
+		UPDATE assets SET name = ?, amount = ?, purchase_price = ?, purchase_time = ?, status = ?,
+			sale_price = ?, sale_time = ?, purchase_fee = ?, sale_fee = ?, parent_id = NULLIF(?, ''),
+			version = version + 1
+		WHERE id = ? AND version = ?`,
+		asset.Name, asset.Amount, asset.PurchasePrice, asset.PurchaseTime, asset.Status,
+		asset.SalePrice, asset.SaleTime, asset.PurchaseFee, asset.SaleFee, asset.ParentID,
+		asset.ID, asset.Version)
+	if err != nil {
+		return asset, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return asset, err
+	}
+	if updated == 0 {
+		return asset, versionedSQLWriteError(ctx, q, asset.ID)
+	}
+	asset.Version++
+	return asset, nil
+}
+
+func (s *SQLStore) UpdateAsset(ctx context.Context, asset Asset) (Asset, error) {
+	return updateSQLAsset(ctx, s.db, asset)
+}
+
+func (s *SQLStore) DeleteAsset(ctx context.Context, id string, version int64) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, `DELETE FROM assets WHERE id = ? AND (? = ? OR version = ?)`, id, version, AnyVersion, version)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return versionedSQLWriteError(ctx, s.db, id)
+	}
+	return nil
+}
+
+// The lot sales and matches of a disposal are written in one transaction
+func (s *SQLStore) Dispose(ctx context.Context, disposal Disposal) (Disposal, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return disposal, err
+	}
+	defer tx.Rollback()
+	disposal, err = disposeSQL(ctx, tx, disposal)
+	if err != nil {
+		return disposal, err
+	}
+	return disposal, tx.Commit()
+}
+
+func disposeSQL(ctx context.Context, tx *sql.Tx, disposal Disposal) (Disposal, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+assetColumns+` FROM assets WHERE owner_id = ? AND name = ? AND status = 'held'`,
+		disposal.OwnerID, disposal.Name)
+	if err != nil {
+		return disposal, err
+	}
+	lots := []Asset{}
+	for rows.Next() {
+		lot, err := scanAsset(rows)
+		if err != nil {
+			rows.Close()
+			return disposal, err
+		}
+		lots = append(lots, lot)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return disposal, err
+	}
+	sales, averageCost, err := planDisposal(lots, disposal)
+	if err != nil {
+		return disposal, err
+	}
+	soldAssets := []Asset{}
+	for _, lotSale := range sales {
+		sold, _, err := sellSQLAsset(ctx, tx, lotSale.Lot.ID, lotSale.Sale)
+		if err != nil {
+			return disposal, err
+		}
+		soldAssets = append(soldAssets, sold)
+	}
+	disposal = completeDisposal(disposal, sales, soldAssets, averageCost)
+	disposal.ID = newID()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO disposals (id, owner_id, name, amount, price, time, fee, method, cost_basis, proceeds, gain, import_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
+		disposal.ID, disposal.OwnerID, disposal.Name, disposal.Amount, disposal.Price, disposal.Time, disposal.Fee, disposal.Method,
+		disposal.CostBasis, disposal.Proceeds, disposal.Gain, disposal.ImportID)
+	if err != nil {
+		return disposal, duplicateImportError(err)
+	}
+	for i, match := range disposal.Matches {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO lot_matches (disposal_id, position, lot_id, asset_id, amount, purchase_price, purchase_time,
+				cost_basis, proceeds, gain)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			disposal.ID, i, match.LotID, match.AssetID, match.Amount, match.PurchasePrice, match.PurchaseTime,
+			match.CostBasis, match.Proceeds, match.Gain)
+		if err != nil {
+			return disposal, err
+		}
+	}
+	return disposal, nil
+}
+
+func (s *SQLStore) ListDisposals(ctx context.Context, ownerID string, name string) ([]Disposal, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, owner_id, name, amount, price, time, fee, method, cost_basis, proceeds, gain, COALESCE(import_id, '')
+		FROM disposals WHERE owner_id = ? AND (? = '' OR name = ?) ORDER BY time DESC`, ownerID, name, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	disposals := []Disposal{}
+	// Index of each disposal by ID
+	positions := map[string]int{}
+	for rows.Next() {
+		disposal := Disposal{Matches: []LotMatch{}}
+		err = rows.Scan(&disposal.ID, &disposal.OwnerID, &disposal.Name, &disposal.Amount, &disposal.Price, &disposal.Time, &disposal.Fee,
+			&disposal.Method, &disposal.CostBasis, &disposal.Proceeds, &disposal.Gain, &disposal.ImportID)
+		if err != nil {
+			return nil, err
+		}
+		positions[disposal.ID] = len(disposals)
+		disposals = append(disposals, disposal)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	matchRows, err := s.db.QueryContext(ctx, `
+		SELECT m.disposal_id, m.lot_id, m.asset_id, m.amount, m.purchase_price, m.purchase_time,
+			m.cost_basis, m.proceeds, m.gain
+		FROM lot_matches m JOIN disposals d ON d.id = m.disposal_id
+		WHERE d.owner_id = ? AND (? = '' OR d.name = ?) ORDER BY m.disposal_id, m.position`, ownerID, name, name)
+	if err != nil {
+		return nil, err
+	}
+	defer matchRows.Close()
+	for matchRows.Next() {
+		var disposalID string
+		var match LotMatch
+		err = matchRows.Scan(&disposalID, &match.LotID, &match.AssetID, &match.Amount, &match.PurchasePrice, &match.PurchaseTime,
+			&match.CostBasis, &match.Proceeds, &match.Gain)
+		if err != nil {
+			return nil, err
+		}
+		if i, didFind := positions[disposalID]; didFind {
+			disposals[i].Matches = append(disposals[i].Matches, match)
+		}
+	}
+	return disposals, matchRows.Err()
+}
+
+func (s *SQLStore) ListImportIDs(ctx context.Context, ownerID string) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT import_id FROM assets WHERE owner_id = ? AND import_id IS NOT NULL
+		UNION SELECT import_id FROM disposals WHERE owner_id = ? AND import_id IS NOT NULL`, ownerID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	importIDs := map[string]bool{}
+	for rows.Next() {
+		var importID string
+		if err = rows.Scan(&importID); err != nil {
+			return nil, err
+		}
+		importIDs[importID] = true
+	}
+	return importIDs, rows.Err()
+}
+
+// Every trade is written in one transaction
+func (s *SQLStore) ImportTrades(ctx context.Context, trades []Trade) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, trade := range trades {
+		var count int
+		err = tx.QueryRowContext(ctx, `
+			SELECT (SELECT COUNT(*) FROM assets WHERE owner_id = ? AND import_id = ?)
+				+ (SELECT COUNT(*) FROM disposals WHERE owner_id = ? AND import_id = ?)`,
+			trade.OwnerID(), trade.ImportID(), trade.OwnerID(), trade.ImportID()).Scan(&count)
+		if err == nil && count > 0 {
+			err = ErrDuplicateImport
+		}
+		if err == nil && trade.Buy != nil {
+			_, err = insertSQLAsset(ctx, tx, *trade.Buy)
+		} else if err == nil {
+			_, err = disposeSQL(ctx, tx, *trade.Sell)
+		}
+		if err != nil {
+			return importError(trade, err)
+		}
+	}
+	return tx.Commit()
+}
+
+const userColumns = `id, username, password_hash, role, created_at`
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	return user, err
+}
+
+func (s *SQLStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLStore) FindUserByUsername(ctx context.Context, username string) (User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *SQLStore) CreateUser(ctx context.Context, user User) (User, error) {
+	user.ID = newID()
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (id, username, password_hash, role, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO NOTHING`,
+		user.ID, user.Username, user.PasswordHash, user.Role, user.CreatedAt)
+	if err != nil {
+		return user, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return user, err
+	} else if inserted == 0 {
+		return user, ErrUsernameTaken
+	}
+	return user, nil
+}
+
+func (s *SQLStore) SetPasswordHash(ctx context.Context, id string, passwordHash string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const tokenColumns = `id, user_id, name, token_hash, read_only, created_at, expires_at`
+
+func scanToken(row interface{ Scan(...any) error }) (APIToken, error) {
+	var token APIToken
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.ReadOnly, &token.CreatedAt, &token.ExpiresAt)
+	return token, err
+}
+
+func (s *SQLStore) ListTokens(ctx context.Context, userID string) ([]APIToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+tokenColumns+` FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []APIToken{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQLStore) CreateToken(ctx context.Context, token APIToken) (APIToken, error) {
+	token.ID = newID()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO api_tokens (`+tokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		token.ID, token.UserID, token.Name, token.TokenHash, token.ReadOnly, token.CreatedAt, token.ExpiresAt)
+	return token, err
+}
+
+func (s *SQLStore) FindToken(ctx context.Context, tokenHash string) (APIToken, User, error) {
+	token, err := scanToken(s.db.QueryRowContext(ctx, `SELECT `+tokenColumns+` FROM api_tokens WHERE token_hash = ?`, tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, User{}, ErrNotFound
+	} else if err != nil {
+		return token, User{}, err
+	}
+	user, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, token.UserID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return token, user, ErrNotFound
+	}
+	return token, user, err
+}
+
+func (s *SQLStore) DeleteToken(ctx context.Context, userID string, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Package storage provides repositories for prices, price changes and assets,
+// backed by MongoDB, SQLite or memory.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Backends selected by STORAGE_BACKEND
+const (
+	BackendMongo  = "mongo"
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+)
+
+var (
+	// Returned when a price or asset does not exist
+	ErrNotFound = errors.New("not found")
+	// Returned when an asset ID is not a valid ID
+	ErrInvalidID = errors.New("invalid ID")
+	// Returned when an asset was changed since the version being updated was read
+	ErrVersionConflict = errors.New("version conflict")
+	// Returned when selling an asset that is already sold
+	ErrAlreadySold = errors.New("asset already sold")
+	// Returned when selling more than the amount of an asset
+	ErrInsufficientAmount = errors.New("amount is more than the asset holds")
+	// Returned when selling an asset at a time before it was purchased
+	ErrSaleBeforePurchase = errors.New("sale time is before the purchase time")
+	// Returned when importing a trade that was already imported
+	ErrDuplicateImport = errors.New("trade already imported")
+)
+
+// Version passed to DeleteAsset to delete an asset whatever its version
+const AnyVersion int64 = -1
+
+// `prices` collection document structure
+type Price struct {
+	ID    string  `bson:"_id,omitempty"`
+	Name  string  `bson:"name"`
+	Price float32 `bson:"price"`
+	// Kafka event time of the last tick applied to the price
+	Time int64 `bson:"time,omitempty"`
+}
+
+// `price_changes_over_time` collection document structure
+type PriceChange struct {
+	ID          string  `bson:"_id,omitempty"`
+	Name        string  `bson:"name"`
+	Price       float32 `bson:"lastPrice"`
+	PriceChange float32 `bson:"priceChange"`
+	Time        int64   `bson:"time"`
+	Stale       bool    `bson:"stale,omitempty"`
+}
+
+// `assets` collection document structure
+type Asset struct {
+	ID string `bson:"_id,omitempty"`
+	// User the asset belongs to
+	OwnerID string `bson:"ownerId"`
+	// Crypto Name
+	Name string `bson:"name"`
+	// Crypto Amount
+	Amount float32 `bson:"amount"`
+	// Price at time crypto was checked
+	PurchasePrice float32 `bson:"purchasePrice"`
+	// Time that the crypto was purchased
+	PurchaseTime float32 `bson:"purchaseTime"`
+	// Whether the crypto is active. Valid values are "held" or "sold"
+	Status    string  `bson:"status"`
+	SalePrice float32 `bson:"salePrice"`
+	SaleTime  float32 `bson:"saleTime"`
+	// Exchange fees paid when buying and selling, in AUD
+	PurchaseFee float32 `bson:"purchaseFee"`
+	SaleFee     float32 `bson:"saleFee"`
+	// Asset this asset was split from when part of it was sold
+	ParentID string `bson:"parentId,omitempty"`
+	// Trade the asset was imported from, such as "kraken:TQ3ZUN-ABCDE-FGHIJK". Unique
+	ImportID string `bson:"importId,omitempty"`
+	// Incremented on every change, for optimistic concurrency. 0 for assets
+	// created before versioning
+	Version int64 `bson:"version"`
+}
+
+// Current crypto prices
+type PriceRepository interface {
+	ListPrices(ctx context.Context) ([]Price, error)
+	// Returns ErrNotFound when the crypto is not tracked
+	FindPrice(ctx context.Context, name string) (Price, error)
+}
+
+// History of crypto prices
+type PriceChangeRepository interface {
+	// Page of the ticks of a crypto matching a query
+	ListPriceChanges(ctx context.Context, query PriceChangeQuery) (PriceChangePage, error)
+}
+
+// Crypto assets held or sold
+type AssetRepository interface {
+	// Every asset of a user, or of every user when ownerID is empty, most recently purchased first
+	ListAssets(ctx context.Context, ownerID string) ([]Asset, error)
+	// Page of the assets matching a query
+	FindAssets(ctx context.Context, query AssetQuery) (AssetPage, error)
+	// Returns ErrNotFound when the asset does not exist
+	FindAsset(ctx context.Context, id string) (Asset, error)
+	// Returns the asset with its new ID
+	CreateAsset(ctx context.Context, asset Asset) (Asset, error)
+	// Sell some or all of a held asset. A partial sale splits the asset, keeping the
+	// rest held under the same ID and creating a sold asset for the amount sold.
+	// Returns the sold asset and the still held asset, nil when everything was sold.
+	// Returns ErrNotFound, ErrAlreadySold, ErrInsufficientAmount, ErrSaleBeforePurchase or ErrVersionConflict
+	SellAsset(ctx context.Context, id string, sale Sale) (Asset, *Asset, error)
+	// Replace an asset if it is still at asset.Version, keeping its owner. Returns the asset with its
+	// new version, ErrNotFound when the asset does not exist, or ErrVersionConflict
+	UpdateAsset(ctx context.Context, asset Asset) (Asset, error)
+	// Delete an asset if it is still at version, or at any version for AnyVersion.
+	// Returns ErrNotFound when the asset does not exist, or ErrVersionConflict
+	DeleteAsset(ctx context.Context, id string, version int64) error
+}
+
+// Sale of an asset
+type Sale struct {
+	// Amount sold, 0 sells the whole asset
+	Amount float32
+	Price  float32
+	Time   float32
+	Fee    float32
+	// Version the asset is expected to be at, or AnyVersion
+	Version int64
+}
+
+// Work out the result of a sale. The returned sold asset, or the held asset for
+// partial sales, keeps the version of current, so it can be written with UpdateAsset.
+// A partially sold asset has no ID yet
+func planSale(current Asset, sale Sale) (Asset, *Asset, error) {
+	if sale.Version != AnyVersion && sale.Version != current.Version {
+		return current, nil, ErrVersionConflict
+	}
+	if current.Status != "held" {
+		return current, nil, ErrAlreadySold
+	}
+	if sale.Amount > current.Amount {
+		return current, nil, ErrInsufficientAmount
+	}
+	if sale.Time < current.PurchaseTime {
+		return current, nil, ErrSaleBeforePurchase
+	}
+	sold := current
+	sold.Status = "sold"
+	sold.SalePrice = sale.Price
+	sold.SaleTime = sale.Time
+	sold.SaleFee = sale.Fee
+	if sale.Amount == 0 || sale.Amount == current.Amount {
+		return sold, nil, nil
+	}
+	// Split the purchase fee in proportion to the amount sold
+	ratio := sale.Amount / current.Amount
+	held := current
+	held.Amount = current.Amount - sale.Amount
+	held.PurchaseFee = current.PurchaseFee * (1 - ratio)
+	sold.ID = ""
+	sold.ParentID = current.ID
+	sold.ImportID = ""
+	sold.Amount = sale.Amount
+	sold.PurchaseFee = current.PurchaseFee * ratio
+	return sold, &held, nil
+}
+
+// All repositories of a backend
+type Store interface {
+	PriceRepository
+	PriceChangeRepository
+	AssetRepository
+	DisposalRepository
+	ImportRepository
+	UserRepository
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Storage configuration, read from environment variables by main
+type Config struct {
+	// One of "mongo", "sqlite" or "memory"
+	Backend  string
+	MongoURL string
+	// SQLite database file
+	SQLitePath string
+}
+
+// Open the store selected by config
+func Open(ctx context.Context, config Config) (Store, error) {
+	switch config.Backend {
+	case BackendMongo, "":
+		return OpenMongo(ctx, config.MongoURL)
+	case BackendSQLite:
+		return OpenSQLite(config.SQLitePath)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+// IDs are Mongo ObjectIDs in every backend, so they are valid when switching backends
+func newID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+func validateID(id string) error {
+	if !primitive.IsValidObjectID(id) {
+		return ErrInvalidID
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// Roles of a User
+const (
+	// Read and write their own assets, and manage users
+	RoleAdmin = "admin"
+	// Read and write their own assets
+	RoleUser = "user"
+	// Only read their own assets
+	RoleReadOnly = "read-only"
+)
+
+// User that assets created before accounts were added belong to. Created by the
+// migrations without a password, which is set from ADMIN_PASSWORD by the API
+const (
+	DefaultUserID       = "000000000000000000000001"
+	DefaultUserUsername = "admin"
+)
+
+// Returned when creating a user with a username that is already used
+var ErrUsernameTaken = errors.New("username already taken")
+
+// `users` collection document structure
+type User struct {
+	ID       string `bson:"_id,omitempty"`
+	Username string `bson:"username"`
+	// bcrypt hash. Empty when the user can only use API tokens
+	PasswordHash string `bson:"passwordHash"`
+	// RoleAdmin, RoleUser or RoleReadOnly
+	Role      string `bson:"role"`
+	CreatedAt int64  `bson:"createdAt"`
+}
+
+// `api_tokens` collection document structure. Only the SHA-256 hash of the token is stored
+type APIToken struct {
+	ID        string `bson:"_id,omitempty"`
+	UserID    string `bson:"userId"`
+	Name      string `bson:"name"`
+	TokenHash string `bson:"tokenHash"`
+	// Limits the token to reading, whatever the role of its user
+	ReadOnly  bool  `bson:"readOnly"`
+	CreatedAt int64 `bson:"createdAt"`
+	// Unix epoch, 0 for tokens that do not expire
+	ExpiresAt int64 `bson:"expiresAt"`
+}
+
+// Whether the token can be used at now
+func (t APIToken) Valid(now int64) bool {
+	return t.ExpiresAt == 0 || t.ExpiresAt > now
+}
+
+// Users and their API tokens
+type UserRepository interface {
+	// Every user, by username
+	ListUsers(ctx context.Context) ([]User, error)
+	// Returns ErrNotFound when no user has the username
+	FindUserByUsername(ctx context.Context, username string) (User, error)
+	// Returns the user with its new ID, or ErrUsernameTaken
+	CreateUser(ctx context.Context, user User) (User, error)
+	// Returns ErrNotFound when the user does not exist
+	SetPasswordHash(ctx context.Context, id string, passwordHash string) error
+	// Tokens of a user, newest first
+	ListTokens(ctx context.Context, userID string) ([]APIToken, error)
+	// Returns the token with its new ID
+	CreateToken(ctx context.Context, token APIToken) (APIToken, error)
+	// Returns the token with the hash and its user, or ErrNotFound. Expired tokens are returned too
+	FindToken(ctx context.Context, tokenHash string) (APIToken, User, error)
+	// Delete a token of a user. Returns ErrNotFound when the user has no such token
+	DeleteToken(ctx context.Context, userID string, id string) error
+}
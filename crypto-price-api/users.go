@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"crypto-price-api/metrics"
+	"crypto-price-api/storage"
+)
+
+// How long a token from /login can be used
+const loginTokenLifetime = 30 * 24 * time.Hour
+
+// Shortest password accepted for a user
+const minPasswordLength = 8
+
+// Compared against when logging in as an unknown user or a user without a
+// password, so the response takes as long as for a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// VM for a user. The password hash is never returned
+type UserVM struct {
+	UserId   string `json:"_id"`
+	Username string `json:"username"`
+	// "admin", "user" or "read-only"
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// VM for an API token. The token itself is only returned when it is created
+type TokenVM struct {
+	TokenId string `json:"_id"`
+	Name    string `json:"name"`
+	Token   string `json:"token,omitempty"`
+	// Only allows GET and HEAD requests, whatever the role of the user
+	ReadOnly  bool  `json:"readOnly"`
+	CreatedAt int64 `json:"createdAt"`
+	// Unix epoch, 0 when the token does not expire
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// VM for the result of logging in
+type LoginVM struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+	User      UserVM `json:"user"`
+}
+
+func userToVM(user storage.User) UserVM {
+	return UserVM{
+		UserId:    user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+func tokenToVM(token storage.APIToken) TokenVM {
+	return TokenVM{
+		TokenId:   token.ID,
+		Name:      token.Name,
+		ReadOnly:  token.ReadOnly,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+}
+
+// Hash a new password, or return a FieldError when it is too short
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fieldError("password", "password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Create a token for a user, returning it with the plaintext token set
+func createToken(ctx context.Context, user storage.User, name string, readOnly bool, lifetime time.Duration) (TokenVM, error) {
+	token, err := newToken()
+	if err != nil {
+		return TokenVM{}, err
+	}
+	now := time.Now()
+	apiToken := storage.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		TokenHash: hashToken(token),
+		ReadOnly:  readOnly,
+		CreatedAt: now.Unix(),
+	}
+	if lifetime > 0 {
+		apiToken.ExpiresAt = now.Add(lifetime).Unix()
+	}
+	apiToken, err = Store.CreateToken(ctx, apiToken)
+	if err != nil {
+		return TokenVM{}, err
+	}
+	result := tokenToVM(apiToken)
+	result.Token = token
+	return result, nil
+}
+
+// Set the password of the default admin user when it has none, so the API can be logged in to
+func initAdminPassword(ctx context.Context, password string) error {
+	admin, err := Store.FindUserByUsername(ctx, storage.DefaultUserUsername)
+	if err != nil || admin.PasswordHash != "" {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return Store.SetPasswordHash(ctx, admin.ID, hash)
+}
+
+// Log in with a username and password, creating an API token valid for 30 days.
+// Required fields are:
+//
+//	username string
+//	password string
+//
+// POST /login
+// Returns: LoginVM
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/login").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	// Limit request size to 10MB (more than enough!)
+	r.ParseMultipartForm(10 << 20)
+	username, err := requiredParam(r, "username")
+	if err != nil {
+		writeServerError(w, "Logging in", err)
+		return
+	}
+	password, err := requiredParam(r, "password")
+	if err != nil {
+		writeServerError(w, "Logging in", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	user, err := Store.FindUserByUsername(ctx, username)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		writeServerError(w, "Logging in", err)
+		return
+	}
+	// Users without a password can only use API tokens
+	passwordHash := dummyPasswordHash
+	if err == nil && user.PasswordHash != "" {
+		passwordHash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil || err != nil || user.PasswordHash == "" {
+		writeUnauthorized(w, "Invalid username or password")
+		return
+	}
+	token, err := createToken(ctx, user, "login", false, loginTokenLifetime)
+	if err != nil {
+		writeServerError(w, "Logging in", err)
+		return
+	}
+	fmt.Printf("User [%s] logged in\n", user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginVM{Token: token.Token, ExpiresAt: token.ExpiresAt, User: userToVM(user)})
+}
+
+// Return the user of the API token
+// GET /me
+// Returns: UserVM
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/me").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userToVM(requestUser(r)))
+}
+
+// Handler for /users route. Admin only
+// GET /users: Returns []UserVM
+// POST /users: Create a user. Required fields are username and password, role is
+// "admin", "user" (default) or "read-only". Returns UserVM
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/users").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		users, err := Store.ListUsers(ctx)
+		if err != nil {
+			writeServerError(w, "Looking up users", err)
+			return
+		}
+		results := []UserVM{}
+		for _, user := range users {
+			results = append(results, userToVM(user))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	case http.MethodPost:
+		// Limit request size to 10MB (more than enough!)
+		r.ParseMultipartForm(10 << 20)
+		user := storage.User{Role: storage.RoleUser, CreatedAt: time.Now().Unix()}
+		if err := formString(r, "username", true, &user.Username); err != nil {
+			writeServerError(w, "Creating user", err)
+			return
+		}
+		if err := formString(r, "role", false, &user.Role); err != nil {
+			writeServerError(w, "Creating user", err)
+			return
+		}
+		if user.Role != storage.RoleAdmin && user.Role != storage.RoleUser && user.Role != storage.RoleReadOnly {
+			writeFieldError(w, fieldError("role", "role must be admin, user or read-only"))
+			return
+		}
+		hash, err := hashPassword(r.FormValue("password"))
+		if err != nil {
+			writeServerError(w, "Creating user", err)
+			return
+		}
+		user.PasswordHash = hash
+		user, err = Store.CreateUser(ctx, user)
+		if err != nil {
+			writeServerError(w, "Creating user", err)
+			return
+		}
+		fmt.Printf("Created %s user [%s]\n", user.Role, user.Username)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(userToVM(user))
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// Handler for /tokens routes, managing the API tokens of the user of the request
+// GET /tokens: Returns []TokenVM, without the tokens
+// POST /tokens: Create a token. Required field is name. Optional fields are
+// readOnly bool (default false) and expiresIn, a Go duration such as 2160h
+// (default never). Returns TokenVM with the token, which can not be looked up again
+// DELETE /tokens/{id}: Revoke a token
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	requestStartTime := time.Now()
+	metrics.HTTPRequestCounter.WithLabelValues("/tokens").Inc()
+	defer func() {
+		metrics.HTTPRequestDuration.Observe(time.Since(requestStartTime).Seconds())
+	}()
+	user := requestUser(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	tokenId := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+	if tokenId != "" {
+		if r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		if err := Store.DeleteToken(ctx, user.ID, tokenId); err != nil {
+			writeServerError(w, "Revoking token", err)
+			return
+		}
+		fmt.Printf("Revoked token [%s] of [%s]\n", tokenId, user.Username)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := Store.ListTokens(ctx, user.ID)
+		if err != nil {
+			writeServerError(w, "Looking up tokens", err)
+			return
+		}
+		results := []TokenVM{}
+		for _, token := range tokens {
+			results = append(results, tokenToVM(token))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	case http.MethodPost:
+		// Limit request size to 10MB (more than enough!)
+		r.ParseMultipartForm(10 << 20)
+		name, err := requiredParam(r, "name")
+		if err != nil {
+			writeServerError(w, "Creating token", err)
+			return
+		}
+		readOnly := false
+		if value := r.FormValue("readOnly"); value != "" {
+			if readOnly, err = strconv.ParseBool(value); err != nil {
+				writeFieldError(w, fieldError("readOnly", "readOnly must be true or false"))
+				return
+			}
+		}
+		var lifetime time.Duration
+		if value := r.FormValue("expiresIn"); value != "" {
+			if lifetime, err = time.ParseDuration(value); err != nil || lifetime <= 0 {
+				writeFieldError(w, fieldError("expiresIn", "expiresIn must be a positive duration such as 2160h"))
+				return
+			}
+		}
+		token, err := createToken(ctx, user, name, readOnly, lifetime)
+		if err != nil {
+			writeServerError(w, "Creating token", err)
+			return
+		}
+		fmt.Printf("Created token [%s] for [%s]\n", token.Name, user.Username)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(token)
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Return a required query or form field, or a FieldError when it is empty
+func requiredParam(r *http.Request, field string) (string, error) {
+	value := r.FormValue(field)
+	if value == "" {
+		return "", fieldError(field, "%s is required", field)
+	}
+	return value, nil
+}
+
+// Parse a required float form field
+func parseFormFloat32(r *http.Request, field string) (float32, error) {
+	value, err := strconv.ParseFloat(r.FormValue(field), 32)
+	if err != nil {
+		return 0, fieldError(field, "%s must be a number", field)
+	}
+	return float32(value), nil
+}
+
+// Parse an optional Go duration query parameter, e.g. "168h"
+func parseDurationParam(r *http.Request, field string, defaultValue time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get(field)
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fieldError(field, "%s must be a positive duration such as 168h", field)
+	}
+	return duration, nil
+}
+
+// Parse an optional time query parameter given as a Unix epoch or RFC3339 string. Empty returns 0
+func parseTimeParam(r *http.Request, field string) (int64, error) {
+	value := r.URL.Query().Get(field)
+	if value == "" {
+		return 0, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fieldError(field, "%s must be a Unix epoch or RFC3339 time", field)
+	}
+	return parsed.Unix(), nil
+}
+
+// Parse the optional from and to query parameters of a time range. to of 0 means unbounded
+func parseTimeRange(r *http.Request) (int64, int64, error) {
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		return 0, 0, err
+	}
+	if to > 0 && to < from {
+		return 0, 0, fieldError("to", "to must not be before from")
+	}
+	return from, to, nil
+}
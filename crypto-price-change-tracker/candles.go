@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Rollup interval and the collection its OHLC candles are stored in
+type CandleInterval struct {
+	Name       string
+	Seconds    int64
+	Collection string
+}
+
+// Rollups maintained by the tracker. Raw ticks live in `price_changes_over_time`
+var candleIntervals = []CandleInterval{
+	{Name: "1m", Seconds: 60, Collection: "price_candles_1m"},
+	{Name: "1h", Seconds: 60 * 60, Collection: "price_candles_1h"},
+	{Name: "1d", Seconds: 24 * 60 * 60, Collection: "price_candles_1d"},
+}
+
+// `price_candles_*` collection document structure
+type PriceCandleDB struct {
+	ID   string `bson:"_id,omitempty"`
+	Name string `bson:"name"`
+	// Start of the bucket, Unix epoch aligned to the interval in UTC
+	Start int64   `bson:"start"`
+	Open  float32 `bson:"open"`
+	High  float32 `bson:"high"`
+	Low   float32 `bson:"low"`
+	Close float32 `bson:"close"`
+	// Event times of the ticks used for open and close
+	OpenTime  int64 `bson:"openTime"`
+	CloseTime int64 `bson:"closeTime"`
+	// Number of ticks in the bucket
+	Count int64 `bson:"count"`
+}
+
+// Start of the bucket containing checkedAt
+func candleStart(checkedAt int64, seconds int64) int64 {
+	return checkedAt - checkedAt%seconds
+}
+
+// Fold a single tick into the 1m, 1h and 1d candles of a crypto.
+// Uses an update pipeline so open and close are chosen by event time, which
+// keeps candles correct when ticks arrive out of order.
+// Counts are not idempotent, so it is only called for ticks newly recorded by updateDatabase.
+func updateCandles(cryptoId string, price float32, checkedAt int64, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, interval := range candleIntervals {
+		start := candleStart(checkedAt, interval.Seconds)
+		filter := bson.M{"name": cryptoId, "start": start}
+		// Missing fields mean this is the first tick in the bucket
+		isFirst := bson.M{"$eq": bson.A{bson.M{"$type": "$count"}, "missing"}}
+		isEarliest := bson.M{"$or": bson.A{isFirst, bson.M{"$lt": bson.A{checkedAt, "$openTime"}}}}
+		isLatest := bson.M{"$or": bson.A{isFirst, bson.M{"$gte": bson.A{checkedAt, "$closeTime"}}}}
+		update := bson.A{
+			bson.M{"$set": bson.M{
+				"open":      bson.M{"$cond": bson.A{isEarliest, price, "$open"}},
+				"openTime":  bson.M{"$cond": bson.A{isEarliest, checkedAt, "$openTime"}},
+				"close":     bson.M{"$cond": bson.A{isLatest, price, "$close"}},
+				"closeTime": bson.M{"$cond": bson.A{isLatest, checkedAt, "$closeTime"}},
+				"high":      bson.M{"$max": bson.A{"$high", price}},
+				"low":       bson.M{"$min": bson.A{"$low", price}},
+				"count":     bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$count", 0}}, 1}},
+			}},
+		}
+		collection := client.Database("crypto").Collection(interval.Collection)
+		_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err != nil {
+			log.Printf("Could not update %s candle for %s: %v\n", interval.Name, cryptoId, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Regenerate candles from the raw ticks in `price_changes_over_time`.
+// If cryptoId is not empty only candles for that crypto are rebuilt. from and to
+// limit the rebuild to candles overlapping [from, to), where 0 means unbounded.
+// Ticks older than the retention period are pruned, so candles starting before the
+// oldest remaining tick are kept rather than rebuilt from part of their ticks.
+func rebuildCandles(cryptoId string, from int64, to int64, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	ticks := client.Database("crypto").Collection("price_changes_over_time")
+	oldestFilter := bson.M{}
+	if cryptoId != "" {
+		oldestFilter["name"] = cryptoId
+	}
+	var oldest struct {
+		Time int64 `bson:"time"`
+	}
+	err := ticks.FindOne(ctx, oldestFilter, options.FindOne().SetSort(bson.D{{Key: "time", Value: 1}})).Decode(&oldest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		log.Println("No raw ticks to rebuild candles from")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, interval := range candleIntervals {
+		// Widen the window to whole buckets, so edge candles include every tick,
+		// but never before the first whole bucket of remaining ticks
+		firstStart := candleStart(oldest.Time+interval.Seconds-1, interval.Seconds)
+		if from > 0 && candleStart(from, interval.Seconds) > firstStart {
+			firstStart = candleStart(from, interval.Seconds)
+		}
+		bucketRange := bson.M{"$gte": firstStart}
+		if to > 0 {
+			bucketRange["$lt"] = candleStart(to-1, interval.Seconds) + interval.Seconds
+		}
+		candleFilter := bson.M{}
+		tickFilter := bson.M{}
+		if cryptoId != "" {
+			candleFilter["name"] = cryptoId
+			tickFilter["name"] = cryptoId
+		}
+		if len(bucketRange) > 0 {
+			candleFilter["start"] = bucketRange
+			tickFilter["time"] = bucketRange
+		}
+		collection := client.Database("crypto").Collection(interval.Collection)
+		deleted, err := collection.DeleteMany(ctx, candleFilter)
+		if err != nil {
+			log.Printf("Could not clear %s candles: %v\n", interval.Name, err)
+			return err
+		}
+		log.Printf("Removed %d %s candles\n", deleted.DeletedCount, interval.Name)
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: tickFilter}},
+			{{Key: "$sort", Value: bson.D{{Key: "time", Value: 1}}}},
+			{{Key: "$group", Value: bson.M{
+				"_id": bson.M{
+					"name":  "$name",
+					"start": bson.M{"$subtract": bson.A{"$time", bson.M{"$mod": bson.A{"$time", interval.Seconds}}}},
+				},
+				"open":      bson.M{"$first": "$lastPrice"},
+				"high":      bson.M{"$max": "$lastPrice"},
+				"low":       bson.M{"$min": "$lastPrice"},
+				"close":     bson.M{"$last": "$lastPrice"},
+				"openTime":  bson.M{"$first": "$time"},
+				"closeTime": bson.M{"$last": "$time"},
+				"count":     bson.M{"$sum": 1},
+			}}},
+			{{Key: "$project", Value: bson.M{
+				"_id":       0,
+				"name":      "$_id.name",
+				"start":     "$_id.start",
+				"open":      1,
+				"high":      1,
+				"low":       1,
+				"close":     1,
+				"openTime":  1,
+				"closeTime": 1,
+				"count":     1,
+			}}},
+			{{Key: "$merge", Value: bson.M{
+				"into":           interval.Collection,
+				"on":             bson.A{"name", "start"},
+				"whenMatched":    "replace",
+				"whenNotMatched": "insert",
+			}}},
+		}
+		cursor, err := ticks.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			log.Printf("Could not rebuild %s candles: %v\n", interval.Name, err)
+			return err
+		}
+		cursor.Close(ctx)
+		rebuilt, err := collection.CountDocuments(ctx, candleFilter)
+		if err != nil {
+			return err
+		}
+		log.Printf("Rebuilt %d %s candles\n", rebuilt, interval.Name)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Run a maintenance command instead of consuming Kafka messages.
+// Example: ./app rebuild-candles -coin BTC
+func runCommand(command string, args []string) {
+	// Example: "mongodb://localhost:27017"
+	mongoURL, didFind := os.LookupEnv("MONGO_URL")
+	if !didFind {
+		panic("No MongoDB URL provided")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
+	if err != nil {
+		panic(err)
+	}
+	defer client.Disconnect(context.Background())
+
+	switch command {
+	case "rebuild-candles":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		coin := flags.String("coin", "", "only rebuild candles for this crypto")
+		flags.Parse(args)
+		err = rebuildCandles(*coin, 0, 0, client)
+	case "rebuild-indicators":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		coin := flags.String("coin", "", "only rebuild indicators for this crypto")
+		flags.Parse(args)
+		err = rebuildIndicators(*coin, client)
+	case "reprocess":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		from := flags.String("from", "", "replay messages at or after this time, as a Unix epoch or RFC3339")
+		to := flags.String("to", "", "replay messages before this time, as a Unix epoch or RFC3339")
+		partition := flags.Int("partition", -1, "only replay this partition")
+		startOffset := flags.Int64("start-offset", -1, "replay from this offset when -from is not set")
+		endOffset := flags.Int64("end-offset", -1, "replay up to but not including this offset when -to is not set")
+		truncate := flags.Bool("truncate", false, "delete ticks in the window and reset prices before replaying. Requires -from and every partition")
+		flags.Parse(args)
+		// Example: "localhost:9091"
+		kafkaServer, didFind := os.LookupEnv("KAFKA_SERVER")
+		if !didFind {
+			panic("No Kafka server provided")
+		}
+		opts := ReprocessOptions{
+			Partition:   int32(*partition),
+			StartOffset: *startOffset,
+			EndOffset:   *endOffset,
+			Truncate:    *truncate,
+		}
+		opts.From, err = parseReprocessTime(*from)
+		if err == nil {
+			opts.To, err = parseReprocessTime(*to)
+		}
+		if err == nil {
+			err = reprocess("crypto.price.updated", kafkaServer, opts, client)
+		}
+	default:
+		log.Fatalf("Unknown command %q. Valid commands are: rebuild-candles, rebuild-indicators, reprocess\n", command)
+	}
+	if err != nil {
+		log.Fatalf("Command %s failed: %v\n", command, err)
+	}
+	log.Printf("Command %s completed\n", command)
+}
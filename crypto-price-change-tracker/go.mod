@@ -6,6 +6,7 @@ toolchain go1.21.1
 
 require (
 	github.com/confluentinc/confluent-kafka-go/v2 v2.8.0
+	github.com/mattn/go-sqlite3 v1.14.28
 	github.com/prometheus/client_golang v1.17.0
 	go.mongodb.org/mongo-driver v1.17.3
 )
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"crypto-price-change-tracker/indicators"
+	"crypto-price-change-tracker/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Number of recent ticks loaded to warm up indicators for a crypto
+const indicatorWarmupTicks = 200
+
+// `indicators` collection document structure. One document per crypto holding
+// the indicator values after the latest applied tick.
+type IndicatorsDB struct {
+	ID   string `bson:"_id,omitempty"`
+	Name string `bson:"name"`
+	// Kafka event time of the latest tick
+	Time  int64   `bson:"time"`
+	Price float32 `bson:"price"`
+	// Indicators are missing until enough ticks have been seen
+	SMA20           *float64 `bson:"sma20,omitempty"`
+	SMA50           *float64 `bson:"sma50,omitempty"`
+	EMA12           *float64 `bson:"ema12,omitempty"`
+	EMA26           *float64 `bson:"ema26,omitempty"`
+	Volatility20    *float64 `bson:"volatility20,omitempty"`
+	RSI14           *float64 `bson:"rsi14,omitempty"`
+	BollingerLower  *float64 `bson:"bollingerLower,omitempty"`
+	BollingerMiddle *float64 `bson:"bollingerMiddle,omitempty"`
+	BollingerUpper  *float64 `bson:"bollingerUpper,omitempty"`
+	// Number of ticks the indicators were calculated from
+	Count int64 `bson:"count"`
+}
+
+func newIndicatorsDB(cryptoId string, price float32, checkedAt int64, snapshot indicators.Snapshot) IndicatorsDB {
+	return IndicatorsDB{
+		Name:            cryptoId,
+		Time:            checkedAt,
+		Price:           price,
+		SMA20:           snapshot.SMA20,
+		SMA50:           snapshot.SMA50,
+		EMA12:           snapshot.EMA12,
+		EMA26:           snapshot.EMA26,
+		Volatility20:    snapshot.Volatility20,
+		RSI14:           snapshot.RSI14,
+		BollingerLower:  snapshot.BollingerLower,
+		BollingerMiddle: snapshot.BollingerMiddle,
+		BollingerUpper:  snapshot.BollingerUpper,
+		Count:           snapshot.Count,
+	}
+}
+
+// Maintains streaming indicators for every crypto and stores them in `indicators`
+type IndicatorTracker struct {
+	client *mongo.Client
+	sets   map[string]*indicators.Set
+}
+
+func NewIndicatorTracker(client *mongo.Client) *IndicatorTracker {
+	return &IndicatorTracker{client: client, sets: map[string]*indicators.Set{}}
+}
+
+// Update the indicators of a crypto with a tick applied to `prices` and save them.
+// Indicators for a crypto are warmed up from its recent history on the first tick.
+func (t *IndicatorTracker) update(cryptoId string, price float32, checkedAt int64) error {
+	set, didFind := t.sets[cryptoId]
+	if !didFind {
+		var err error
+		set, err = t.warmUp(cryptoId, checkedAt)
+		if err != nil {
+			return err
+		}
+		t.sets[cryptoId] = set
+	}
+	set.Update(float64(price))
+	return saveIndicators(newIndicatorsDB(cryptoId, price, checkedAt, set.Snapshot()), t.client)
+}
+
+// Create indicators for a crypto from the applied ticks before checkedAt
+func (t *IndicatorTracker) warmUp(cryptoId string, checkedAt int64) (*indicators.Set, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	collection := t.client.Database("crypto").Collection("price_changes_over_time")
+	// Stale ticks never updated the live indicators
+	filter := bson.M{"name": cryptoId, "time": bson.M{"$lt": checkedAt}, "stale": bson.M{"$ne": true}}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(indicatorWarmupTicks)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var ticks []storage.PriceChange
+	if err = cursor.All(ctx, &ticks); err != nil {
+		return nil, err
+	}
+	set := indicators.NewSet()
+	// Ticks were loaded newest first
+	for i := len(ticks) - 1; i >= 0; i-- {
+		set.Update(float64(ticks[i].Price))
+	}
+	log.Printf("Warmed up %s indicators from %d ticks\n", cryptoId, len(ticks))
+	return set, nil
+}
+
+// Upsert the indicators document of a crypto
+func saveIndicators(document IndicatorsDB, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := client.Database("crypto").Collection("indicators")
+	_, err := collection.ReplaceOne(ctx, bson.M{"name": document.Name}, &document, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Printf("Could not save %s indicators: %v\n", document.Name, err)
+	}
+	return err
+}
+
+// Recalculate indicators from the applied ticks in `price_changes_over_time`,
+// matching the live updates. If cryptoId is not empty only that crypto is rebuilt.
+func rebuildIndicators(cryptoId string, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	collection := client.Database("crypto").Collection("price_changes_over_time")
+	cryptoIds := []string{cryptoId}
+	if cryptoId == "" {
+		names, err := collection.Distinct(ctx, "name", bson.M{})
+		if err != nil {
+			return err
+		}
+		cryptoIds = cryptoIds[:0]
+		for _, name := range names {
+			if n, ok := name.(string); ok {
+				cryptoIds = append(cryptoIds, n)
+			}
+		}
+	}
+	for _, id := range cryptoIds {
+		opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}})
+		cursor, err := collection.Find(ctx, bson.M{"name": id, "stale": bson.M{"$ne": true}}, opts)
+		if err != nil {
+			return err
+		}
+		set := indicators.NewSet()
+		var last storage.PriceChange
+		for cursor.Next(ctx) {
+			if err = cursor.Decode(&last); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			set.Update(float64(last.Price))
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+		snapshot := set.Snapshot()
+		if snapshot.Count == 0 {
+			log.Printf("No ticks found for %s\n", id)
+			continue
+		}
+		if err = saveIndicators(newIndicatorsDB(id, last.Price, last.Time, snapshot), client); err != nil {
+			return err
+		}
+		log.Printf("Rebuilt %s indicators from %d ticks\n", id, snapshot.Count)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package indicators maintains streaming technical indicators over a price series.
+// Each indicator is updated in constant time per tick and reports whether it has
+// seen enough prices to produce a value.
+package indicators
+
+import "math"
+
+// Fixed size window of the most recent values
+type window struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func newWindow(size int) *window {
+	return &window{values: make([]float64, size)}
+}
+
+// Add a value, returning the value it replaced and whether one was replaced
+func (w *window) push(value float64) (float64, bool) {
+	old, replaced := w.values[w.next], w.full
+	w.values[w.next] = value
+	w.next = (w.next + 1) % len(w.values)
+	if w.next == 0 {
+		w.full = true
+	}
+	return old, replaced
+}
+
+// Simple moving average of the last Period prices
+type SMA struct {
+	Period int
+	window *window
+	sum    float64
+}
+
+func NewSMA(period int) *SMA {
+	return &SMA{Period: period, window: newWindow(period)}
+}
+
+func (s *SMA) Update(price float64) {
+	old, replaced := s.window.push(price)
+	s.sum += price
+	if replaced {
+		s.sum -= old
+	}
+}
+
+func (s *SMA) Ready() bool {
+	return s.window.full
+}
+
+func (s *SMA) Value() float64 {
+	return s.sum / float64(s.Period)
+}
+
+// Exponential moving average with smoothing 2/(Period+1), seeded with the SMA
+// of the first Period prices
+type EMA struct {
+	Period int
+	alpha  float64
+	seed   *SMA
+	value  float64
+	count  int
+}
+
+func NewEMA(period int) *EMA {
+	return &EMA{Period: period, alpha: 2 / float64(period+1), seed: NewSMA(period)}
+}
+
+func (e *EMA) Update(price float64) {
+	e.count++
+	if e.count <= e.Period {
+		e.seed.Update(price)
+		e.value = e.seed.Value()
+		return
+	}
+	e.value = e.alpha*price + (1-e.alpha)*e.value
+}
+
+func (e *EMA) Ready() bool {
+	return e.count >= e.Period
+}
+
+func (e *EMA) Value() float64 {
+	return e.value
+}
+
+// Rolling mean and standard deviation of the last Period values
+type RollingStats struct {
+	Period int
+	window *window
+	sum    float64
+	sumSq  float64
+}
+
+func NewRollingStats(period int) *RollingStats {
+	return &RollingStats{Period: period, window: newWindow(period)}
+}
+
+func (r *RollingStats) Update(value float64) {
+	old, replaced := r.window.push(value)
+	r.sum += value
+	r.sumSq += value * value
+	if replaced {
+		r.sum -= old
+		r.sumSq -= old * old
+	}
+}
+
+func (r *RollingStats) Ready() bool {
+	return r.window.full
+}
+
+func (r *RollingStats) Mean() float64 {
+	return r.sum / float64(r.Period)
+}
+
+// Population standard deviation
+func (r *RollingStats) StdDev() float64 {
+	n := float64(r.Period)
+	variance := r.sumSq/n - (r.sum/n)*(r.sum/n)
+	// Guard against tiny negative values from floating point error
+	if variance < 0 {
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+// Sample standard deviation
+func (r *RollingStats) SampleStdDev() float64 {
+	n := float64(r.Period)
+	if n < 2 {
+		return 0
+	}
+	return r.StdDev() * math.Sqrt(n/(n-1))
+}
+
+// Rolling volatility as the sample standard deviation of the last Period log returns
+type Volatility struct {
+	Period    int
+	returns   *RollingStats
+	lastPrice float64
+	hasLast   bool
+}
+
+func NewVolatility(period int) *Volatility {
+	return &Volatility{Period: period, returns: NewRollingStats(period)}
+}
+
+func (v *Volatility) Update(price float64) {
+	if v.hasLast && v.lastPrice > 0 && price > 0 {
+		v.returns.Update(math.Log(price / v.lastPrice))
+	}
+	v.lastPrice = price
+	v.hasLast = true
+}
+
+func (v *Volatility) Ready() bool {
+	return v.returns.Ready()
+}
+
+func (v *Volatility) Value() float64 {
+	return v.returns.SampleStdDev()
+}
+
+// Relative strength index using Wilder's smoothing
+type RSI struct {
+	Period    int
+	avgGain   float64
+	avgLoss   float64
+	changes   int
+	lastPrice float64
+	hasLast   bool
+}
+
+func NewRSI(period int) *RSI {
+	return &RSI{Period: period}
+}
+
+func (r *RSI) Update(price float64) {
+	if !r.hasLast {
+		r.lastPrice = price
+		r.hasLast = true
+		return
+	}
+	change := price - r.lastPrice
+	r.lastPrice = price
+	gain, loss := math.Max(change, 0), math.Max(-change, 0)
+	r.changes++
+	period := float64(r.Period)
+	if r.changes <= r.Period {
+		// Simple average of the first Period changes
+		r.avgGain += gain / period
+		r.avgLoss += loss / period
+		return
+	}
+	r.avgGain = (r.avgGain*(period-1) + gain) / period
+	r.avgLoss = (r.avgLoss*(period-1) + loss) / period
+}
+
+func (r *RSI) Ready() bool {
+	return r.changes >= r.Period
+}
+
+func (r *RSI) Value() float64 {
+	if r.avgLoss == 0 {
+		if r.avgGain == 0 {
+			return 50
+		}
+		return 100
+	}
+	return 100 - 100/(1+r.avgGain/r.avgLoss)
+}
+
+// Bollinger bands of Width population standard deviations around the SMA of the last Period prices
+type Bollinger struct {
+	Period int
+	Width  float64
+	stats  *RollingStats
+}
+
+func NewBollinger(period int, width float64) *Bollinger {
+	return &Bollinger{Period: period, Width: width, stats: NewRollingStats(period)}
+}
+
+func (b *Bollinger) Update(price float64) {
+	b.stats.Update(price)
+}
+
+func (b *Bollinger) Ready() bool {
+	return b.stats.Ready()
+}
+
+// Returns the lower, middle and upper bands
+func (b *Bollinger) Value() (float64, float64, float64) {
+	middle := b.stats.Mean()
+	offset := b.Width * b.stats.StdDev()
+	return middle - offset, middle, middle + offset
+}
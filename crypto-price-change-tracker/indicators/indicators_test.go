@@ -0,0 +1,179 @@
+package indicators
+
+import (
+	"math"
+	"testing"
+)
+
+// Closing prices of the StockCharts moving average example
+var movingAverageSeries = []float64{
+	22.27, 22.19, 22.08, 22.17, 22.18, 22.13, 22.23, 22.43, 22.24, 22.29,
+	22.15, 22.39, 22.38, 22.61, 23.36, 24.05, 23.75, 23.83, 23.95, 23.63,
+	23.82, 23.87, 23.65, 23.19, 23.10, 23.33, 22.68, 23.10, 22.40, 22.17,
+}
+
+// Closing prices of the StockCharts RSI example
+var rsiSeries = []float64{
+	44.34, 44.09, 44.15, 43.61, 44.33, 44.83, 45.10, 45.42, 45.84, 46.08,
+	45.89, 46.03, 45.61, 46.28, 46.28, 46.00, 46.03, 46.41, 46.22, 45.64,
+	46.21, 46.25, 45.71, 46.45, 45.78, 45.35, 44.03, 44.18, 44.22, 44.57,
+	43.42, 42.66, 43.13,
+}
+
+// Streaming indicator with a single value
+type indicator interface {
+	Update(price float64)
+	Ready() bool
+	Value() float64
+}
+
+// Check an indicator against the expected value after each price. want starts at
+// the first price the indicator is ready on
+func checkSeries(t *testing.T, name string, ind indicator, prices []float64, want []float64, tolerance float64) {
+	t.Helper()
+	first := len(prices) - len(want)
+	for i, price := range prices {
+		ind.Update(price)
+		if ind.Ready() != (i >= first) {
+			t.Fatalf("%s: Ready() = %v after %d prices", name, ind.Ready(), i+1)
+		}
+		if i < first {
+			continue
+		}
+		if got := ind.Value(); math.Abs(got-want[i-first]) > tolerance {
+			t.Errorf("%s: value after %d prices = %.4f, want %.4f", name, i+1, got, want[i-first])
+		}
+	}
+}
+
+func TestIndicators(t *testing.T) {
+	tests := []struct {
+		name      string
+		indicator indicator
+		prices    []float64
+		want      []float64
+		tolerance float64
+	}{
+		{
+			name:      "SMA10",
+			indicator: NewSMA(10),
+			prices:    movingAverageSeries,
+			want: []float64{
+				22.22, 22.21, 22.23, 22.26, 22.30, 22.42, 22.61, 22.77, 22.91, 23.08, 23.21,
+				23.38, 23.52, 23.65, 23.71, 23.68, 23.61, 23.51, 23.43, 23.28, 23.13,
+			},
+			tolerance: 0.01,
+		},
+		{
+			name:      "EMA10",
+			indicator: NewEMA(10),
+			prices:    movingAverageSeries,
+			want: []float64{
+				22.22, 22.21, 22.24, 22.27, 22.33, 22.52, 22.80, 22.97, 23.13, 23.28, 23.34,
+				23.43, 23.51, 23.53, 23.47, 23.40, 23.39, 23.26, 23.23, 23.08, 22.92,
+			},
+			tolerance: 0.01,
+		},
+		{
+			name:      "EMA26",
+			indicator: NewEMA(26),
+			prices:    movingAverageSeries,
+			want:      []float64{22.8950, 22.8791, 22.8954, 22.8587, 22.8077},
+			tolerance: 0.0001,
+		},
+		{
+			// Values are calculated without rounding the average gains and losses,
+			// so they differ from the rounded example by up to 0.07
+			name:      "RSI14",
+			indicator: NewRSI(14),
+			prices:    rsiSeries,
+			want: []float64{
+				70.46, 66.25, 66.48, 69.35, 66.29, 57.92, 62.88, 63.21, 56.01, 62.34,
+				54.67, 50.39, 40.02, 41.49, 41.90, 45.50, 37.32, 33.09, 37.79,
+			},
+			tolerance: 0.01,
+		},
+		{
+			name:      "Volatility20",
+			indicator: NewVolatility(20),
+			prices:    movingAverageSeries,
+			want: []float64{
+				0.011750, 0.011641, 0.011846, 0.012917, 0.012985,
+				0.013058, 0.014756, 0.015167, 0.016679, 0.016840,
+			},
+			tolerance: 0.000001,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkSeries(t, test.name, test.indicator, test.prices, test.want, test.tolerance)
+		})
+	}
+}
+
+func TestMACD(t *testing.T) {
+	// MACD line of EMA12 - EMA26 once both are ready
+	want := []float64{0.4597, 0.3718, 0.3323, 0.2416, 0.1495}
+	ema12, ema26 := NewEMA(12), NewEMA(26)
+	first := len(movingAverageSeries) - len(want)
+	for i, price := range movingAverageSeries {
+		ema12.Update(price)
+		ema26.Update(price)
+		if i < first {
+			continue
+		}
+		if got := ema12.Value() - ema26.Value(); math.Abs(got-want[i-first]) > 0.0001 {
+			t.Errorf("MACD after %d prices = %.4f, want %.4f", i+1, got, want[i-first])
+		}
+	}
+}
+
+func TestBollinger(t *testing.T) {
+	tests := []struct {
+		prices               int
+		lower, middle, upper float64
+	}{
+		{prices: 20, lower: 21.3049, middle: 22.7155, upper: 24.1261},
+		{prices: 21, lower: 21.3199, middle: 22.7930, upper: 24.2661},
+		{prices: 25, lower: 21.6374, middle: 23.0525, upper: 24.4676},
+		{prices: 30, lower: 21.9055, middle: 23.1705, upper: 24.4355},
+	}
+	for _, test := range tests {
+		bollinger := NewBollinger(20, 2)
+		for _, price := range movingAverageSeries[:test.prices] {
+			bollinger.Update(price)
+		}
+		if !bollinger.Ready() {
+			t.Fatalf("Bollinger not ready after %d prices", test.prices)
+		}
+		lower, middle, upper := bollinger.Value()
+		for _, band := range []struct {
+			name      string
+			got, want float64
+		}{{"lower", lower, test.lower}, {"middle", middle, test.middle}, {"upper", upper, test.upper}} {
+			if math.Abs(band.got-band.want) > 0.0001 {
+				t.Errorf("Bollinger %s band after %d prices = %.4f, want %.4f", band.name, test.prices, band.got, band.want)
+			}
+		}
+	}
+}
+
+func TestSetSnapshot(t *testing.T) {
+	set := NewSet()
+	for i := 0; i < 49; i++ {
+		set.Update(movingAverageSeries[i%len(movingAverageSeries)])
+	}
+	if snapshot := set.Snapshot(); snapshot.SMA50 != nil || snapshot.Count != 49 {
+		t.Fatalf("Snapshot after 49 prices has SMA50 %v and count %d", snapshot.SMA50, snapshot.Count)
+	}
+	set.Update(movingAverageSeries[49%len(movingAverageSeries)])
+	snapshot := set.Snapshot()
+	for name, value := range map[string]*float64{
+		"SMA20": snapshot.SMA20, "SMA50": snapshot.SMA50, "EMA12": snapshot.EMA12, "EMA26": snapshot.EMA26,
+		"Volatility20": snapshot.Volatility20, "RSI14": snapshot.RSI14, "BollingerMiddle": snapshot.BollingerMiddle,
+	} {
+		if value == nil {
+			t.Errorf("%s not ready after 50 prices", name)
+		}
+	}
+}
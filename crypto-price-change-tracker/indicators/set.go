@@ -0,0 +1,85 @@
+package indicators
+
+// Values of all indicators after a tick. Fields are nil until the indicator
+// has seen enough prices.
+type Snapshot struct {
+	SMA20           *float64
+	SMA50           *float64
+	EMA12           *float64
+	EMA26           *float64
+	Volatility20    *float64
+	RSI14           *float64
+	BollingerLower  *float64
+	BollingerMiddle *float64
+	BollingerUpper  *float64
+	// Number of prices the indicators were calculated from
+	Count int64
+}
+
+// The indicators maintained for each crypto
+type Set struct {
+	sma20        *SMA
+	sma50        *SMA
+	ema12        *EMA
+	ema26        *EMA
+	volatility20 *Volatility
+	rsi14        *RSI
+	bollinger    *Bollinger
+	count        int64
+}
+
+func NewSet() *Set {
+	return &Set{
+		sma20:        NewSMA(20),
+		sma50:        NewSMA(50),
+		ema12:        NewEMA(12),
+		ema26:        NewEMA(26),
+		volatility20: NewVolatility(20),
+		rsi14:        NewRSI(14),
+		bollinger:    NewBollinger(20, 2),
+	}
+}
+
+func (s *Set) Update(price float64) {
+	s.sma20.Update(price)
+	s.sma50.Update(price)
+	s.ema12.Update(price)
+	s.ema26.Update(price)
+	s.volatility20.Update(price)
+	s.rsi14.Update(price)
+	s.bollinger.Update(price)
+	s.count++
+}
+
+func (s *Set) Snapshot() Snapshot {
+	snapshot := Snapshot{Count: s.count}
+	if s.sma20.Ready() {
+		snapshot.SMA20 = valueOf(s.sma20.Value())
+	}
+	if s.sma50.Ready() {
+		snapshot.SMA50 = valueOf(s.sma50.Value())
+	}
+	if s.ema12.Ready() {
+		snapshot.EMA12 = valueOf(s.ema12.Value())
+	}
+	if s.ema26.Ready() {
+		snapshot.EMA26 = valueOf(s.ema26.Value())
+	}
+	if s.volatility20.Ready() {
+		snapshot.Volatility20 = valueOf(s.volatility20.Value())
+	}
+	if s.rsi14.Ready() {
+		snapshot.RSI14 = valueOf(s.rsi14.Value())
+	}
+	if s.bollinger.Ready() {
+		lower, middle, upper := s.bollinger.Value()
+		snapshot.BollingerLower = valueOf(lower)
+		snapshot.BollingerMiddle = valueOf(middle)
+		snapshot.BollingerUpper = valueOf(upper)
+	}
+	return snapshot
+}
+
+func valueOf(value float64) *float64 {
+	return &value
+}
@@ -11,30 +11,15 @@ import (
 	"log"
 	
 	"crypto-price-change-tracker/metrics" 
+	"crypto-price-change-tracker/storage"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-
-    "go.mongodb.org/mongo-driver/bson"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/mongo/options"
 )
 // Unused type for message
 type Message struct {
     Name    string 
     Price   float32
 }
-type CryptoPriceDB struct {
-    ID    string `bson:"_id,omitempty"`
-    Name  string `bson:"name"`
-    Price float32	 `bson:"price"`
-}
-type CryptoPriceChangeDB struct {
-    ID    		string `bson:"_id,omitempty"`
-    Name  		string `bson:"name"`
-    Price  	float32	    `bson:"lastPrice"`
-    PriceChange  	float32	    `bson:"priceChange"`
-    Time int64     `bson:"time"`
-}
 func parseKafkaMessage(message string) (*Message, error) { 
 	parts := strings.Split(message, ":")
 	if len(parts) != 2 {
@@ -55,68 +40,97 @@ func parseKafkaMessage(message string) (*Message, error) {
 // This method 1. updates the `prices` collection with the latest price,
 // and 2. updates the `price_changes_over_time` collection with a new 
 // entry for the received message. 
-func updateDatabase(cryptoId string, price float32, checkedAt int64, client *mongo.Client) error { 
+// The previous price is read and replaced atomically, so concurrent 
+// trackers processing the same coin always see a consistent previous 
+// price when calculating the price change.
+// Ticks older than the last applied tick are not applied to `prices`, but are 
+// still archived in `price_changes_over_time`, marked as stale.
+// Both writes are idempotent, so transient Mongo errors are retried and 
+// redelivered messages do not duplicate ticks.
+// Returns the stored `price_changes_over_time` document, and whether this call recorded
+// it rather than finding it already recorded by an earlier delivery.
+func updateDatabase(cryptoId string, price float32, checkedAt int64, store storage.Store) (*storage.PriceChange, bool, error) { 
 	// 1. Update Price of existing `prices` document
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-    collection := client.Database("crypto").Collection("prices")
-    // Define a filter to look up a specific crypto
-    filter := bson.M{"name": cryptoId}
-	// Find previous price of crypto
-	var previousPrice CryptoPriceDB 
-	err := collection.FindOne(ctx, filter).Decode(&previousPrice)
-	if err != nil { 
-        log.Println("Initial crypto " + cryptoId + " price not found:", err)
+	applied := true
+	var currentPrice storage.Price 
+	err := retryMongo("update_price", func(ctx context.Context) error { 
+		var err error
+		currentPrice, applied, err = store.ApplyPrice(ctx, cryptoId, price, checkedAt)
 		return err
+	})
+	if errors.Is(err, storage.ErrNotFound) { 
+		log.Println("Initial crypto " + cryptoId + " price not found:", err)
+		return nil, false, err
+	} else if err != nil { 
+		log.Printf("Could not find and update: %v\n", err)
+		return nil, false, err
 	}
-	// Define the update query to update the price field
-	update := bson.M{
-		"$set": bson.M{"price": price}, 
-	}
-	// Update main `price` collection object only if the time since the message is received is less than 1 minute
-	updateResult := collection.FindOneAndUpdate(ctx, filter, update)
-	if updateResult.Err() != nil {
-		log.Printf("Could not find and update: %v\n", updateResult.Err())
-		panic(updateResult.Err())
+	if !applied { 
+		log.Printf("Ignoring stale %s tick @%d, price already updated @%d\n", cryptoId, checkedAt, currentPrice.Time)
 	}
 	// 2. Create a new document in the `price_changes_over_time` 
-	priceChangeEntry := CryptoPriceChangeDB{
+	priceChangeEntry := storage.PriceChange{
 		Name: cryptoId,
 		Price: price, 
 		// Time is Kafka event time
 		Time: checkedAt,
+		Stale: !applied,
+	}
+	// Stale ticks did not change the current price
+	if applied { 
 		// 120,000 - 100,000 = 20,000
-		PriceChange: price - previousPrice.Price,
+		priceChangeEntry.PriceChange = price - currentPrice.PreviousPrice
 	}
-	// Insert record into database
-	collection = client.Database("crypto").Collection("price_changes_over_time")
-	_, err = collection.InsertOne(ctx, &priceChangeEntry)
+	// Insert record into database, unless the tick was already recorded
+	var storedEntry storage.PriceChange
+	var recorded bool
+	err = retryMongo("insert_price_change", func(ctx context.Context) error { 
+		var err error
+		storedEntry, recorded, err = store.RecordPriceChange(ctx, priceChangeEntry)
+		return err
+	})
 	if err != nil {
 		log.Printf("Insert price change record failed: %v\n", err)
-		return err
+		return nil, false, err
 	}
-	return nil
+	return &storedEntry, recorded, nil
 }
 
-// Receive Kafka messages with new Crypto prices and update 2 tables in the MongoDB database.
+// Receive Kafka messages with new Crypto prices and update the MongoDB database.
+// Passing a command as the first argument runs a maintenance command instead, see runCommand.
 func main() { 
+	if len(os.Args) > 1 { 
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
 	// Initialize context for killing application
-	_, cancel := context.WithCancel(context.Background())
+	mainCtx, cancel := context.WithCancel(context.Background())
 	// Initialize prometheus metrics and expose on separate port
 	metrics.Init(cancel)
 
 	topic := "crypto.price.updated"
+	storedTopic := "crypto.price.stored"
 	// Lookup necessary environment variables
 	// Example: "localhost:9091"
 	kafkaServer, didFind := os.LookupEnv("KAFKA_SERVER")
 	if !didFind { 
 		panic("No Kafka server provided")
 	}
+	// "mongo" (default), "sqlite" or "memory"
+	backend, didFind := os.LookupEnv("STORAGE_BACKEND")
+	if !didFind { 
+		backend = storage.BackendMongo
+	}
 	// Example: "mongodb://localhost:27017"
 	mongoURL, didFind := os.LookupEnv("MONGO_URL")
-	if !didFind { 
+	if !didFind && backend == storage.BackendMongo { 
 		panic("No MongoDB URL provided")
 	}
+	// Example: "/data/crypto.db"
+	sqlitePath, didFind := os.LookupEnv("SQLITE_PATH")
+	if !didFind && backend == storage.BackendSQLite { 
+		panic("No SQLite path provided")
+	}
 	// Example: 1 or 2
 	kafkaPartition, didFind := os.LookupEnv("KAFKA_PARTITION")
 	if !didFind { 
@@ -126,20 +140,56 @@ func main() {
     if err != nil {
         panic("Invalid Kafka partition provided")
     }
-	// Connect to MongoDB 
+	// Optional, publishes stored events and commits offsets in Kafka transactions.
+	// Must be unique per tracker, example: "go-price-change-tracker-0"
+	transactionalId := os.Getenv("KAFKA_TRANSACTIONAL_ID")
+	// Connect to storage 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
+	store, err := storage.Open(ctx, storage.Config{
+		Backend: backend,
+		MongoURL: mongoURL,
+		SQLitePath: sqlitePath,
+	})
     if err != nil {
         panic(err)
     }
-    defer client.Disconnect(ctx)
+    defer store.Close(context.Background())
+	log.Printf("Using %s storage\n", backend)
+	// Retry transient Mongo errors before pausing consumption
+	err = loadMongoRetryPolicy()
+	if err != nil { 
+		panic(err)
+	}
+	// Retention, candles, indicators and portfolio snapshots are only stored in MongoDB
+	var indicatorTracker *IndicatorTracker
+	var portfolioTracker *PortfolioTracker
+	mongoStore, isMongo := store.(*storage.MongoStore)
+	if isMongo { 
+		client := mongoStore.Client()
+		// Prune raw price history in the background
+		retentionPolicy, err := loadRetentionPolicy()
+		if err != nil { 
+			panic(err)
+		}
+		go runRetention(mainCtx, retentionPolicy, client)
+		// Streaming technical indicators per crypto
+		indicatorTracker = NewIndicatorTracker(client)
+		// Portfolio valuation time series
+		portfolioTracker = NewPortfolioTracker(client)
+	} else { 
+		log.Printf("Retention, candles, indicators and portfolio snapshots are disabled with %s storage\n", backend)
+	}
 	// Define Kafka Consumer client
 	c, err := kafka.NewConsumer(&kafka.ConfigMap{
 		"bootstrap.servers": kafkaServer,
 		"group.id":          "go-price-change-consumer-group",
 		"auto.offset.reset": "earliest",
-		"enable.auto.commit": true,
+		// Transactions commit offsets together with the stored events
+		"enable.auto.commit": transactionalId == "",
+		// Offsets are stored once a message is written to Mongo, so messages 
+		// that fail while Mongo is unavailable are consumed again
+		"enable.auto.offset.store": false,
 	})
 	if err != nil {
 		panic(err)
@@ -149,54 +199,216 @@ func main() {
 	if err != nil {
 		panic("Did not subscribe to topic")
 	}
-	// Assign consumer to topic partition
+	// Assign consumer to topic partition, resuming after the last committed offset
 	topicPartition := kafka.TopicPartition{
 		Topic:             	&topic,
 		Partition: 			int32(kafkaPartition_i),
-		Offset:				-1,
+		Offset:				kafka.OffsetStored,
 	}
 	err = c.Assign([]kafka.TopicPartition{topicPartition})
 	if err != nil {
 		panic("Did not assign topic partition to consumer")
 	}
+	defer c.Close()
+	// Publish an event for every stored tick
+	storedPublisher, err := NewStoredPublisher(kafkaServer, transactionalId, storedTopic, c)
+	if err != nil { 
+		panic(err)
+	}
+	defer storedPublisher.Close()
+	// Export consumer lag of the assigned partition
+	lagExporter := metrics.NewLagExporter(c)
+	go lagExporter.Run(mainCtx, 10*time.Second)
+	// Track whether the brokers are reachable. Unknown until the first message or probe
+	kafkaConnected := false
+	lastConnectionProbe := time.Time{}
+	metrics.KafkaConnectionStateGauge.Set(0)
+	// Partitions paused while Mongo is unavailable, resumed once it can be pinged again
+	var pausedPartitions []kafka.TopicPartition
+	lastMongoProbe := time.Time{}
+	metrics.MongoAvailableGauge.Set(1)
+	metrics.SetReady(true)
 	// For Each Message, 
 	run := true
 	timeoutMs := 2000
 	for run {
+		// Stop consuming on shutdown
+		select { 
+		case <-mainCtx.Done():
+			log.Println("Shutting down Kafka consumer...")
+			run = false
+			continue
+		default:
+		}
 		currentDate := time.Now().Format("2006-01-02 15:04:05") // YYYY-MM-DD HH:mm:ss
 		// log.Printf("Waiting %dms for new Kafka message@%s\n", timeoutMs, currentDate)
 		ev := c.Poll(timeoutMs)
 		switch e := ev.(type) {
 		// Process Message
 		case *kafka.Message:
+			// Drop messages fetched before the partition was paused, they are redelivered after the seek
+			if isPaused(pausedPartitions, e.TopicPartition.Partition) { 
+				continue
+			}
 			messageProcessingStart := time.Now()
+			lagExporter.MessageReceived(e.TopicPartition)
+			if !kafkaConnected { 
+				kafkaConnected = true
+				metrics.KafkaConnectionStateGauge.Set(1)
+			}
 			log.Printf("Received PART:[%d]OFF[%d]: %s @ %s\n", e.TopicPartition.Partition, e.TopicPartition.Offset, string(e.Value), currentDate)
+			// Document stored for the message, published once processing is done
+			var storedChange *storage.PriceChange
 			// Parse message into Message type
 			cryptoMessage, err := parseKafkaMessage(string(e.Value))
 			if err != nil { 
+				// Skip messages that can never be processed rather than crash looping on them
 				metrics.FailedKafkaMessagesCounter.WithLabelValues().Inc()
-				panic(err)
+				log.Printf("Skipping invalid message %s: %v\n", string(e.Value), err)
 			}else{
 				// Update current price and insert price at time
-				err = updateDatabase(cryptoMessage.Name, cryptoMessage.Price, e.Timestamp.Unix(), client)
-				if err != nil { 
+				change, recorded, err := updateDatabase(cryptoMessage.Name, cryptoMessage.Price, e.Timestamp.Unix(), store)
+				if isTransientMongoError(err) { 
+					// Mongo is unavailable, so stop consuming and redeliver this message once it is back
+					log.Printf("Mongo unavailable, pausing partition %d at offset %d: %v\n", e.TopicPartition.Partition, e.TopicPartition.Offset, err)
+					pausedPartitions = pauseAtMessage(c, e, pausedPartitions)
+					lastMongoProbe = time.Now()
+					metrics.PriceChangeMessageDuration.Observe(time.Since(messageProcessingStart).Seconds())
+					continue
+				} else if err != nil { 
 					metrics.FailedKafkaMessagesCounter.WithLabelValues().Inc()
 					log.Printf("Error updating crypto prices, %v", err)
+				} else if change.Stale { 
+					metrics.StaleKafkaMessagesCounter.WithLabelValues(cryptoMessage.Name).Inc()
+					metrics.MessagesConsumedCounter.WithLabelValues(cryptoMessage.Name).Inc()
 				} else { 
 					log.Printf("Updated price of crypto \"%s\" to \"%f\"\n", cryptoMessage.Name, cryptoMessage.Price)
 					metrics.MessagesConsumedCounter.WithLabelValues(cryptoMessage.Name).Inc()
+					// Redelivered ticks already updated the indicators and snapshots when they were recorded
+					if isMongo && recorded { 
+						// Indicators are calculated over the ordered stream, so only applied ticks update them
+						indicatorErr := indicatorTracker.update(cryptoMessage.Name, cryptoMessage.Price, e.Timestamp.Unix())
+						if indicatorErr != nil { 
+							metrics.FailedIndicatorUpdatesCounter.WithLabelValues(cryptoMessage.Name).Inc()
+						}
+						portfolioErr := portfolioTracker.update(cryptoMessage.Name, cryptoMessage.Price, e.Timestamp.Unix())
+						if portfolioErr != nil { 
+							metrics.FailedPortfolioUpdatesCounter.WithLabelValues().Inc()
+						}
+					}
+				}
+				if err == nil { 
+					storedChange = change
+				}
+				// Stale ticks are still part of the price history, so always roll them up.
+				// Redelivered ticks were already rolled up when they were recorded
+				if err == nil && isMongo && recorded { 
+					err = updateCandles(cryptoMessage.Name, cryptoMessage.Price, e.Timestamp.Unix(), mongoStore.Client())
+					if err != nil { 
+						metrics.FailedCandleUpdatesCounter.WithLabelValues(cryptoMessage.Name).Inc()
+					}
+				}
+			}
+			// Messages are only skipped when they can never be processed
+			if err := storedPublisher.publish(e, storedChange); isFatalKafkaError(err) { 
+				// The producer can not be used again, so stop and close the clients
+				log.Printf("Fatal Kafka error publishing stored event for offset %d: %v\n", e.TopicPartition.Offset, err)
+				metrics.PriceChangeMessageDuration.Observe(time.Since(messageProcessingStart).Seconds())
+				run = false
+				continue
+			} else if err != nil { 
+				log.Printf("Could not publish stored event for offset %d, consuming again: %v\n", e.TopicPartition.Offset, err)
+				if err := c.Seek(e.TopicPartition, 0); err != nil { 
+					log.Printf("Could not seek partition %d to offset %d: %v\n", e.TopicPartition.Partition, e.TopicPartition.Offset, err)
 				}
 			}
 			metrics.PriceChangeMessageDuration.Observe(time.Since(messageProcessingStart).Seconds())
 			run = true // continue processing messages
-		// Handle Error
+		// Handle Error. librdkafka reconnects by itself, so only fatal errors stop the consumer
 		case kafka.Error:
-			log.Printf("Kafka error: %v\n", e)
-			run = false
+			if e.IsFatal() { 
+				log.Printf("Fatal Kafka error: %v\n", e)
+				metrics.KafkaConnectionStateGauge.Set(0)
+				run = false
+			} else { 
+				log.Printf("Kafka error, continuing: %v\n", e)
+				metrics.KafkaErrorsCounter.WithLabelValues(e.Code().String()).Inc()
+				if e.Code() == kafka.ErrAllBrokersDown || e.Code() == kafka.ErrTransport { 
+					kafkaConnected = false
+					metrics.KafkaConnectionStateGauge.Set(0)
+				}
+			}
 		// No message received, loop
 		default:
 			// log.Printf("No message received in %dms\n", timeoutMs)
+			// Without messages there is no other signal that the brokers are back, so probe them
+			if !kafkaConnected && time.Since(lastConnectionProbe) > 10*time.Second { 
+				lastConnectionProbe = time.Now()
+				_, err := c.GetMetadata(&topic, false, 1000)
+				if err == nil { 
+					log.Println("Connected to Kafka")
+					kafkaConnected = true
+					metrics.KafkaConnectionStateGauge.Set(1)
+				}
+			}
+			if len(pausedPartitions) > 0 && time.Since(lastMongoProbe) > 5*time.Second { 
+				lastMongoProbe = time.Now()
+				pausedPartitions = resumeIfMongoAvailable(c, store, pausedPartitions)
+			}
 			run = true
 		}
 	}
 }
+
+// Pause a partition and rewind it to a message that could not be written, 
+// so it is consumed again when the partition is resumed
+func pauseAtMessage(c *kafka.Consumer, e *kafka.Message, pausedPartitions []kafka.TopicPartition) []kafka.TopicPartition { 
+	metrics.MongoAvailableGauge.Set(0)
+	metrics.SetReady(false)
+	tp := e.TopicPartition
+	err := c.Pause([]kafka.TopicPartition{tp})
+	if err != nil { 
+		log.Printf("Could not pause partition %d: %v\n", tp.Partition, err)
+	}
+	err = c.Seek(tp, 0)
+	if err != nil { 
+		log.Printf("Could not seek partition %d to offset %d: %v\n", tp.Partition, tp.Offset, err)
+	}
+	if isPaused(pausedPartitions, tp.Partition) { 
+		return pausedPartitions
+	}
+	pausedPartitions = append(pausedPartitions, tp)
+	metrics.PausedPartitionsGauge.Set(float64(len(pausedPartitions)))
+	return pausedPartitions
+}
+
+// Whether a partition is paused while Mongo is unavailable
+func isPaused(pausedPartitions []kafka.TopicPartition, partition int32) bool { 
+	for _, paused := range pausedPartitions { 
+		if paused.Partition == partition { 
+			return true
+		}
+	}
+	return false
+}
+
+// Resume paused partitions if Mongo can be pinged. Returns the partitions still paused
+func resumeIfMongoAvailable(c *kafka.Consumer, store storage.Store, pausedPartitions []kafka.TopicPartition) []kafka.TopicPartition { 
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := store.Ping(ctx)
+	if err != nil { 
+		log.Printf("Mongo still unavailable: %v\n", err)
+		return pausedPartitions
+	}
+	err = c.Resume(pausedPartitions)
+	if err != nil { 
+		log.Printf("Could not resume partitions: %v\n", err)
+		return pausedPartitions
+	}
+	log.Printf("Mongo available, resumed %d partitions\n", len(pausedPartitions))
+	metrics.MongoAvailableGauge.Set(1)
+	metrics.PausedPartitionsGauge.Set(0)
+	metrics.SetReady(true)
+	return nil
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Consumer position metrics, labelled by topic and partition
+var (
+	ConsumerLagGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_consumer_lag",
+			Help: "Number of messages between the committed offset and the high watermark",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	CommittedOffsetGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_consumer_committed_offset",
+			Help: "Offset committed by the consumer group",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	HighWatermarkGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_consumer_high_watermark",
+			Help: "Offset of the next message to be written to the partition",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	TimeSinceLastMessageGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_consumer_seconds_since_last_message",
+			Help: "Seconds since the consumer last received a message from the partition",
+		},
+		[]string{"topic", "partition"},
+	)
+)
+
+// Periodically exports the lag of the partitions assigned to a consumer
+type LagExporter struct {
+	consumer *kafka.Consumer
+	started  time.Time
+	// Time the last message was received per partition
+	mu          sync.Mutex
+	lastMessage map[int32]time.Time
+}
+
+func NewLagExporter(consumer *kafka.Consumer) *LagExporter {
+	return &LagExporter{
+		consumer:    consumer,
+		started:     time.Now(),
+		lastMessage: map[int32]time.Time{},
+	}
+}
+
+// Record that a message was received from a partition
+func (l *LagExporter) MessageReceived(partition kafka.TopicPartition) {
+	l.mu.Lock()
+	l.lastMessage[partition.Partition] = time.Now()
+	l.mu.Unlock()
+}
+
+// Export lag metrics every interval until ctx is cancelled
+func (l *LagExporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.export(); err != nil {
+				log.Printf("Could not export consumer lag: %v\n", err)
+			}
+		}
+	}
+}
+
+func (l *LagExporter) export() error {
+	assignment, err := l.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	committed, err := l.consumer.Committed(assignment, 5000)
+	if err != nil {
+		return err
+	}
+	for _, tp := range committed {
+		if tp.Topic == nil {
+			continue
+		}
+		topic := *tp.Topic
+		partition := strconv.Itoa(int(tp.Partition))
+		low, high, err := l.consumer.QueryWatermarkOffsets(topic, tp.Partition, 5000)
+		if err != nil {
+			return err
+		}
+		// Nothing committed yet, so everything still in the partition is lag
+		offset := int64(tp.Offset)
+		if offset < 0 {
+			offset = low
+		}
+		lag := high - offset
+		if lag < 0 {
+			lag = 0
+		}
+		ConsumerLagGauge.WithLabelValues(topic, partition).Set(float64(lag))
+		CommittedOffsetGauge.WithLabelValues(topic, partition).Set(float64(offset))
+		HighWatermarkGauge.WithLabelValues(topic, partition).Set(float64(high))
+		l.mu.Lock()
+		lastMessage, didFind := l.lastMessage[tp.Partition]
+		l.mu.Unlock()
+		if !didFind {
+			lastMessage = l.started
+		}
+		TimeSinceLastMessageGauge.WithLabelValues(topic, partition).Set(time.Since(lastMessage).Seconds())
+	}
+	return nil
+}
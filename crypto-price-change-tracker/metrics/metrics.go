@@ -7,6 +7,7 @@ import (
     "os/signal"
     "syscall"
 	"log"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -45,7 +46,108 @@ var (
         },
 		[]string{"coin"},
     )
+
+    StaleKafkaMessagesCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "stale_kafka_messages_total",
+            Help:    "Number of Kafka messages older than the current price that were archived but not applied",
+        },
+		[]string{"coin"},
+    )
     
+    FailedCandleUpdatesCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "failed_candle_updates_total",
+            Help:    "Number of ticks that could not be rolled up into candles",
+        },
+		[]string{"coin"},
+    )
+
+    FailedIndicatorUpdatesCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "failed_indicator_updates_total",
+            Help:    "Number of ticks that could not update technical indicators",
+        },
+		[]string{"coin"},
+    )
+
+    FailedPortfolioUpdatesCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "failed_portfolio_updates_total",
+            Help:    "Number of ticks that could not update the portfolio snapshots",
+        },
+		[]string{},
+    )
+
+    PrunedSnapshotsCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "pruned_portfolio_snapshots_total",
+            Help:    "Number of downsampled portfolio snapshot points removed by the retention policy",
+        },
+		[]string{"interval"},
+    )
+
+    PrunedTicksCounter = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name:    "pruned_price_ticks_total",
+            Help:    "Number of raw price ticks removed by the retention policy",
+        },
+		[]string{},
+    )
+
+	FailedRetentionRunsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failed_retention_runs_total",
+			Help: "Number of retention runs that could not prune raw price history",
+		},
+		[]string{},
+	)
+
+    KafkaConnectionStateGauge = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Name:    "kafka_connection_state",
+            Help:    "Whether the consumer can reach the Kafka brokers. 1 when connected, 0 when disconnected",
+        },
+    )
+
+	KafkaErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_errors_total",
+			Help: "Number of non-fatal Kafka errors by error code",
+		},
+		[]string{"code"},
+	)
+
+	FailedStoredEventsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failed_stored_events_total",
+			Help: "Number of crypto.price.stored events that could not be published",
+		},
+		[]string{},
+	)
+
+	MongoRetriesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mongo_retries_total",
+			Help: "Number of Mongo operations retried after a transient error",
+		},
+		[]string{"operation"},
+	)
+
+    MongoAvailableGauge = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Name:    "mongo_available",
+            Help:    "Whether writes to Mongo are succeeding. 1 when available, 0 while consumption is paused",
+        },
+    )
+
+    PausedPartitionsGauge = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Name:    "kafka_paused_partitions",
+            Help:    "Number of partitions paused while Mongo is unavailable",
+        },
+    )
+
     PriceChangeMessageDuration = prometheus.NewHistogram(
         prometheus.HistogramOpts{
             Name:    "price_change_message_processing_duration",
@@ -61,7 +163,24 @@ func Init(cancel context.CancelFunc) {
 	// prometheus.MustRegister(HTTPRequestDuration)
 	prometheus.MustRegister(FailedKafkaMessagesCounter)
 	prometheus.MustRegister(MessagesConsumedCounter)
+	prometheus.MustRegister(StaleKafkaMessagesCounter)
+	prometheus.MustRegister(FailedCandleUpdatesCounter)
+	prometheus.MustRegister(FailedIndicatorUpdatesCounter)
+	prometheus.MustRegister(FailedPortfolioUpdatesCounter)
+	prometheus.MustRegister(PrunedSnapshotsCounter)
+	prometheus.MustRegister(PrunedTicksCounter)
+	prometheus.MustRegister(FailedRetentionRunsCounter)
+	prometheus.MustRegister(KafkaConnectionStateGauge)
+	prometheus.MustRegister(KafkaErrorsCounter)
+	prometheus.MustRegister(FailedStoredEventsCounter)
+	prometheus.MustRegister(MongoRetriesCounter)
+	prometheus.MustRegister(MongoAvailableGauge)
+	prometheus.MustRegister(PausedPartitionsGauge)
 	prometheus.MustRegister(PriceChangeMessageDuration)
+	prometheus.MustRegister(ConsumerLagGauge)
+	prometheus.MustRegister(CommittedOffsetGauge)
+	prometheus.MustRegister(HighWatermarkGauge)
+	prometheus.MustRegister(TimeSinceLastMessageGauge)
 
     // Handle graceful shutdown
     go handleSignals(cancel)
@@ -69,12 +188,30 @@ func Init(cancel context.CancelFunc) {
     // Start metrics endpoint
     go func() {
         http.Handle("/metrics", promhttp.Handler())
+        http.HandleFunc("/ready", readyHandler)
         log.Println("Prometheus metrics at :2112/metrics")
         log.Fatal(http.ListenAndServe(":2112", nil))
     }()
 
 }
 
+// Whether the service can process messages, served on /ready
+var ready atomic.Bool
+
+// Set the readiness reported on /ready
+func SetReady(isReady bool) {
+    ready.Store(isReady)
+}
+
+// Readiness probe. Returns 503 while the service cannot process messages
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+    if !ready.Load() {
+        http.Error(w, "not ready", http.StatusServiceUnavailable)
+        return
+    }
+    w.Write([]byte("ok"))
+}
+
 // Handle OS signals
 func handleSignals(cancel context.CancelFunc) {
     sigChan := make(chan os.Signal, 1)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"crypto-price-change-tracker/metrics"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Server error codes returned while a replica set is changing primary or shutting down
+var transientMongoErrorCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// How Mongo operations are retried before a tick is given up on
+type MongoRetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Timeout of a single attempt
+	AttemptTimeout time.Duration
+}
+
+// Retry policy used by updateDatabase, configured by loadMongoRetryPolicy
+var mongoRetryPolicy = MongoRetryPolicy{
+	MaxRetries:     5,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	AttemptTimeout: 5 * time.Second,
+}
+
+// Read the Mongo retry policy from environment variables
+//
+//	MONGO_MAX_RETRIES    retries after the first attempt. Default 5
+//	MONGO_RETRY_BACKOFF  delay before the first retry, doubled for each retry. Default 200ms
+func loadMongoRetryPolicy() error {
+	if retries, didFind := os.LookupEnv("MONGO_MAX_RETRIES"); didFind {
+		retries_i, err := strconv.Atoi(retries)
+		if err != nil || retries_i < 0 {
+			return fmt.Errorf("Invalid MONGO_MAX_RETRIES provided: %s", retries)
+		}
+		mongoRetryPolicy.MaxRetries = retries_i
+	}
+	if backoff, didFind := os.LookupEnv("MONGO_RETRY_BACKOFF"); didFind {
+		duration, err := time.ParseDuration(backoff)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid MONGO_RETRY_BACKOFF provided: %s", backoff)
+		}
+		mongoRetryPolicy.InitialBackoff = duration
+	}
+	return nil
+}
+
+// Whether an error is caused by Mongo being temporarily unavailable, e.g. a
+// network failure or a primary stepdown, rather than by the operation itself
+func isTransientMongoError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, mongo.ErrClientDisconnected) {
+		return true
+	}
+	var serverError mongo.ServerError
+	if errors.As(err, &serverError) {
+		if serverError.HasErrorLabel("RetryableWriteError") || serverError.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+		for _, code := range transientMongoErrorCodes {
+			if serverError.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run a Mongo operation, retrying transient errors with exponential backoff.
+// Each attempt gets its own timeout. Non-transient errors are returned immediately.
+func retryMongo(operation string, fn func(ctx context.Context) error) error {
+	backoff := mongoRetryPolicy.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), mongoRetryPolicy.AttemptTimeout)
+		err := fn(ctx)
+		cancel()
+		if err == nil || !isTransientMongoError(err) || attempt >= mongoRetryPolicy.MaxRetries {
+			return err
+		}
+		metrics.MongoRetriesCounter.WithLabelValues(operation).Inc()
+		log.Printf("Mongo %s failed, retrying in %s: %v\n", operation, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > mongoRetryPolicy.MaxBackoff {
+			backoff = mongoRetryPolicy.MaxBackoff
+		}
+	}
+}
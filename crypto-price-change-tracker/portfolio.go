@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"crypto-price-change-tracker/metrics"
+	"crypto-price-change-tracker/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How often held assets and current prices are reloaded from Mongo
+const portfolioRefreshInterval = 30 * time.Second
+
+// Resolution of a portfolio snapshot series and how long its points are kept
+type SnapshotInterval struct {
+	Name    string
+	Seconds int64
+	// Points older than this are pruned by the retention policy. Zero keeps them forever
+	Retention time.Duration
+}
+
+// Snapshot series maintained by the tracker. Every tick updates the latest point
+// of each series, so older points are downsampled to one per interval.
+var snapshotIntervals = []SnapshotInterval{
+	{Name: "1m", Seconds: 60, Retention: 24 * time.Hour},
+	{Name: "1h", Seconds: 60 * 60, Retention: 30 * 24 * time.Hour},
+	{Name: "1d", Seconds: 24 * 60 * 60},
+}
+
+// `assets` collection document structure
+type AssetDB struct {
+	ID string `bson:"_id,omitempty"`
+	// ID of the user the asset belongs to
+	OwnerID       string  `bson:"ownerId"`
+	Name          string  `bson:"name"`
+	Amount        float32 `bson:"amount"`
+	PurchasePrice float32 `bson:"purchasePrice"`
+	PurchaseTime  float32 `bson:"purchaseTime"`
+	// "held" or "sold"
+	Status    string  `bson:"status"`
+	SalePrice float32 `bson:"salePrice"`
+	SaleTime  float32 `bson:"saleTime"`
+	// Exchange fees of the purchase and sale
+	PurchaseFee float32 `bson:"purchaseFee"`
+	SaleFee     float32 `bson:"saleFee"`
+}
+
+// `disposals` collection document structure, only the fields needed for the cost
+// of assets sold at the average cost of the held lots
+type DisposalDB struct {
+	// "fifo", "lifo", "hifo" or "average"
+	Method  string       `bson:"method"`
+	Matches []LotMatchDB `bson:"matches"`
+}
+type LotMatchDB struct {
+	// Sold asset recording the match
+	AssetID   string  `bson:"assetId"`
+	Amount    float32 `bson:"amount"`
+	CostBasis float64 `bson:"costBasis"`
+}
+
+// Unit costs of the assets sold by "average" disposals, by sold asset ID. Matches
+// AverageUnitCosts in the API's storage package
+func averageUnitCosts(disposals []DisposalDB) map[string]float64 {
+	costs := map[string]float64{}
+	for _, disposal := range disposals {
+		if disposal.Method != "average" {
+			continue
+		}
+		for _, match := range disposal.Matches {
+			if match.Amount != 0 {
+				costs[match.AssetID] = match.CostBasis / float64(match.Amount)
+			}
+		}
+	}
+	return costs
+}
+
+// Cost of an asset including its purchase fee, or at averageUnitCost when it was
+// sold by an "average" disposal. Matches CostBasis in the API's storage package, so
+// snapshots agree with /pnl and the CGT report
+func assetCostBasis(asset AssetDB, averageUnitCost float64) float64 {
+	if averageUnitCost != 0 {
+		return float64(asset.Amount) * averageUnitCost
+	}
+	return float64(asset.Amount)*float64(asset.PurchasePrice) + float64(asset.PurchaseFee)
+}
+
+// Market value of the held assets of a single crypto
+type PortfolioHoldingDB struct {
+	Name   string  `bson:"name"`
+	Amount float64 `bson:"amount"`
+	Price  float64 `bson:"price"`
+	Value  float64 `bson:"value"`
+	Cost   float64 `bson:"cost"`
+}
+
+// `portfolio_snapshots` collection document structure. Each user has their own series
+type PortfolioSnapshotDB struct {
+	ID       string `bson:"_id,omitempty"`
+	OwnerID  string `bson:"ownerId"`
+	Interval string `bson:"interval"`
+	// Start of the bucket, Unix epoch aligned to the interval in UTC
+	Time int64 `bson:"time"`
+	// Kafka event time of the tick the snapshot was last calculated on
+	UpdatedAt int64 `bson:"updatedAt"`
+	// Market value and purchase cost of held assets, including purchase fees
+	Value         float64 `bson:"value"`
+	Cost          float64 `bson:"cost"`
+	UnrealizedPnL float64 `bson:"unrealizedPnl"`
+	// Profit of sold assets, net of fees, at the same cost basis as /pnl
+	RealizedPnL float64              `bson:"realizedPnl"`
+	Holdings    []PortfolioHoldingDB `bson:"holdings"`
+}
+
+// Recalculates the portfolio value of every user on every tick and stores it in `portfolio_snapshots`
+type PortfolioTracker struct {
+	client *mongo.Client
+	assets []AssetDB
+	// Unit costs of assets sold at the average cost, see averageUnitCosts
+	averageCosts map[string]float64
+	prices       map[string]float32
+	refreshedAt  time.Time
+}
+
+func NewPortfolioTracker(client *mongo.Client) *PortfolioTracker {
+	return &PortfolioTracker{client: client, prices: map[string]float32{}}
+}
+
+// Update the portfolio with a tick applied to `prices` and save a snapshot of it
+func (t *PortfolioTracker) update(cryptoId string, price float32, checkedAt int64) error {
+	if time.Since(t.refreshedAt) > portfolioRefreshInterval {
+		if err := t.refresh(); err != nil {
+			log.Printf("Could not refresh portfolio: %v\n", err)
+			return err
+		}
+	}
+	t.prices[cryptoId] = price
+	for _, snapshot := range t.snapshots(checkedAt) {
+		for _, interval := range snapshotIntervals {
+			snapshot.Interval = interval.Name
+			snapshot.Time = candleStart(checkedAt, interval.Seconds)
+			if err := saveSnapshot(snapshot, t.client); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reload assets and disposals, and the prices of cryptos not ticked by this tracker
+func (t *PortfolioTracker) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cursor, err := t.client.Database("crypto").Collection("assets").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var assets []AssetDB
+	if err = cursor.All(ctx, &assets); err != nil {
+		return err
+	}
+	opts := options.Find().SetProjection(bson.M{"method": 1, "matches": 1})
+	cursor, err = t.client.Database("crypto").Collection("disposals").Find(ctx, bson.M{"method": "average"}, opts)
+	if err != nil {
+		return err
+	}
+	var disposals []DisposalDB
+	if err = cursor.All(ctx, &disposals); err != nil {
+		return err
+	}
+	cursor, err = t.client.Database("crypto").Collection("prices").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var prices []storage.Price
+	if err = cursor.All(ctx, &prices); err != nil {
+		return err
+	}
+	t.assets = assets
+	t.averageCosts = averageUnitCosts(disposals)
+	for _, price := range prices {
+		t.prices[price.Name] = price.Price
+	}
+	t.refreshedAt = time.Now()
+	return nil
+}
+
+// Value the cached assets of each user at the latest known prices, as /pnl does.
+// Costs include purchase fees and sale proceeds are net of sale fees
+func (t *PortfolioTracker) snapshots(checkedAt int64) []PortfolioSnapshotDB {
+	snapshots := []PortfolioSnapshotDB{}
+	// Index of each user in snapshots, and of each of their cryptos in Holdings
+	owners := map[string]int{}
+	holdings := map[string]map[string]int{}
+	for _, asset := range t.assets {
+		o, didFind := owners[asset.OwnerID]
+		if !didFind {
+			o = len(snapshots)
+			owners[asset.OwnerID] = o
+			holdings[asset.OwnerID] = map[string]int{}
+			snapshots = append(snapshots, PortfolioSnapshotDB{OwnerID: asset.OwnerID, UpdatedAt: checkedAt, Holdings: []PortfolioHoldingDB{}})
+		}
+		snapshot := &snapshots[o]
+		amount := float64(asset.Amount)
+		cost := assetCostBasis(asset, t.averageCosts[asset.ID])
+		if asset.Status == "sold" {
+			snapshot.RealizedPnL += amount*float64(asset.SalePrice) - float64(asset.SaleFee) - cost
+			continue
+		}
+		i, didFind := holdings[asset.OwnerID][asset.Name]
+		if !didFind {
+			i = len(snapshot.Holdings)
+			holdings[asset.OwnerID][asset.Name] = i
+			snapshot.Holdings = append(snapshot.Holdings, PortfolioHoldingDB{Name: asset.Name, Price: float64(t.prices[asset.Name])})
+		}
+		snapshot.Holdings[i].Amount += amount
+		snapshot.Holdings[i].Cost += cost
+	}
+	for o := range snapshots {
+		snapshot := &snapshots[o]
+		for i := range snapshot.Holdings {
+			holding := &snapshot.Holdings[i]
+			holding.Value = holding.Amount * holding.Price
+			snapshot.Value += holding.Value
+			snapshot.Cost += holding.Cost
+		}
+		snapshot.UnrealizedPnL = snapshot.Value - snapshot.Cost
+	}
+	return snapshots
+}
+
+// Upsert the point of a snapshot series, unless it was already updated by a later tick
+func saveSnapshot(snapshot PortfolioSnapshotDB, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := client.Database("crypto").Collection("portfolio_snapshots")
+	filter := bson.M{
+		"ownerId":   snapshot.OwnerID,
+		"interval":  snapshot.Interval,
+		"time":      snapshot.Time,
+		"updatedAt": bson.M{"$lte": snapshot.UpdatedAt},
+	}
+	_, err := collection.ReplaceOne(ctx, filter, &snapshot, options.Replace().SetUpsert(true))
+	// A later tick already updated the point, so the upsert hit the unique index
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Could not save %s portfolio snapshot of %s: %v\n", snapshot.Interval, snapshot.OwnerID, err)
+	}
+	return err
+}
+
+// Delete snapshot points older than the retention of their interval
+func pruneSnapshots(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database("crypto").Collection("portfolio_snapshots")
+	for _, interval := range snapshotIntervals {
+		if interval.Retention == 0 {
+			continue
+		}
+		cutoff := time.Now().Add(-interval.Retention).Unix()
+		deleteCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		result, err := collection.DeleteMany(deleteCtx, bson.M{"interval": interval.Name, "time": bson.M{"$lt": cutoff}})
+		cancel()
+		if err != nil {
+			return err
+		}
+		metrics.PrunedSnapshotsCounter.WithLabelValues(interval.Name).Add(float64(result.DeletedCount))
+	}
+	return nil
+}
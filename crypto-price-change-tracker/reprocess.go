@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"crypto-price-change-tracker/storage"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Give up replaying when no message is received for this long before reaching the end offsets
+const reprocessIdleTimeout = 30 * time.Second
+
+// Range of `crypto.price.updated` messages to replay into `prices` and `price_changes_over_time`
+type ReprocessOptions struct {
+	// Unix epochs bounding the replay by message time. 0 means unbounded
+	From int64
+	To   int64
+	// Partition to replay, or -1 for every partition
+	Partition int32
+	// Offsets bounding the replay when From and To are not set. -1 means unbounded
+	StartOffset int64
+	EndOffset   int64
+	// Delete the ticks in [From, To) and reset `prices` to their state at From before replaying
+	Truncate bool
+}
+
+// Parse a time given as a Unix epoch or RFC3339 string. Empty returns 0
+func parseReprocessTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %q, expected a Unix epoch or RFC3339", value)
+	}
+	return parsed.Unix(), nil
+}
+
+// Replay messages from Kafka into the database. A throwaway consumer group is used
+// and no offsets are committed, so the live change tracker is not disturbed.
+// Candles and indicators covering the replayed window are rebuilt afterwards.
+func reprocess(topic string, kafkaServer string, opts ReprocessOptions, client *mongo.Client) error {
+	if opts.Truncate && opts.From == 0 {
+		return errors.New("-truncate requires -from")
+	}
+	// Ticks of coins on other partitions would be deleted and never replayed
+	if opts.Truncate && opts.Partition >= 0 {
+		return errors.New("-truncate can not be used with -partition")
+	}
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  kafkaServer,
+		"group.id":           fmt.Sprintf("go-price-change-reprocess-%d", time.Now().UnixNano()),
+		"enable.auto.commit": false,
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// Work out the offsets to replay for each partition
+	assignment, endOffsets, err := reprocessOffsets(c, topic, opts)
+	if err != nil {
+		return err
+	}
+	if len(assignment) == 0 {
+		log.Println("No messages to reprocess")
+		return nil
+	}
+	for _, tp := range assignment {
+		log.Printf("Reprocessing partition %d from offset %d to %d\n", tp.Partition, tp.Offset, endOffsets[tp.Partition])
+	}
+	if opts.Truncate {
+		if err = truncateWindow(opts.From, opts.To, client); err != nil {
+			return err
+		}
+	}
+	err = c.Assign(assignment)
+	if err != nil {
+		return err
+	}
+	store := storage.NewMongoStore(client)
+	// Replay until every partition reaches its end offset
+	var replayed, failed int64
+	var minTime, maxTime int64
+	lastMessage := time.Now()
+	for len(endOffsets) > 0 {
+		if time.Since(lastMessage) > reprocessIdleTimeout {
+			return fmt.Errorf("No messages received for %s, %d partitions not finished", reprocessIdleTimeout, len(endOffsets))
+		}
+		ev := c.Poll(1000)
+		switch e := ev.(type) {
+		case *kafka.Message:
+			lastMessage = time.Now()
+			partition := e.TopicPartition.Partition
+			end, didFind := endOffsets[partition]
+			if !didFind {
+				continue
+			}
+			if int64(e.TopicPartition.Offset) >= end {
+				delete(endOffsets, partition)
+				continue
+			}
+			if int64(e.TopicPartition.Offset)+1 >= end {
+				delete(endOffsets, partition)
+			}
+			cryptoMessage, err := parseKafkaMessage(string(e.Value))
+			if err != nil {
+				failed++
+				log.Printf("Skipping unparseable message PART:[%d]OFF[%d]: %v\n", partition, e.TopicPartition.Offset, err)
+				continue
+			}
+			checkedAt := e.Timestamp.Unix()
+			_, _, err = updateDatabase(cryptoMessage.Name, cryptoMessage.Price, checkedAt, store)
+			if err != nil {
+				failed++
+				continue
+			}
+			replayed++
+			if minTime == 0 || checkedAt < minTime {
+				minTime = checkedAt
+			}
+			if checkedAt > maxTime {
+				maxTime = checkedAt
+			}
+		case kafka.Error:
+			log.Printf("Kafka error: %v\n", e)
+			if e.IsFatal() {
+				return e
+			}
+		case nil:
+			// The last offsets may be control records that are never delivered,
+			// so finish partitions whose position has passed the end offset
+			finishedPartitions(c, endOffsets)
+		}
+	}
+	log.Printf("Reprocessed %d messages, %d failed\n", replayed, failed)
+	// Ticks after the window were not replayed, so the prices are behind them
+	if opts.Truncate && opts.To > 0 {
+		if err = restoreLatestPrices(opts.To, client); err != nil {
+			return err
+		}
+	}
+	if replayed == 0 {
+		return nil
+	}
+	// Replayed ticks bypass the incremental rollups, so rebuild them
+	if err = rebuildCandles("", minTime, maxTime+1, client); err != nil {
+		return err
+	}
+	return rebuildIndicators("", client)
+}
+
+// Remove partitions from endOffsets whose consumer position reached their end offset
+func finishedPartitions(c *kafka.Consumer, endOffsets map[int32]int64) {
+	assignment, err := c.Assignment()
+	if err != nil {
+		return
+	}
+	positions, err := c.Position(assignment)
+	if err != nil {
+		return
+	}
+	for _, position := range positions {
+		end, didFind := endOffsets[position.Partition]
+		if didFind && position.Offset >= 0 && int64(position.Offset) >= end {
+			delete(endOffsets, position.Partition)
+		}
+	}
+}
+
+// Returns the partitions to assign at their start offsets, and the exclusive end
+// offset of each partition
+func reprocessOffsets(c *kafka.Consumer, topic string, opts ReprocessOptions) ([]kafka.TopicPartition, map[int32]int64, error) {
+	metadata, err := c.GetMetadata(&topic, false, 10000)
+	if err != nil {
+		return nil, nil, err
+	}
+	topicMetadata, didFind := metadata.Topics[topic]
+	if !didFind || topicMetadata.Error.Code() != kafka.ErrNoError {
+		return nil, nil, fmt.Errorf("Topic %s not found", topic)
+	}
+	var assignment []kafka.TopicPartition
+	endOffsets := map[int32]int64{}
+	for _, partitionMetadata := range topicMetadata.Partitions {
+		partition := partitionMetadata.ID
+		if opts.Partition >= 0 && partition != opts.Partition {
+			continue
+		}
+		low, high, err := c.QueryWatermarkOffsets(topic, partition, 10000)
+		if err != nil {
+			return nil, nil, err
+		}
+		start, end := low, high
+		if opts.StartOffset >= 0 && opts.StartOffset > start {
+			start = opts.StartOffset
+		}
+		if opts.EndOffset >= 0 && opts.EndOffset < end {
+			end = opts.EndOffset
+		}
+		// Times take precedence over offsets
+		if opts.From > 0 {
+			start, err = offsetForTime(c, topic, partition, opts.From, high)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if opts.To > 0 {
+			end, err = offsetForTime(c, topic, partition, opts.To, high)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if start >= end {
+			continue
+		}
+		assignment = append(assignment, kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: kafka.Offset(start)})
+		endOffsets[partition] = end
+	}
+	return assignment, endOffsets, nil
+}
+
+// Returns the offset of the first message at or after a Unix epoch, or high if there is none
+func offsetForTime(c *kafka.Consumer, topic string, partition int32, unix int64, high int64) (int64, error) {
+	offsets, err := c.OffsetsForTimes([]kafka.TopicPartition{
+		{Topic: &topic, Partition: partition, Offset: kafka.Offset(unix * 1000)},
+	}, 10000)
+	if err != nil {
+		return 0, err
+	}
+	if len(offsets) == 0 || offsets[0].Offset < 0 {
+		return high, nil
+	}
+	return int64(offsets[0].Offset), nil
+}
+
+// Reset every price to the last tick before from and delete ticks in [from, to), so
+// replayed ticks are applied and their price changes recalculated. Prices without a
+// tick before from are set to the first tick in the window without a time, so that
+// tick is replayed with no change. to of 0 means unbounded
+func truncateWindow(from int64, to int64, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	window := bson.M{"$gte": from}
+	if to > 0 {
+		window["$lt"] = to
+	}
+	ticks := client.Database("crypto").Collection("price_changes_over_time")
+	prices := client.Database("crypto").Collection("prices")
+	cursor, err := prices.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var currentPrices []storage.Price
+	if err = cursor.All(ctx, &currentPrices); err != nil {
+		return err
+	}
+	// Prices are reset before the ticks are deleted, as the first tick in the window is needed
+	for _, price := range currentPrices {
+		var previous storage.PriceChange
+		opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: -1}})
+		err = ticks.FindOne(ctx, bson.M{"name": price.Name, "time": bson.M{"$lt": from}}, opts).Decode(&previous)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			var first storage.PriceChange
+			opts = options.FindOne().SetSort(bson.D{{Key: "time", Value: 1}})
+			err = ticks.FindOne(ctx, bson.M{"name": price.Name, "time": window}, opts).Decode(&first)
+			previous = storage.PriceChange{Price: price.Price}
+			if err == nil {
+				previous.Price = first.Price
+			}
+		}
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"price": previous.Price}, "$unset": bson.M{"time": "", "previousPrice": ""}}
+		if previous.Time > 0 {
+			update = bson.M{"$set": bson.M{"price": previous.Price, "time": previous.Time}}
+		}
+		if _, err = prices.UpdateOne(ctx, bson.M{"name": price.Name}, update); err != nil {
+			return err
+		}
+	}
+	log.Printf("Reset %d prices to their state at %d\n", len(currentPrices), from)
+	deleted, err := ticks.DeleteMany(ctx, bson.M{"time": window})
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d ticks from price_changes_over_time\n", deleted.DeletedCount)
+	return nil
+}
+
+// Set every price back to its newest tick at or after to, which a replay of a window
+// ending at to moved the price back from. Prices already updated by a newer tick are kept
+func restoreLatestPrices(to int64, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	ticks := client.Database("crypto").Collection("price_changes_over_time")
+	prices := client.Database("crypto").Collection("prices")
+	cursor, err := prices.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var currentPrices []storage.Price
+	if err = cursor.All(ctx, &currentPrices); err != nil {
+		return err
+	}
+	restored := 0
+	for _, price := range currentPrices {
+		var latest storage.PriceChange
+		opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: -1}})
+		filter := bson.M{"name": price.Name, "time": bson.M{"$gte": to}, "stale": bson.M{"$ne": true}}
+		err = ticks.FindOne(ctx, filter, opts).Decode(&latest)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		olderPrice := bson.M{
+			"name": price.Name,
+			"$or": bson.A{
+				bson.M{"time": bson.M{"$exists": false}},
+				bson.M{"time": bson.M{"$lte": latest.Time}},
+			},
+		}
+		update := bson.M{"$set": bson.M{
+			"price":         latest.Price,
+			"time":          latest.Time,
+			"previousPrice": latest.Price - latest.PriceChange,
+		}}
+		result, err := prices.UpdateOne(ctx, olderPrice, update)
+		if err != nil {
+			return err
+		}
+		restored += int(result.ModifiedCount)
+	}
+	log.Printf("Restored %d prices to their latest tick at or after %d\n", restored, to)
+	return nil
+}
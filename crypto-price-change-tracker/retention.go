@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"crypto-price-change-tracker/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Number of raw ticks archived and deleted in one batch
+const retentionBatchSize = 10000
+
+// Lease in the `leases` collection held by the one tracker instance that prunes.
+// It is renewed before every batch, so it only expires when its holder stops
+const (
+	retentionLeaseName = "retention"
+	retentionLeaseTTL  = 10 * time.Minute
+)
+
+// Retention policy for raw price history. Candle rollups are kept forever.
+// `time` is stored as a Unix epoch number rather than a BSON date, so a TTL index
+// cannot be used and expired ticks are removed by a scheduled pruner instead.
+type RetentionPolicy struct {
+	// Raw ticks older than this are removed. Zero disables pruning
+	RawRetention time.Duration
+	// How often the pruner runs
+	Interval time.Duration
+	// Directory to archive expired ticks to before deletion. Empty disables archiving
+	ArchiveDir string
+}
+
+// Read the retention policy from environment variables
+//
+//	RAW_RETENTION_DAYS  days of raw ticks to keep, 0 to keep forever. Default 30
+//	RETENTION_INTERVAL  how often to prune, as a Go duration. Default 1h
+//	ARCHIVE_DIR         directory to write gzip NDJSON archives to. Default no archive
+func loadRetentionPolicy() (RetentionPolicy, error) {
+	policy := RetentionPolicy{
+		RawRetention: 30 * 24 * time.Hour,
+		Interval:     time.Hour,
+	}
+	if days, didFind := os.LookupEnv("RAW_RETENTION_DAYS"); didFind {
+		days_i, err := strconv.Atoi(days)
+		if err != nil || days_i < 0 {
+			return policy, fmt.Errorf("Invalid RAW_RETENTION_DAYS provided: %s", days)
+		}
+		policy.RawRetention = time.Duration(days_i) * 24 * time.Hour
+	}
+	if interval, didFind := os.LookupEnv("RETENTION_INTERVAL"); didFind {
+		duration, err := time.ParseDuration(interval)
+		if err != nil || duration <= 0 {
+			return policy, fmt.Errorf("Invalid RETENTION_INTERVAL provided: %s", interval)
+		}
+		policy.Interval = duration
+	}
+	policy.ArchiveDir = os.Getenv("ARCHIVE_DIR")
+	return policy, nil
+}
+
+// Prune expired raw ticks and downsampled portfolio snapshots every policy.Interval until ctx is cancelled.
+// Every tracker instance runs this, but only the holder of the retention lease prunes
+func runRetention(ctx context.Context, policy RetentionPolicy, client *mongo.Client) {
+	if policy.RawRetention == 0 {
+		log.Println("Raw price history retention disabled")
+	} else {
+		log.Printf("Pruning raw price history older than %s every %s\n", policy.RawRetention, policy.Interval)
+	}
+	lease := newLease(client, retentionLeaseName, retentionLeaseTTL)
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+	for {
+		held, err := lease.renew(ctx)
+		if err != nil {
+			metrics.FailedRetentionRunsCounter.WithLabelValues().Inc()
+			log.Printf("Could not take the retention lease: %v\n", err)
+		}
+		if held && policy.RawRetention > 0 {
+			cutoff := time.Now().Add(-policy.RawRetention).Unix()
+			removed, err := pruneRawTicks(ctx, cutoff, policy.ArchiveDir, lease, client)
+			if err != nil {
+				metrics.FailedRetentionRunsCounter.WithLabelValues().Inc()
+				log.Printf("Could not prune raw price history: %v\n", err)
+			} else if removed > 0 {
+				log.Printf("Pruned %d raw ticks older than %d\n", removed, cutoff)
+			}
+		}
+		// Snapshot series have fixed retention, see snapshotIntervals
+		if held {
+			if err := pruneSnapshots(ctx, client); err != nil {
+				metrics.FailedRetentionRunsCounter.WithLabelValues().Inc()
+				log.Printf("Could not prune portfolio snapshots: %v\n", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Delete ticks in `price_changes_over_time` with a time before cutoff, archiving
+// them to archiveDir first when set. Stops when the lease is lost.
+// Returns the number of ticks deleted.
+func pruneRawTicks(ctx context.Context, cutoff int64, archiveDir string, lease *lease, client *mongo.Client) (int64, error) {
+	collection := client.Database("crypto").Collection("price_changes_over_time")
+	filter := bson.M{"time": bson.M{"$lt": cutoff}}
+	var removed int64
+	for {
+		if ctx.Err() != nil {
+			return removed, ctx.Err()
+		}
+		held, err := lease.renew(ctx)
+		if err != nil {
+			return removed, err
+		} else if !held {
+			return removed, errors.New("retention lease taken by another instance")
+		}
+		// Load a batch of expired ticks, oldest first
+		findCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}}).SetLimit(retentionBatchSize)
+		cursor, err := collection.Find(findCtx, filter, opts)
+		if err != nil {
+			cancel()
+			return removed, err
+		}
+		var batch []bson.M
+		err = cursor.All(findCtx, &batch)
+		cancel()
+		if err != nil {
+			return removed, err
+		}
+		if len(batch) == 0 {
+			return removed, nil
+		}
+		// Archive before deleting, so a failed archive never loses data
+		if archiveDir != "" {
+			err = archiveRawTicks(archiveDir, batch)
+			if err != nil {
+				return removed, err
+			}
+		}
+		ids := make(bson.A, 0, len(batch))
+		for _, tick := range batch {
+			ids = append(ids, tick["_id"])
+		}
+		deleteCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		result, err := collection.DeleteMany(deleteCtx, bson.M{"_id": bson.M{"$in": ids}})
+		cancel()
+		if err != nil {
+			return removed, err
+		}
+		removed += result.DeletedCount
+		metrics.PrunedTicksCounter.WithLabelValues().Add(float64(result.DeletedCount))
+	}
+}
+
+// Write ticks to a new gzip compressed NDJSON file named after the first and last tick
+// times and when it was written, so a batch archived again after a failed delete
+// never overwrites an earlier archive. The file is synced and closed before returning.
+func archiveRawTicks(archiveDir string, ticks []bson.M) error {
+	err := os.MkdirAll(archiveDir, 0o755)
+	if err != nil {
+		return err
+	}
+	first := ticks[0]["time"]
+	last := ticks[len(ticks)-1]["time"]
+	name := fmt.Sprintf("price_changes_over_time_%v_%v_%d.ndjson.gz", first, last, time.Now().UnixNano())
+	path := filepath.Join(archiveDir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	buffered := bufio.NewWriter(gz)
+	for _, tick := range ticks {
+		line, err := bson.MarshalExtJSON(tick, false, false)
+		if err != nil {
+			return err
+		}
+		buffered.Write(line)
+		buffered.WriteByte('\n')
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	log.Printf("Archived %d raw ticks to %s\n", len(ticks), path)
+	return nil
+}
+
+// Lease on a named job shared by the tracker instances, stored in the `leases` collection
+type lease struct {
+	collection *mongo.Collection
+	name       string
+	holder     string
+	ttl        time.Duration
+}
+
+// Create a lease held by this process when renewed
+func newLease(client *mongo.Client, name string, ttl time.Duration) *lease {
+	hostname, _ := os.Hostname()
+	return &lease{
+		collection: client.Database("crypto").Collection("leases"),
+		name:       name,
+		holder:     fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		ttl:        ttl,
+	}
+}
+
+// Take the lease, or extend it when already held, until ttl from now. Returns false
+// when another instance holds a lease that has not expired
+func (l *lease) renew(ctx context.Context) (bool, error) {
+	renewCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	now := time.Now()
+	filter := bson.M{
+		"_id": l.name,
+		"$or": bson.A{bson.M{"holder": l.holder}, bson.M{"expiresAt": bson.M{"$lt": now.Unix()}}},
+	}
+	update := bson.M{"$set": bson.M{"holder": l.holder, "expiresAt": now.Add(l.ttl).Unix()}}
+	// When the filter does not match because another instance holds the lease, the
+	// upsert inserts a second document with the same _id and fails
+	_, err := l.collection.UpdateOne(renewCtx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
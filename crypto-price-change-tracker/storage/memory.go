@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// Store kept in memory, for tests and local development. Nothing is persisted
+// or shared with other services, so prices must be added with PutPrice
+type MemoryStore struct {
+	mu      sync.Mutex
+	prices  map[string]Price
+	changes map[PriceChange]PriceChange
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{prices: map[string]Price{}, changes: map[PriceChange]PriceChange{}}
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// Set the current price of a crypto
+func (s *MemoryStore) PutPrice(price Price) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, didFind := s.prices[price.Name]; didFind {
+		price.ID = existing.ID
+	} else {
+		price.ID = newID()
+	}
+	s.prices[price.Name] = price
+}
+
+func (s *MemoryStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	price, didFind := s.prices[name]
+	if !didFind {
+		return price, ErrNotFound
+	}
+	return price, nil
+}
+
+func (s *MemoryStore) ApplyPrice(ctx context.Context, name string, price float32, checkedAt int64) (Price, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, didFind := s.prices[name]
+	if !didFind {
+		return current, false, ErrNotFound
+	}
+	if current.Time > checkedAt {
+		return current, false, nil
+	}
+	if current.Time != checkedAt || current.Price != price {
+		current.PreviousPrice = current.Price
+	}
+	current.Price = price
+	current.Time = checkedAt
+	s.prices[name] = current
+	return current, true, nil
+}
+
+func (s *MemoryStore) RecordPriceChange(ctx context.Context, change PriceChange) (PriceChange, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Ticks are unique per name, time and price
+	key := PriceChange{Name: change.Name, Time: change.Time, Price: change.Price}
+	if stored, didFind := s.changes[key]; didFind {
+		return stored, false, nil
+	}
+	change.ID = newID()
+	s.changes[key] = change
+	return change, true, nil
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store backed by the `crypto` MongoDB database.
+// Errors from the driver are returned unwrapped, so callers can detect transient errors
+type MongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+// Connect to MongoDB
+func OpenMongo(ctx context.Context, url string) (*MongoStore, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	return NewMongoStore(client), nil
+}
+
+// Create a store using an existing client
+func NewMongoStore(client *mongo.Client) *MongoStore {
+	return &MongoStore{client: client, db: client.Database("crypto")}
+}
+
+// Client for collections without a repository
+func (s *MongoStore) Client() *mongo.Client {
+	return s.client
+}
+
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+func (s *MongoStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	var price Price
+	err := s.db.Collection("prices").FindOne(ctx, bson.M{"name": name}).Decode(&price)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return price, ErrNotFound
+	}
+	return price, err
+}
+
+// The previous price is read and replaced in a single FindOneAndUpdate, so
+// concurrent trackers processing the same coin always see a consistent previous price
+func (s *MongoStore) ApplyPrice(ctx context.Context, name string, price float32, checkedAt int64) (Price, bool, error) {
+	// Only match if the stored price is not newer than this tick
+	filter := bson.M{
+		"name": name,
+		"$or": bson.A{
+			bson.M{"time": bson.M{"$exists": false}},
+			bson.M{"time": bson.M{"$lte": checkedAt}},
+		},
+	}
+	isReapplied := bson.M{"$and": bson.A{
+		bson.M{"$eq": bson.A{"$time", checkedAt}},
+		bson.M{"$eq": bson.A{"$price", price}},
+	}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"previousPrice": bson.M{"$cond": bson.A{isReapplied, "$previousPrice", "$price"}},
+			"price":         price,
+			"time":          checkedAt,
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var current Price
+	err := s.db.Collection("prices").FindOneAndUpdate(ctx, filter, update, opts).Decode(&current)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Either the crypto is not tracked yet, or a newer tick was already applied
+		current, err = s.FindPrice(ctx, name)
+		return current, false, err
+	}
+	return current, err == nil, err
+}
+
+func (s *MongoStore) RecordPriceChange(ctx context.Context, change PriceChange) (PriceChange, bool, error) {
+	change.ID = ""
+	filter := bson.M{"name": change.Name, "time": change.Time, "lastPrice": change.Price}
+	collection := s.db.Collection("price_changes_over_time")
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": &change}, options.Update().SetUpsert(true))
+	// A concurrent upsert inserting the same tick first fails on the unique index
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return change, false, err
+	}
+	recorded := err == nil && result.UpsertedCount == 1
+	if recorded {
+		if id, isObjectID := result.UpsertedID.(primitive.ObjectID); isObjectID {
+			change.ID = id.Hex()
+			return change, true, nil
+		}
+	}
+	var stored PriceChange
+	err = collection.FindOne(ctx, filter).Decode(&stored)
+	return stored, recorded, err
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Tables mirroring the Mongo collections. Created by every service using the
+// SQLite backend, so keep in sync with the API and producer.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS prices (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	price REAL NOT NULL,
+	time INTEGER,
+	previous_price REAL
+);
+CREATE TABLE IF NOT EXISTS price_changes_over_time (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	last_price REAL NOT NULL,
+	price_change REAL NOT NULL,
+	time INTEGER NOT NULL,
+	stale INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (name, time, last_price)
+);
+CREATE INDEX IF NOT EXISTS price_changes_over_time_time ON price_changes_over_time (time);
+CREATE TABLE IF NOT EXISTS assets (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	amount REAL NOT NULL,
+	purchase_price REAL NOT NULL,
+	purchase_time REAL NOT NULL,
+	status TEXT NOT NULL,
+	sale_price REAL NOT NULL,
+	sale_time REAL NOT NULL
+);
+`
+
+// Store backed by an SQLite database file, for lightweight deployments
+type SQLStore struct {
+	db *sql.DB
+}
+
+// Open an SQLite database, creating the tables if they do not exist.
+// WAL mode and a busy timeout let several services share the file. Transactions
+// take the write lock when they begin, so a price is not replaced between being
+// read and written.
+func OpenSQLite(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+const priceColumns = `id, name, price, COALESCE(time, 0), COALESCE(previous_price, 0)`
+
+func scanPrice(row interface{ Scan(...any) error }) (Price, error) {
+	var price Price
+	err := row.Scan(&price.ID, &price.Name, &price.Price, &price.Time, &price.PreviousPrice)
+	if errors.Is(err, sql.ErrNoRows) {
+		return price, ErrNotFound
+	}
+	return price, err
+}
+
+func (s *SQLStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	return scanPrice(s.db.QueryRowContext(ctx, `SELECT `+priceColumns+` FROM prices WHERE name = ?`, name))
+}
+
+func (s *SQLStore) ApplyPrice(ctx context.Context, name string, price float32, checkedAt int64) (Price, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Price{}, false, err
+	}
+	defer tx.Rollback()
+	current, err := scanPrice(tx.QueryRowContext(ctx, `SELECT `+priceColumns+` FROM prices WHERE name = ?`, name))
+	if err != nil {
+		return current, false, err
+	}
+	if current.Time > checkedAt {
+		return current, false, nil
+	}
+	if current.Time != checkedAt || current.Price != price {
+		current.PreviousPrice = current.Price
+	}
+	current.Price = price
+	current.Time = checkedAt
+	_, err = tx.ExecContext(ctx, `UPDATE prices SET price = ?, time = ?, previous_price = ? WHERE id = ?`,
+		current.Price, current.Time, current.PreviousPrice, current.ID)
+	if err != nil {
+		return current, false, err
+	}
+	return current, true, tx.Commit()
+}
+
+func (s *SQLStore) RecordPriceChange(ctx context.Context, change PriceChange) (PriceChange, bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO price_changes_over_time (id, name, last_price, price_change, time, stale)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (name, time, last_price) DO NOTHING`,
+		newID(), change.Name, change.Price, change.PriceChange, change.Time, change.Stale)
+	if err != nil {
+		return change, false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return change, false, err
+	}
+	var stored PriceChange
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, name, last_price, price_change, time, stale FROM price_changes_over_time
+		WHERE name = ? AND time = ? AND last_price = ?`, change.Name, change.Time, change.Price)
+	err = row.Scan(&stored.ID, &stored.Name, &stored.Price, &stored.PriceChange, &stored.Time, &stored.Stale)
+	return stored, inserted == 1, err
+}
@@ -0,0 +1,99 @@
+// Package storage provides repositories for the current prices and price history
+// written by the change tracker, backed by MongoDB, SQLite or memory.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Backends selected by STORAGE_BACKEND
+const (
+	BackendMongo  = "mongo"
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+)
+
+// Returned when a crypto is not tracked yet
+var ErrNotFound = errors.New("not found")
+
+// `prices` collection document structure
+type Price struct {
+	ID    string  `bson:"_id,omitempty"`
+	Name  string  `bson:"name"`
+	Price float32 `bson:"price"`
+	// Kafka event time of the last tick applied to `price`
+	Time int64 `bson:"time,omitempty"`
+	// Price replaced by the last applied tick
+	PreviousPrice float32 `bson:"previousPrice,omitempty"`
+}
+
+// `price_changes_over_time` collection document structure
+type PriceChange struct {
+	ID          string  `bson:"_id,omitempty"`
+	Name        string  `bson:"name"`
+	Price       float32 `bson:"lastPrice"`
+	PriceChange float32 `bson:"priceChange"`
+	Time        int64   `bson:"time"`
+	// True when the tick arrived after a newer tick was already applied
+	Stale bool `bson:"stale,omitempty"`
+}
+
+// Current crypto prices
+type PriceRepository interface {
+	// Returns ErrNotFound when the crypto is not tracked
+	FindPrice(ctx context.Context, name string) (Price, error)
+	// Replace the price of a crypto with a tick, unless a newer tick was already
+	// applied. The replaced price is kept as PreviousPrice, unless the same tick
+	// was already applied, so applying a tick twice gives the same result.
+	// Returns the current price and whether the tick was applied, or ErrNotFound
+	// when the crypto is not tracked
+	ApplyPrice(ctx context.Context, name string, price float32, checkedAt int64) (Price, bool, error)
+}
+
+// History of crypto prices
+type PriceChangeRepository interface {
+	// Store a tick unless a tick with the same name, time and price is already
+	// stored. Returns the stored tick and whether this call stored it, so
+	// redelivered ticks can be told apart
+	RecordPriceChange(ctx context.Context, change PriceChange) (PriceChange, bool, error)
+}
+
+// All repositories of a backend
+type Store interface {
+	PriceRepository
+	PriceChangeRepository
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Storage configuration, read from environment variables by main
+type Config struct {
+	// One of "mongo", "sqlite" or "memory"
+	Backend  string
+	MongoURL string
+	// SQLite database file
+	SQLitePath string
+}
+
+// Open the store selected by config
+func Open(ctx context.Context, config Config) (Store, error) {
+	switch config.Backend {
+	case BackendMongo, "":
+		return OpenMongo(ctx, config.MongoURL)
+	case BackendSQLite:
+		return OpenSQLite(config.SQLitePath)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+// IDs are Mongo ObjectIDs in every backend, so they are valid when switching backends
+func newID() string {
+	return primitive.NewObjectID().Hex()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"crypto-price-change-tracker/metrics"
+	"crypto-price-change-tracker/storage"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// Published to `crypto.price.stored` once a tick is persisted to `price_changes_over_time`
+type PriceStoredEvent struct {
+	// ID of the `price_changes_over_time` document
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Price       float32 `json:"price"`
+	PriceChange float32 `json:"priceChange"`
+	// Kafka event time of the tick
+	Time int64 `json:"time"`
+	// True when the tick did not update `prices`, see updateDatabase
+	Stale bool `json:"stale"`
+}
+
+// Publishes stored events and commits consumer offsets.
+// With a transactional ID each event is produced in a Kafka transaction together
+// with the offset of the consumed message, so downstream consumers using
+// isolation.level=read_committed see every stored tick exactly once. Without one,
+// events are produced by an idempotent producer and offsets are auto committed,
+// so an event may be published again after a restart.
+type StoredPublisher struct {
+	producer      *kafka.Producer
+	consumer      *kafka.Consumer
+	topic         string
+	transactional bool
+}
+
+// Create the producer for stored events. transactionalId must be unique per tracker
+// instance, or empty to publish without transactions.
+func NewStoredPublisher(kafkaServer string, transactionalId string, topic string, consumer *kafka.Consumer) (*StoredPublisher, error) {
+	config := &kafka.ConfigMap{
+		"bootstrap.servers":  kafkaServer,
+		"enable.idempotence": true,
+	}
+	if transactionalId != "" {
+		config.SetKey("transactional.id", transactionalId)
+	}
+	producer, err := kafka.NewProducer(config)
+	if err != nil {
+		return nil, err
+	}
+	publisher := &StoredPublisher{
+		producer:      producer,
+		consumer:      consumer,
+		topic:         topic,
+		transactional: transactionalId != "",
+	}
+	go publisher.deliveryReports()
+	if publisher.transactional {
+		// Fences off earlier instances with the same transactional ID and aborts their open transactions
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err = producer.InitTransactions(ctx); err != nil {
+			producer.Close()
+			return nil, err
+		}
+	}
+	return publisher, nil
+}
+
+// Log and count events that could not be delivered
+func (s *StoredPublisher) deliveryReports() {
+	for ev := range s.producer.Events() {
+		if m, ok := ev.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			metrics.FailedStoredEventsCounter.WithLabelValues().Inc()
+			log.Printf("Could not deliver stored event to Kafka: %v\n", m.TopicPartition.Error)
+		}
+	}
+}
+
+// Publish the stored event for a consumed message and mark the message consumed.
+// change is nil for messages that were skipped, in which case only the offset is committed.
+// Returns an error when the message must be consumed again.
+func (s *StoredPublisher) publish(message *kafka.Message, change *storage.PriceChange) error {
+	var event *kafka.Message
+	if change != nil {
+		value, err := json.Marshal(PriceStoredEvent{
+			ID:          change.ID,
+			Name:        change.Name,
+			Price:       change.Price,
+			PriceChange: change.PriceChange,
+			Time:        change.Time,
+			Stale:       change.Stale,
+		})
+		if err != nil {
+			return err
+		}
+		event = &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &s.topic, Partition: kafka.PartitionAny},
+			Key:            []byte(change.Name),
+			Value:          value,
+			Timestamp:      message.Timestamp,
+		}
+	}
+	if !s.transactional {
+		if event != nil {
+			if err := s.producer.Produce(event, nil); err != nil {
+				metrics.FailedStoredEventsCounter.WithLabelValues().Inc()
+				log.Printf("Could not produce stored event for %s: %v\n", change.Name, err)
+			}
+		}
+		// A later stored offset also covers this message, so a failure is only logged
+		if _, err := s.consumer.StoreMessage(message); err != nil {
+			log.Printf("Could not store offset %d: %v\n", message.TopicPartition.Offset, err)
+		}
+		return nil
+	}
+	err := s.commitTransaction(message, event)
+	if err != nil {
+		metrics.FailedStoredEventsCounter.WithLabelValues().Inc()
+		if fatalErr := s.abortTransaction(err); fatalErr != nil {
+			return fatalErr
+		}
+	}
+	return err
+}
+
+// Produce an event and commit the offset after message in a single transaction
+func (s *StoredPublisher) commitTransaction(message *kafka.Message, event *kafka.Message) error {
+	if err := s.producer.BeginTransaction(); err != nil {
+		return err
+	}
+	if event != nil {
+		if err := s.producer.Produce(event, nil); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	groupMetadata, err := s.consumer.GetConsumerGroupMetadata()
+	if err != nil {
+		return err
+	}
+	next := message.TopicPartition
+	next.Offset++
+	err = s.producer.SendOffsetsToTransaction(ctx, []kafka.TopicPartition{next}, groupMetadata)
+	if err != nil {
+		return err
+	}
+	return s.producer.CommitTransaction(ctx)
+}
+
+// Abort the current transaction after a failure. Returns the fatal error when the
+// producer can no longer be used, so the tracker stops and restarts with a new producer.
+func (s *StoredPublisher) abortTransaction(cause error) error {
+	if isFatalKafkaError(cause) {
+		return cause
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.producer.AbortTransaction(ctx); err != nil {
+		if isFatalKafkaError(err) {
+			return err
+		}
+		log.Printf("Could not abort transaction: %v\n", err)
+	}
+	return nil
+}
+
+// Whether err is a Kafka error after which the client can not be used again
+func isFatalKafkaError(err error) bool {
+	var kafkaErr kafka.Error
+	return errors.As(err, &kafkaErr) && kafkaErr.IsFatal()
+}
+
+// Wait for outstanding events and close the producer
+func (s *StoredPublisher) Close() {
+	if !s.transactional {
+		s.producer.Flush(5000)
+	}
+	s.producer.Close()
+}
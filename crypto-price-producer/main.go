@@ -15,12 +15,9 @@ import (
 	"math"
 
 	"crypto-price-producer/metrics" 
+	"crypto-price-producer/storage"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	
-    "go.mongodb.org/mongo-driver/bson"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/mongo/options"
 )
 const (
     coinbaseCryptoAPI   = "https://api.coinbase.com/v2/prices/%s-%s/spot"
@@ -38,26 +35,12 @@ type coinbasePriceResponse struct {
         Amount string `json:"amount"`
     } `json:"data"`
 }
-// `prices` collection document structure
-type CryptoPriceDB struct {
-    ID    string `bson:"_id,omitempty"`
-    Name  string `bson:"name"`
-    Price float32	 `bson:"price"`
-}
-
-func lookupOldCryptoPrice(cryptoId string, client *mongo.Client) (float32, error) { 
-	// 5s timeout for MongoDB lookup
+func lookupOldCryptoPrice(cryptoId string, store storage.Store) (float32, error) { 
+	// 5s timeout for lookup
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
-	// Choose database and collection
-    collection := client.Database("crypto").Collection("prices")
-
-    // Define a filter to look up a specific user
-    filter := bson.M{"name": cryptoId}
-
-	var result CryptoPriceDB
-    err := collection.FindOne(ctx, filter).Decode(&result)
+	result, err := store.FindPrice(ctx, cryptoId)
     if err != nil {
         log.Println("Crypto " + cryptoId + " not found:", err)
 		return -1, err
@@ -157,20 +140,35 @@ func main() {
 	if !didFind { 
 		panic("No crypto ID provided")
 	}
+	// "mongo" (default), "sqlite" or "memory"
+	backend, didFind := os.LookupEnv("STORAGE_BACKEND")
+	if !didFind { 
+		backend = storage.BackendMongo
+	}
 	// Example: "mongodb://localhost:27017"
 	mongoURL, didFind := os.LookupEnv("MONGO_URL")
-	if !didFind { 
+	if !didFind && backend == storage.BackendMongo { 
 		panic("No MongoDB URL provided")
 	}
+	// Example: "/data/crypto.db"
+	sqlitePath, didFind := os.LookupEnv("SQLITE_PATH")
+	if !didFind && backend == storage.BackendSQLite { 
+		panic("No SQLite path provided")
+	}
 	log.Printf("STARTUP: Tracking [%s] prices every 5s", cryptoId)
-	// Connect to MongoDB 
+	// Connect to storage 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
+	store, err := storage.Open(ctx, storage.Config{
+		Backend: backend,
+		MongoURL: mongoURL,
+		SQLitePath: sqlitePath,
+	})
     if err != nil {
         panic(err)
     }
-    defer client.Disconnect(ctx)
+    defer store.Close(context.Background())
+	log.Printf("Using %s storage\n", backend)
 	// Create Kafka Producer client
 	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": kafkaServer})
 	if err != nil {
@@ -197,28 +195,29 @@ func main() {
 			}
 
 			// Lookup previous price from DB
-			_, err := lookupOldCryptoPrice(cryptoId, client)
+			_, err := lookupOldCryptoPrice(cryptoId, store)
 			// err != nil means we are tracking the crypto for the first time!
 			if err != nil { 
 				log.Println("Creating new `prices` document for " + cryptoId)
-				createNewPrice := CryptoPriceDB{
+				createNewPrice := storage.Price{
 					Name: cryptoId,
 					Price: cryptoPrice,
 				}
 				insertCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 				defer cancel()
 				// Insert record with current price
-				collection := client.Database("crypto").Collection("prices")
-				_, err = collection.InsertOne(insertCtx, &createNewPrice)
+				err = store.CreatePrice(insertCtx, createNewPrice)
 				if err != nil {
 					log.Printf("Insert new `prices` document failed: %v\n", err)
 				}else { 
 					log.Printf("Created new crypto success for %s\n", cryptoId)
 				}
 			}
-			// Publish Message
+			// Publish Message. Keyed by crypto so every price of a crypto lands on the same
+			// partition, and is processed in order by the same change tracker
 			err = p.Produce(&kafka.Message{
 				TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+				Key:            []byte(cryptoId),
 				Value:          []byte(fmt.Sprintf("%s:%f", cryptoId, cryptoPrice)),
 			}, nil)
 			if err != nil {
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// Store kept in memory, for tests and local development. Nothing is persisted
+// or shared with other services
+type MemoryStore struct {
+	mu     sync.Mutex
+	prices map[string]Price
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{prices: map[string]Price{}}
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	price, didFind := s.prices[name]
+	if !didFind {
+		return price, ErrNotFound
+	}
+	return price, nil
+}
+
+func (s *MemoryStore) CreatePrice(ctx context.Context, price Price) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, didFind := s.prices[price.Name]; didFind {
+		return nil
+	}
+	price.ID = newID()
+	s.prices[price.Name] = price
+	return nil
+}
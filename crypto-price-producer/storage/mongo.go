@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store backed by the `crypto` MongoDB database
+type MongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+// Connect to MongoDB
+func OpenMongo(ctx context.Context, url string) (*MongoStore, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	return &MongoStore{client: client, db: client.Database("crypto")}, nil
+}
+
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+func (s *MongoStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	var price Price
+	err := s.db.Collection("prices").FindOne(ctx, bson.M{"name": name}).Decode(&price)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return price, ErrNotFound
+	}
+	return price, err
+}
+
+func (s *MongoStore) CreatePrice(ctx context.Context, price Price) error {
+	price.ID = ""
+	_, err := s.db.Collection("prices").InsertOne(ctx, &price)
+	return err
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Tables mirroring the Mongo collections. Created by every service using the
+// SQLite backend, so keep in sync with the API and change tracker.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS prices (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	price REAL NOT NULL,
+	time INTEGER,
+	previous_price REAL
+);
+CREATE TABLE IF NOT EXISTS price_changes_over_time (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	last_price REAL NOT NULL,
+	price_change REAL NOT NULL,
+	time INTEGER NOT NULL,
+	stale INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (name, time, last_price)
+);
+CREATE INDEX IF NOT EXISTS price_changes_over_time_time ON price_changes_over_time (time);
+CREATE TABLE IF NOT EXISTS assets (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	amount REAL NOT NULL,
+	purchase_price REAL NOT NULL,
+	purchase_time REAL NOT NULL,
+	status TEXT NOT NULL,
+	sale_price REAL NOT NULL,
+	sale_time REAL NOT NULL
+);
+`
+
+// Store backed by an SQLite database file, for lightweight deployments
+type SQLStore struct {
+	db *sql.DB
+}
+
+// Open an SQLite database, creating the tables if they do not exist.
+// WAL mode and a busy timeout let several services share the file.
+func OpenSQLite(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) FindPrice(ctx context.Context, name string) (Price, error) {
+	var price Price
+	row := s.db.QueryRowContext(ctx, `SELECT id, name, price FROM prices WHERE name = ?`, name)
+	err := row.Scan(&price.ID, &price.Name, &price.Price)
+	if errors.Is(err, sql.ErrNoRows) {
+		return price, ErrNotFound
+	}
+	return price, err
+}
+
+func (s *SQLStore) CreatePrice(ctx context.Context, price Price) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO prices (id, name, price) VALUES (?, ?, ?) ON CONFLICT (name) DO NOTHING`,
+		newID(), price.Name, price.Price)
+	return err
+}
@@ -0,0 +1,71 @@
+// Package storage provides the repository for current prices used by the producer,
+// backed by MongoDB, SQLite or memory.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Backends selected by STORAGE_BACKEND
+const (
+	BackendMongo  = "mongo"
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+)
+
+// Returned when a crypto is not tracked yet
+var ErrNotFound = errors.New("not found")
+
+// `prices` collection document structure
+type Price struct {
+	ID    string  `bson:"_id,omitempty"`
+	Name  string  `bson:"name"`
+	Price float32 `bson:"price"`
+}
+
+// Current crypto prices
+type PriceRepository interface {
+	// Returns ErrNotFound when the crypto is not tracked
+	FindPrice(ctx context.Context, name string) (Price, error)
+	// Start tracking a crypto at an initial price
+	CreatePrice(ctx context.Context, price Price) error
+}
+
+// All repositories of a backend
+type Store interface {
+	PriceRepository
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Storage configuration, read from environment variables by main
+type Config struct {
+	// One of "mongo", "sqlite" or "memory"
+	Backend  string
+	MongoURL string
+	// SQLite database file
+	SQLitePath string
+}
+
+// Open the store selected by config
+func Open(ctx context.Context, config Config) (Store, error) {
+	switch config.Backend {
+	case BackendMongo, "":
+		return OpenMongo(ctx, config.MongoURL)
+	case BackendSQLite:
+		return OpenSQLite(config.SQLitePath)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+// IDs are Mongo ObjectIDs in every backend, so they are valid when switching backends
+func newID() string {
+	return primitive.NewObjectID().Hex()
+}